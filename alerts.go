@@ -0,0 +1,272 @@
+/*
+ * Alerts for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Every actionable verdict raises an alert. Repeats of the same detector for
+ * the same device within ALERT_GROUP_WINDOW are grouped into one alert, with
+ * a count and the first and last occurrence. Alerts are published on the
+ * traffic topic, in the same format as other command results:
+ * {"command": "alert", "argument": "<id>", "result": {...}}
+ * Alerts can be acknowledged, and silenced per device and detector. Alerts
+ * are persisted, and removed ALERT_RETENTION after their last occurrence.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ALERT_GROUP_WINDOW = 30 * time.Minute // Repeats within this window are grouped
+const ALERT_RETENTION = 30 * 24 * time.Hour // Alerts are removed this long after their last occurrence
+const ALERT_MAX_EVIDENCE = 10               // Maximum number of evidence items in an alert
+const ALERT_SILENCE = 24 * 60               // Default time to silence alerts, in minutes
+
+const SEVERITY_INFO = "info"
+const SEVERITY_WARNING = "warning"
+const SEVERITY_CRITICAL = "critical"
+
+type Alert struct {
+	Id           int       `json:"id"`
+	Device       int       `json:"device"`     // SPIN identifier of the device
+	DeviceName   string    `json:"devicename"` // Human readable description of the device
+	Detector     string    `json:"detector"`
+	Severity     string    `json:"severity"` // info, warning or critical
+	Message      string    `json:"message"`  // Reason of the last occurrence
+	Evidence     []string  `json:"evidence,omitempty"`
+	Firstseen    time.Time `json:"firstseen"`
+	Lastseen     time.Time `json:"lastseen"`
+	Count        int       `json:"count"`
+	Acknowledged bool      `json:"acknowledged"`
+}
+
+type AlertState struct {
+	Alerts   map[int]*Alert       `json:"alerts"`
+	Silenced map[string]time.Time `json:"silenced"` // Silenced until, per device and detector
+	NextId   int                  `json:"nextid"`
+}
+
+var Alerts = struct {
+	sync.RWMutex
+	s AlertState
+}{s: AlertState{Alerts: map[int]*Alert{}, Silenced: map[string]time.Time{}, NextId: 1}}
+
+// Initialise alerts, with previously stored alerts
+func InitAlerts(oldstate *AlertState) {
+	Alerts.Lock()
+	if oldstate != nil && oldstate.Alerts != nil {
+		Alerts.s = *oldstate
+		if Alerts.s.Silenced == nil {
+			Alerts.s.Silenced = map[string]time.Time{}
+		}
+	}
+	Alerts.Unlock()
+
+	RegisterCommand("get_alerts", handleGetAlerts)
+	RegisterCommand("ack_alert", handleAckAlert)
+	RegisterCommand("silence_alert", handleSilenceAlert)
+}
+
+// Key of the group of an alert, also used for silencing
+func alertKey(device int, detector string) string {
+	return fmt.Sprintf("%v %v", device, detector)
+}
+
+// Severity of an alert for a verdict
+func verdictSeverity(v Verdict) string {
+	switch v.Action {
+	case ACTION_BLOCK_REMOTE, ACTION_BLOCK_DEVICE:
+		return SEVERITY_CRITICAL
+	case ACTION_REPORT:
+		return SEVERITY_WARNING
+	}
+	return SEVERITY_INFO
+}
+
+// Raises an alert for a verdict, or groups it with a recent alert of the same detector and device.
+// The alert is published, unless it is silenced.
+func RaiseAlert(v Verdict) {
+	label := DeviceLabel(v.Deviceid)
+	now := clock.Now()
+	key := alertKey(v.Deviceid, v.Detector)
+
+	Alerts.Lock()
+	expireAlerts(now)
+	var alert *Alert
+	for _, a := range Alerts.s.Alerts {
+		if alertKey(a.Device, a.Detector) == key && now.Sub(a.Lastseen) < ALERT_GROUP_WINDOW &&
+			(alert == nil || a.Lastseen.After(alert.Lastseen)) {
+			alert = a
+		}
+	}
+	if alert == nil {
+		alert = &Alert{Id: Alerts.s.NextId, Device: v.Deviceid, Detector: v.Detector, Firstseen: now}
+		Alerts.s.NextId++
+		Alerts.s.Alerts[alert.Id] = alert
+	}
+	alert.DeviceName, alert.Message, alert.Lastseen = label, v.Reason, now
+	alert.Count++
+	if severity := verdictSeverity(v); alertSeverityLevel(severity) > alertSeverityLevel(alert.Severity) {
+		alert.Severity = severity
+	}
+	for _, e := range v.Evidence {
+		if len(alert.Evidence) < ALERT_MAX_EVIDENCE && !containsString(alert.Evidence, e) {
+			alert.Evidence = append(alert.Evidence, e)
+		}
+	}
+	silenced := now.Before(Alerts.s.Silenced[key])
+	res := alert.copy()
+	Alerts.Unlock()
+
+	if !silenced {
+		publishResult("alert", fmt.Sprintf("%v", res.Id), res)
+	}
+	CorrelateAlert(res, v)
+}
+
+func (a *Alert) copy() Alert {
+	c := *a
+	c.Evidence = append([]string(nil), a.Evidence...)
+	return c
+}
+
+// Ordering of severities
+func alertSeverityLevel(severity string) int {
+	switch severity {
+	case SEVERITY_INFO:
+		return 1
+	case SEVERITY_WARNING:
+		return 2
+	case SEVERITY_CRITICAL:
+		return 3
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Requires lock on Alerts
+// Removes alerts and silences beyond retention
+func expireAlerts(now time.Time) {
+	for id, a := range Alerts.s.Alerts {
+		if now.Sub(a.Lastseen) > ALERT_RETENTION {
+			delete(Alerts.s.Alerts, id)
+		}
+	}
+	for key, until := range Alerts.s.Silenced {
+		if now.After(until) {
+			delete(Alerts.s.Silenced, key)
+		}
+	}
+}
+
+// Moves the alerts and silences of device from to device into
+func AlertsMerge(from int, into int) {
+	label := DeviceLabel(into)
+	Alerts.Lock()
+	defer Alerts.Unlock()
+	for _, a := range Alerts.s.Alerts {
+		if a.Device == from {
+			a.Device, a.DeviceName = into, label
+		}
+	}
+	prefix := alertKey(from, "")
+	for key, until := range Alerts.s.Silenced {
+		if strings.HasPrefix(key, prefix) {
+			newkey := alertKey(into, strings.TrimPrefix(key, prefix))
+			if until.After(Alerts.s.Silenced[newkey]) {
+				Alerts.s.Silenced[newkey] = until
+			}
+			delete(Alerts.s.Silenced, key)
+		}
+	}
+}
+
+// Returns a copy of all alerts, for persistence
+func AlertsState() AlertState {
+	Alerts.RLock()
+	defer Alerts.RUnlock()
+	state := AlertState{Alerts: map[int]*Alert{}, Silenced: map[string]time.Time{}, NextId: Alerts.s.NextId}
+	for id, a := range Alerts.s.Alerts {
+		alert := a.copy()
+		state.Alerts[id] = &alert
+	}
+	for key, until := range Alerts.s.Silenced {
+		state.Silenced[key] = until
+	}
+	return state
+}
+
+// Handles the get_alerts command, argument is an optional device to filter on. Newest alerts first.
+func handleGetAlerts(argument json.RawMessage) {
+	device, filter := argumentInt(argument)
+	Alerts.RLock()
+	alerts := []Alert{}
+	for _, a := range Alerts.s.Alerts {
+		if !filter || a.Device == device {
+			alerts = append(alerts, a.copy())
+		}
+	}
+	Alerts.RUnlock()
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Lastseen.After(alerts[j].Lastseen) })
+	if filter {
+		publishResult("alerts", fmt.Sprintf("%v", device), alerts)
+	} else {
+		publishResult("alerts", "", alerts)
+	}
+}
+
+// Handles the ack_alert command, argument is the id of the alert
+func handleAckAlert(argument json.RawMessage) {
+	id, ok := argumentInt(argument)
+	if !ok {
+		return
+	}
+	Alerts.Lock()
+	a, exists := Alerts.s.Alerts[id]
+	if !exists {
+		Alerts.Unlock()
+		return
+	}
+	a.Acknowledged = true
+	res := a.copy()
+	Alerts.Unlock()
+	publishResult("alert", fmt.Sprintf("%v", id), res)
+}
+
+// Handles the silence_alert command, argument is the id of the alert, or {"id": ..., "minutes": ...}.
+// Silences all alerts of the same detector and device.
+func handleSilenceAlert(argument json.RawMessage) {
+	arg := struct {
+		Id      int `json:"id"`
+		Minutes int `json:"minutes"`
+	}{Minutes: ALERT_SILENCE}
+	if id, ok := argumentInt(argument); ok {
+		arg.Id = id
+	} else if err := json.Unmarshal(argument, &arg); err != nil {
+		return
+	}
+	Alerts.Lock()
+	defer Alerts.Unlock()
+	a, exists := Alerts.s.Alerts[arg.Id]
+	if !exists {
+		return
+	}
+	until := clock.Now().Add(time.Duration(arg.Minutes) * time.Minute)
+	Alerts.s.Silenced[alertKey(a.Device, a.Detector)] = until
+	fmt.Println("AL: silenced", a.Detector, "alerts of device", a.DeviceName, "until", until.Format(time.RFC3339))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Clears alerts and incidents for a test
+func resetAlerts() {
+	Alerts.Lock()
+	Alerts.s = AlertState{Alerts: map[int]*Alert{}, Silenced: map[string]time.Time{}, NextId: 1}
+	Alerts.Unlock()
+	Incidents.Lock()
+	Incidents.s = IncidentState{Incidents: map[int]*Incident{}, NextId: 1}
+	Incidents.Unlock()
+}
+
+func TestRaiseAlert(t *testing.T) {
+	c := &ManualClock{}
+	c.Set(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	SetClock(c)
+	defer SetClock(systemClock{})
+	resetAlerts()
+	defer resetAlerts()
+
+	type want struct {
+		id       int
+		count    int
+		severity string
+		evidence int
+	}
+	steps := []struct {
+		name    string
+		after   time.Duration
+		verdict Verdict
+		want    want
+	}{
+		{"first", 0, Verdict{Detector: "dga", Deviceid: 9001, Score: 0.6, Action: ACTION_REPORT, Evidence: []string{"a"}},
+			want{1, 1, SEVERITY_WARNING, 1}},
+		{"repeat", time.Minute, Verdict{Detector: "dga", Deviceid: 9001, Score: 0.9, Action: ACTION_BLOCK_DEVICE,
+			Evidence: []string{"a", "b"}}, want{1, 2, SEVERITY_CRITICAL, 2}},
+		{"other detector", time.Minute, Verdict{Detector: "scan", Deviceid: 9001, Score: 0.6, Action: ACTION_REPORT},
+			want{2, 1, SEVERITY_WARNING, 0}},
+		{"other device", time.Minute, Verdict{Detector: "dga", Deviceid: 9002, Score: 0.6, Action: ACTION_REPORT},
+			want{3, 1, SEVERITY_WARNING, 0}},
+		{"repeat, severity is kept", time.Minute, Verdict{Detector: "dga", Deviceid: 9001, Score: 0.6,
+			Action: ACTION_REPORT}, want{1, 3, SEVERITY_CRITICAL, 2}},
+		{"after the group window", ALERT_GROUP_WINDOW, Verdict{Detector: "dga", Deviceid: 9001, Score: 0.6,
+			Action: ACTION_REPORT}, want{4, 1, SEVERITY_WARNING, 0}},
+	}
+	for _, s := range steps {
+		c.Advance(s.after)
+		RaiseAlert(s.verdict)
+		Alerts.RLock()
+		a, exists := Alerts.s.Alerts[s.want.id]
+		var got want
+		if exists {
+			got = want{a.Id, a.Count, a.Severity, len(a.Evidence)}
+		}
+		Alerts.RUnlock()
+		if got != s.want {
+			t.Errorf("%v: got %+v, want %+v", s.name, got, s.want)
+		}
+	}
+
+	// Alerts are removed after retention
+	c.Advance(ALERT_RETENTION + time.Minute)
+	RaiseAlert(Verdict{Detector: "scan", Deviceid: 9003, Score: 0.6, Action: ACTION_REPORT})
+	Alerts.RLock()
+	n := len(Alerts.s.Alerts)
+	Alerts.RUnlock()
+	if n != 1 {
+		t.Errorf("%v alerts after retention, want 1", n)
+	}
+}
+
+func TestAlertCopy(t *testing.T) {
+	a := &Alert{Evidence: make([]string, 1, ALERT_MAX_EVIDENCE)}
+	c := a.copy()
+	a.Evidence[0] = "changed"
+	if c.Evidence[0] == "changed" {
+		t.Error("copy shares evidence with the alert")
+	}
+}
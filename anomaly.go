@@ -6,13 +6,14 @@
 /*
  * TODO:
  * - store state for later re-use?
- * - Currently only does peak detection, expand?
  */
 
 /*
- * This module implements a simple peak-based anomaly detection.
+ * This module implements a simple peak-based anomaly detection, as one of
+ * the detectors (see detector.go).
  * We store all previous flow-information per time period.
  * The first x hours, we only monitor, after that, we will start enforcing
+ * (see phase.go).
  */
 
 package main
@@ -20,16 +21,21 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
-const RECENT_TRAFFIC = 5               // Last 5 minutes is recent traffic
-const PEAK_MAX_INCREASE = 1.2          // Alert if new peak is 20% higher than old one.
-const PEAK_THRESHOLD = 100 * 1024 * 60 // 100 Kbit/sec (over a minute interval) is always allowed
-const PENALTY_THRESHOLD = 3            // If 3 out of 5 minutes the peak is too high, block!
-const TIME_MEASURING = 10              // In minutes, time to measure (10 means monitor for 0-10 minutes)
-const TIME_REPORTING = 60              // Time to report only, no blocking, in minutes. Longer than this will be blocked.
+const RECENT_TRAFFIC = 5                 // Last 5 minutes is recent traffic
+const PEAK_MAX_INCREASE = 1.2            // Alert if new peak is 20% higher than old one.
+const PEAK_THRESHOLD = 100 * 1024 * 60   // 100 Kbit/sec (over a minute interval) is always allowed
+const PENALTY_THRESHOLD = 3              // If 3 out of 5 minutes the peak is too high, block!
+const TIME_MEASURING = 10                // In minutes, time to measure (10 means monitor for 0-10 minutes)
+const TIME_REPORTING = 60                // Time to report only, no blocking, in minutes. Longer than this will be blocked.
+const ALLOWED_LATENESS = 2 * time.Minute // Traffic may arrive this late, and still be analysed with its minute
+
+const PEAK_INBOUND_THRESHOLD = 10 * PEAK_THRESHOLD // Same for incoming traffic, downloads are common
+const PEAK_INFO_MAX_ITEMS = 24 * 60                // Peak info has at most this many items, per resolution
 
 type Datapoint struct {
 	BytesReceived   int // Number of bytes received by the local device
@@ -47,8 +53,10 @@ type FlowSummary struct {
 var TrafficHistory = struct {
 	sync.RWMutex
 	h           map[int]*FlowSummary // index is SPIN Identifier for this node. Same as in History database.
+	analysed    map[int]time.Time    // Last minute that was analysed, per device
+	lastclosed  time.Time            // Last minute that was closed by the scheduler
 	initialised bool
-}{h: map[int]*FlowSummary{}}
+}{h: map[int]*FlowSummary{}, analysed: map[int]time.Time{}}
 
 // Initialise anomaly detection
 // if load, reload state from disk (filepath in attach)
@@ -57,12 +65,25 @@ func InitAnomaly(oldstate *map[int]*FlowSummary) {
 		TrafficHistory.Lock()
 		defer TrafficHistory.Unlock()
 		TrafficHistory.h = *oldstate
+		// Older states used local time, datapoints are keyed by minute in UTC
+		for _, node := range TrafficHistory.h {
+			dps := make(map[time.Time]*Datapoint)
+			for k, v := range node.Datapoints {
+				dps[getRoundedMinute(k)] = v
+			}
+			node.Datapoints = dps
+		}
 	}
 	// go printResolved(SubscribeResolve())
 	// go printNewTraffic(SubscribeNewTraffic())
 	go processTraffic(SubscribeNewTraffic())
 	go processTraffic(SubscribeExtraTraffic())
-	go listenWebInfo()
+	go scheduleAnalysis()
+	RegisterCommand("get_peak_info", handlePeakInfo)
+	RegisterDetector(&peakDetector{MaxIncrease: PEAK_MAX_INCREASE, Threshold: PEAK_THRESHOLD,
+		Penalty: PENALTY_THRESHOLD, Action: ACTION_BLOCK_DEVICE}, true)
+	RegisterDetector(&peakDetector{MaxIncrease: PEAK_MAX_INCREASE, Threshold: PEAK_INBOUND_THRESHOLD,
+		Penalty: PENALTY_THRESHOLD, Action: ACTION_REPORT, inbound: true}, true)
 }
 
 // Process new datapoint to existing flow, or new flow.
@@ -72,42 +93,137 @@ func processTraffic(ch chan SubFlow) {
 		if !cont { // channel is closed
 			break
 		}
-		deviceid := flowinfo.Deviceid
-		// fmt.Printf("AD: Device %v adding flowdata to flow %v with recv:%v/%v sent:%v/%v bytes/packets\n", deviceid, flowinfo.Flowid,
-		//   flowinfo.BytesReceived, flowinfo.PacketsReceived, flowinfo.BytesSent, flowinfo.PacketsSent)
+		addTraffic(flowinfo)
+	}
+}
 
-		TrafficHistory.Lock()
-		flow, exists := TrafficHistory.h[deviceid]
-		t := getRoundedMinute(time.Now())
-
-		if !exists {
-			// No FlowSummary for this device
-			flow = &FlowSummary{NodeId: deviceid, Datapoints: make(map[time.Time]*Datapoint)}
-			flow.Datapoints[t] = &Datapoint{BytesReceived: 0,
-				BytesSent: 0, PacketsReceived: 0, PacketsSent: 0}
+// Adds the traffic of a flow event to the minute of its timestamp
+func addTraffic(flowinfo SubFlow) {
+	deviceid := flowinfo.Deviceid
+	// fmt.Printf("AD: Device %v adding flowdata to flow %v with recv:%v/%v sent:%v/%v bytes/packets\n", deviceid, flowinfo.Flowid,
+	//   flowinfo.BytesReceived, flowinfo.PacketsReceived, flowinfo.BytesSent, flowinfo.PacketsSent)
+
+	TrafficHistory.Lock()
+	flow, exists := TrafficHistory.h[deviceid]
+	t := eventMinute(flowinfo.Timestamp)
+
+	if !exists {
+		// No FlowSummary for this device
+		flow = &FlowSummary{NodeId: deviceid, Datapoints: make(map[time.Time]*Datapoint)}
+		flow.Datapoints[t] = &Datapoint{BytesReceived: 0,
+			BytesSent: 0, PacketsReceived: 0, PacketsSent: 0}
+	}
+	dp := flow.Datapoints[t]
+	if dp == nil {
+		/* Start a new minute, analysed by the scheduler once it is complete */
+		dp = &Datapoint{0, 0, 0, 0}
+		flow.Datapoints[t] = dp
+	}
+	dp.BytesReceived += flowinfo.BytesReceived
+	dp.BytesSent += flowinfo.BytesSent
+	dp.PacketsReceived += flowinfo.PacketsReceived
+	dp.PacketsSent += flowinfo.PacketsSent
+	TrafficHistory.h[deviceid] = flow
+	// fmt.Printf("History: %+v\n", TrafficHistory)
+	// fmt.Printf("FlowSummary: %v\n", TrafficHistory.h)
+	// for _, m := range TrafficHistory.h {
+	//   fmt.Printf("\t%v\n", m)
+	//   for _, n := range m.Datapoints {
+	//     fmt.Printf("\t\t%v\n", n)
+	//   }
+	// }
+	TrafficHistory.Unlock()
+}
+
+// Returns the minute bucket for traffic at time t (event time, as reported by SPIN).
+// Traffic without a timestamp, or from the future, is put in the current minute.
+// Traffic that arrives after its minute was closed is stored, but not analysed anymore.
+func eventMinute(t time.Time) time.Time {
+	now := clock.Now()
+	if t.IsZero() || t.After(now.Add(ALLOWED_LATENESS)) {
+		t = now
+	}
+	return getRoundedMinute(t)
+}
+
+// Closes the minute buckets of all active devices at every minute boundary,
+// so a minute is analysed even if the device sends nothing afterwards.
+// A minute is closed ALLOWED_LATENESS after it ended, to allow for late traffic.
+func scheduleAnalysis() {
+	for {
+		now := clock.Now()
+		clock.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		closeDueMinutes()
+	}
+}
+
+// Closes all minutes that ended at least ALLOWED_LATENESS ago
+func closeDueMinutes() {
+	closeMinutes(getRoundedMinute(clock.Now().Add(-ALLOWED_LATENESS)).Add(-time.Minute))
+}
+
+// Closes all minutes up to and including last, that were not closed yet.
+// After a delay (e.g. suspend), at most RECENT_TRAFFIC minutes are caught up on.
+func closeMinutes(last time.Time) {
+	TrafficHistory.Lock()
+	first := TrafficHistory.lastclosed.Add(time.Minute)
+	if first.Before(last.Add(-RECENT_TRAFFIC * time.Minute)) {
+		first = last.Add(-RECENT_TRAFFIC * time.Minute)
+	}
+	if last.After(TrafficHistory.lastclosed) {
+		TrafficHistory.lastclosed = last
+	}
+	TrafficHistory.Unlock()
+
+	for minute := first; !minute.After(last); minute = minute.Add(time.Minute) {
+		for _, deviceid := range devicesToAnalyse(minute) {
+			AnalyseTraffic(deviceid, minute)
 		}
-		dp := flow.Datapoints[t]
+	}
+}
+
+// Returns the devices with traffic in this minute, that have not been analysed for it yet.
+// Marks them as analysed, so every minute of a device is analysed only once.
+func devicesToAnalyse(minute time.Time) []int {
+	TrafficHistory.Lock()
+	defer TrafficHistory.Unlock()
+	devices := []int{}
+	for deviceid, node := range TrafficHistory.h {
+		if node.Datapoints[minute] == nil || !TrafficHistory.analysed[deviceid].Before(minute) {
+			continue
+		}
+		TrafficHistory.analysed[deviceid] = minute
+		devices = append(devices, deviceid)
+	}
+	return devices
+}
+
+// Adds all datapoints of device from to device into, and removes device from
+func TrafficHistoryMerge(from int, into int) {
+	TrafficHistory.Lock()
+	defer TrafficHistory.Unlock()
+	src, exists := TrafficHistory.h[from]
+	if !exists {
+		return
+	}
+	dst, exists := TrafficHistory.h[into]
+	if !exists {
+		dst = &FlowSummary{NodeId: into, Datapoints: make(map[time.Time]*Datapoint)}
+		TrafficHistory.h[into] = dst
+	}
+	for t, v := range src.Datapoints {
+		dp := dst.Datapoints[t]
 		if dp == nil {
-			/* Start a new minute */
 			dp = &Datapoint{0, 0, 0, 0}
-			flow.Datapoints[t] = dp
-			go analyseTraffic(deviceid) // Call peak detection
+			dst.Datapoints[t] = dp
 		}
-		dp.BytesReceived += flowinfo.BytesReceived
-		dp.BytesSent += flowinfo.BytesSent
-		dp.PacketsReceived += flowinfo.PacketsReceived
-		dp.PacketsSent += flowinfo.PacketsSent
-		TrafficHistory.h[deviceid] = flow
-		// fmt.Printf("History: %+v\n", TrafficHistory)
-		// fmt.Printf("FlowSummary: %v\n", TrafficHistory.h)
-		// for _, m := range TrafficHistory.h {
-		//   fmt.Printf("\t%v\n", m)
-		//   for _, n := range m.Datapoints {
-		//     fmt.Printf("\t\t%v\n", n)
-		//   }
-		// }
-		TrafficHistory.Unlock()
+		dp.BytesReceived += v.BytesReceived
+		dp.BytesSent += v.BytesSent
+		dp.PacketsReceived += v.PacketsReceived
+		dp.PacketsSent += v.PacketsSent
 	}
+	delete(TrafficHistory.h, from)
+	delete(TrafficHistory.analysed, from)
 }
 
 // Debug print functions
@@ -141,25 +257,25 @@ func processTraffic(ch chan SubFlow) {
 //   }
 // }
 
-// Gets time and returns rounded (to the minute) version
+// Gets time and returns rounded (to the minute) version, in UTC so DST changes do not matter
 func getRoundedMinute(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+	return t.UTC().Truncate(time.Minute)
 }
 
-/* Check whether there is a recent peak in outgoing traffic.
+/* Check whether there is a recent peak in outgoing (or, if inbound, incoming) traffic.
    Called every minute.
-   Only outgoing traffic, to prevent DDoS attacks.
+   Outgoing traffic to prevent DDoS attacks, incoming traffic for devices
+   that suddenly serve much more than before.
    Needs at least 10 minutes of data, but blocks only after 1 hour.
-   Perform checking for the last 5 minutes.
-   Calculates mean and std dev of device (alltime, and last day).
+   Perform checking for the last 5 minutes, up to and including minute.
+   Only tracks the maximum, mean and std dev are in the baseline detector.
    Calculate absolute peak.
 
-   Bug: 1 minute high spike, with no traffic afterwards, no analysis done.
-      -> fix properly, this is just a POC.
+   Called by the scheduler once a minute is complete, see scheduleAnalysis().
 
    Returns: recent bytes, recent packets, maxbytes, maxpackets
 */
-func getPeak(nodeid int) ([]int, []int, int, int, int, int) {
+func getPeak(nodeid int, minute time.Time, inbound bool) ([]int, []int, int, int, int, int) {
 	TrafficHistory.RLock()
 	defer TrafficHistory.RUnlock()
 	_, exists := TrafficHistory.h[nodeid]
@@ -179,25 +295,33 @@ func getPeak(nodeid int) ([]int, []int, int, int, int, int) {
 	maxpackets := 0
 
 	for k, v := range dp {
-		if time.Now().Sub(k).Minutes() <= RECENT_TRAFFIC {
+		if k.After(minute) {
+			// Minute is not complete yet
+			continue
+		}
+		bytes, packets := v.BytesSent, v.PacketsSent
+		if inbound {
+			bytes, packets = v.BytesReceived, v.PacketsReceived
+		}
+		if minute.Sub(k).Minutes() < RECENT_TRAFFIC {
 			// Recent traffic of last RECENT_TRAFFIC (default 5) minutes
 			// Update counters
-			recentbytes = append(recentbytes, v.BytesSent)
-			recentpackets = append(recentpackets, v.PacketsSent)
+			recentbytes = append(recentbytes, bytes)
+			recentpackets = append(recentpackets, packets)
 
-			if recentmaxbytes < v.BytesSent {
-				recentmaxbytes = v.BytesSent
+			if recentmaxbytes < bytes {
+				recentmaxbytes = bytes
 			}
-			if recentmaxpackets < v.PacketsSent {
-				recentmaxpackets = v.PacketsSent
+			if recentmaxpackets < packets {
+				recentmaxpackets = packets
 			}
 		} else {
 			// Update statistics
-			if maxbytes < v.BytesSent {
-				maxbytes = v.BytesSent
+			if maxbytes < bytes {
+				maxbytes = bytes
 			}
-			if maxpackets < v.PacketsSent {
-				maxpackets = v.PacketsSent
+			if maxpackets < packets {
+				maxpackets = packets
 			}
 		}
 		// fmt.Printf("AD: device %v traffic %v/%v bytes and %v/%v packets (in/out) %v\n", nodeid, v.BytesReceived,
@@ -208,8 +332,8 @@ func getPeak(nodeid int) ([]int, []int, int, int, int, int) {
 
 func getTimeMinMax(dp map[time.Time]*Datapoint) (time.Time, time.Time) {
 	// Store all defaults
-	tmax := time.Now().AddDate(-10, 0, 0) // 10 years in the past
-	tmin := time.Now().AddDate(10, 0, 0)  // 10 years in the future
+	tmax := clock.Now().AddDate(-10, 0, 0) // 10 years in the past
+	tmin := clock.Now().AddDate(10, 0, 0)  // 10 years in the future
 
 	for k := range dp {
 		if tmax.Before(k) {
@@ -222,130 +346,290 @@ func getTimeMinMax(dp map[time.Time]*Datapoint) (time.Time, time.Time) {
 	return tmin, tmax
 }
 
-func analyseTraffic(nodeid int) {
+const PHASE_MEASURING = "measuring" // Only measuring
+const PHASE_REPORTING = "reporting" // Reporting, not blocking
+const PHASE_ENFORCING = "enforcing" // Reporting and blocking
+
+// Peak detector, blocks devices that send much more than they ever did before.
+// The inbound variant (peak_inbound) looks at traffic received by the device.
+type peakDetector struct {
+	MaxIncrease float64 `json:"maxincrease"` // Alert if new peak is this much higher than old one
+	Threshold   int     `json:"threshold"`   // Traffic (per minute) below this is always allowed
+	Penalty     int     `json:"penalty"`     // Block if more than this many recent minutes have a peak
+	Action      string  `json:"action"`      // Action on a peak
+
+	inbound bool
+}
+
+func (d *peakDetector) Name() string {
+	if d.inbound {
+		return "peak_inbound"
+	}
+	return "peak"
+}
+
+// Requires lock on Detectors
+// Applies the configuration only when all of it is valid
+func (d *peakDetector) Configure(config json.RawMessage) error {
+	c := *d
+	if err := json.Unmarshal(config, &c); err != nil {
+		return err
+	}
+	if c.MaxIncrease <= 0 || c.Threshold < 0 || c.Penalty < 0 {
+		return fmt.Errorf("maxincrease must be positive, threshold and penalty not negative")
+	}
+	if !validAction(c.Action) {
+		return fmt.Errorf("invalid action %q", c.Action)
+	}
+	*d = c
+	return nil
+}
+
+// Returns the limits (in bytes and packets per minute) derived from the maxima of getPeakMaxima, and the maxima
+func (d *peakDetector) limits(max Datapoint) (float64, float64, int, int) {
+	maxbytes, maxpackets := max.BytesSent, max.PacketsSent
+	if d.inbound {
+		maxbytes, maxpackets = max.BytesReceived, max.PacketsReceived
+	}
+	return float64(maxbytes) * d.MaxIncrease, float64(maxpackets) * d.MaxIncrease, maxbytes, maxpackets
+}
+
+// Returns, per minute, the highest traffic per minute before the last RECENT_TRAFFIC
+// minutes (as getPeak does), in a single pass over the datapoints
+func getPeakMaxima(dp map[time.Time]Datapoint, minutes []time.Time) map[time.Time]Datapoint {
+	keys := make([]time.Time, 0, len(dp))
+	for k := range dp {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Before(keys[j]) })
+	sorted := append([]time.Time{}, minutes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	res := make(map[time.Time]Datapoint, len(sorted))
+	max := Datapoint{}
+	i := 0
+	for _, minute := range sorted {
+		for ; i < len(keys) && minute.Sub(keys[i]).Minutes() >= RECENT_TRAFFIC; i++ {
+			v := dp[keys[i]]
+			if max.BytesSent < v.BytesSent {
+				max.BytesSent = v.BytesSent
+			}
+			if max.PacketsSent < v.PacketsSent {
+				max.PacketsSent = v.PacketsSent
+			}
+			if max.BytesReceived < v.BytesReceived {
+				max.BytesReceived = v.BytesReceived
+			}
+			if max.PacketsReceived < v.PacketsReceived {
+				max.PacketsReceived = v.PacketsReceived
+			}
+		}
+		res[minute] = max
+	}
+	return res
+}
+
+// Checks whether the bytes and packets of a minute exceed the limits
+func (d *peakDetector) penalised(bytes int, packets int, limitbytes float64, limitpackets float64) (bool, bool) {
+	return bytes >= d.Threshold && float64(bytes) > limitbytes, packets >= d.Threshold && float64(packets) > limitpackets
+}
+
+// Returns a copy of the detector, with the limits of the policy of a device
+func (d *peakDetector) forDevice(nodeid int) *peakDetector {
+	res := *d
+	p := DevicePolicy(nodeid)
+	if p.MaxIncrease != nil {
+		res.MaxIncrease = *p.MaxIncrease
+	}
+	if p.Threshold != nil && !d.inbound {
+		res.Threshold = *p.Threshold
+	}
+	if p.Inbound != nil && d.inbound {
+		res.Threshold = *p.Inbound
+	}
+	if p.Penalty != nil {
+		res.Penalty = *p.Penalty
+	}
+	return &res
+}
+
+func (d *peakDetector) AnalyseTraffic(nodeid int, minute time.Time) []Verdict {
+	d = d.forDevice(nodeid)
 	// fmt.Println("AD: device", nodeid, "model (b/p): ", maxbytes, "/", maxpackets)
 	recentbytes, recentpackets, recentmaxbytes, recentmaxpackets,
-		maxbytes, maxpackets := getPeak(nodeid)
+		maxbytes, maxpackets := getPeak(nodeid, minute, d.inbound)
+	limitbytes, limitpackets := float64(maxbytes)*d.MaxIncrease, float64(maxpackets)*d.MaxIncrease
 
 	// Continue only when a peak was found
 	peak := false
 	penaltyb, penaltyp := 0, 0
-	for _, v := range recentbytes {
-		if v >= PEAK_THRESHOLD && float64(v) > float64(maxbytes)*PEAK_MAX_INCREASE {
+	for i := range recentbytes {
+		pb, pp := d.penalised(recentbytes[i], recentpackets[i], limitbytes, limitpackets)
+		if pb {
 			penaltyb += 1
 		}
-	}
-	for _, v := range recentpackets {
-		if v >= PEAK_THRESHOLD && float64(v) > float64(maxpackets)*PEAK_MAX_INCREASE {
+		if pp {
 			penaltyp += 1
 		}
 	}
 
-	peak = penaltyp > PENALTY_THRESHOLD || penaltyb > PENALTY_THRESHOLD
+	peak = penaltyp > d.Penalty || penaltyb > d.Penalty
+	if !peak {
+		return []Verdict{{Detector: d.Name(), Deviceid: nodeid, Score: 0, Action: ACTION_NONE,
+			Reason: fmt.Sprintf("%v/%v bytes/packets, limit %.0f/%.0f", recentmaxbytes, recentmaxpackets,
+				limitbytes, limitpackets)}}
+	}
+	return []Verdict{{Detector: d.Name(), Deviceid: nodeid, Score: 1, Action: d.Action,
+		Reason: fmt.Sprintf("peak of %v/%v bytes/packets, limit %.0f/%.0f", recentmaxbytes, recentmaxpackets,
+			limitbytes, limitpackets)}}
+}
 
-	TrafficHistory.RLock()
-	dp := TrafficHistory.h[nodeid].Datapoints
-	tmin, tmax := getTimeMinMax(dp)
-	dp = nil
-	TrafficHistory.RUnlock()
+// Returns copies of the registered peak detectors, for outgoing and incoming traffic
+func peakDetectors() (*peakDetector, *peakDetector) {
+	out := peakDetector{MaxIncrease: PEAK_MAX_INCREASE, Threshold: PEAK_THRESHOLD, Penalty: PENALTY_THRESHOLD}
+	in := peakDetector{MaxIncrease: PEAK_MAX_INCREASE, Threshold: PEAK_INBOUND_THRESHOLD,
+		Penalty: PENALTY_THRESHOLD, inbound: true}
+	Detectors.RLock()
+	defer Detectors.RUnlock()
+	if d, ok := Detectors.d["peak"].(*peakDetector); ok {
+		out = *d
+	}
+	if d, ok := Detectors.d["peak_inbound"].(*peakDetector); ok {
+		in = *d
+	}
+	return &out, &in
+}
 
-	duration := tmax.Sub(tmin).Minutes()
-	switch {
-	case duration < TIME_MEASURING: // Only measuring
-	case peak && duration < TIME_REPORTING: // Reporting, not blocking
-		fmt.Println("AD: PEAK device", nodeid, "has peak, no action taken:", recentmaxbytes,
-			"/", recentmaxpackets, "bytes/packets", duration)
-	case peak: // Block bad traffic!
-		BrokerSendCommand(SPINcommand{SPIN_CMD_ADD_BLOCK, nodeid})
-
-		fmt.Println("AD: BLOCKED device", nodeid, "for peak: ", recentmaxbytes,
-			"/", recentmaxpackets, "bytes/packets", duration)
-		fmt.Println("AD: device", nodeid, "had limit of", float64(maxbytes)*PEAK_MAX_INCREASE,
-			"/", float64(recentmaxpackets)*PEAK_MAX_INCREASE, " bytes/packets", duration)
-	default:
-		fmt.Println("AD: device", nodeid, "all okay", recentmaxbytes, "/", recentmaxpackets,
-			"bytes/packets", "limit", maxbytes, "/", maxpackets)
+// Describes how the limits of a peak detector are derived
+func (d *peakDetector) derivation(maxbytes int, maxpackets int) string {
+	direction := "sent"
+	if d.inbound {
+		direction = "received"
 	}
+	return fmt.Sprintf("highest %v bytes/packets per minute before the last %v minutes (%v/%v) times %v; "+
+		"minutes at or below %v are always allowed; more than %v penalised minutes in the last %v is a peak",
+		direction, RECENT_TRAFFIC, maxbytes, maxpackets, d.MaxIncrease, d.Threshold, d.Penalty, RECENT_TRAFFIC)
 }
 
-func listenWebInfo() {
-	brokerchan, brokererr := BrokerSubscribe(TOPIC_COMMANDS)
-	if brokererr != nil {
-		fmt.Println("listenWebInfo: unable to subscribe to commands topic")
-		time.Sleep(1 * time.Second)
-		go listenWebInfo()
+// Handles the get_peak_info command. The argument is a node, or
+// {"node": 12, "from": <unix time>, "to": <unix time>, "resolution": <minutes>}.
+// By default, the last 60 minutes are returned per minute. The penalties of an
+// item are based on the limits at the start of the item, not the current limits.
+func handlePeakInfo(argument json.RawMessage) {
+	// Return peak information for node in arguments
+	now := clock.Now()
+	req := struct {
+		Node       int   `json:"node"`
+		From       int64 `json:"from"`
+		To         int64 `json:"to"`
+		Resolution int   `json:"resolution"`
+	}{}
+	if nodeid, ok := argumentInt(argument); ok {
+		req.Node = nodeid
+	} else if err := json.Unmarshal(argument, &req); err != nil {
+		return
+	}
+	nodeid := req.Node
+	if nodeid <= 0 {
+		return
+	}
+	to := now
+	if req.To > 0 {
+		to = time.Unix(req.To, 0)
+	}
+	from := to.Add(-60 * time.Minute)
+	if req.From > 0 {
+		from = time.Unix(req.From, 0)
+	}
+	from = getRoundedMinute(from)
+	resolution := time.Minute
+	if req.Resolution > 1 {
+		resolution = time.Duration(req.Resolution) * time.Minute
+	}
+	if to.Sub(from) > PEAK_INFO_MAX_ITEMS*resolution {
+		resolution = (to.Sub(from)/PEAK_INFO_MAX_ITEMS + time.Minute - 1).Truncate(time.Minute)
+	}
+
+	// Copy the traffic, the limits of an item depend on the traffic before it
+	TrafficHistory.RLock()
+	node, exists := TrafficHistory.h[nodeid]
+	datapoints := map[time.Time]Datapoint{}
+	if exists {
+		for k, v := range node.Datapoints {
+			datapoints[k] = *v
+		}
+	}
+	TrafficHistory.RUnlock()
+	if !exists {
+		// Return error, no information.
+		publishResult("peakinfo", fmt.Sprintf("%v", nodeid), nil)
 		return
 	}
-	go func() {
-		for {
-			data, ok := <-brokerchan
-			if !ok {
-				break
-			}
-			var parsed SPINcommand
-			err := json.Unmarshal(data, &parsed)
-			if err != nil {
-				continue
-			}
 
-			switch parsed.Command {
-			case "get_peak_info":
-				// Return peak information for node in arguments
-				nodeid := parsed.Argument
-				if nodeid <= 0 {
-					continue
-				}
-				// var nodeid int
-				// var err error
-				// if nodeid, err = strconv.Atoi(nodeidstr); err != nil {
-				//     continue
-				// }
-				traffic := make(map[string]interface{})
-				items := make(map[string]interface{})
-
-				_, _, _, _, maxbytes, maxpackets := getPeak(nodeid)
-				traffic["maxbytes"] = int(float64(maxbytes) * PEAK_MAX_INCREASE)
-				traffic["maxpackets"] = int(float64(maxpackets) * PEAK_MAX_INCREASE)
-
-				TrafficHistory.RLock()
-
-				node, exists := TrafficHistory.h[nodeid]
-				results := make(map[string]interface{})
-				if exists {
-					dp := node.Datapoints
-					tmin, tmax := getTimeMinMax(dp)
-					traffic["enforcing"] = tmax.Sub(tmin).Minutes() >= TIME_REPORTING
-
-					for k, v := range dp {
-						if time.Now().Sub(k).Minutes() <= 60 {
-							// Send back last 60 minutes of traffic
-							items[fmt.Sprintf("%0.f", 0-time.Now().Sub(k).Minutes())] = map[string]interface{}{
-								"bytes":   v.BytesSent,
-								"packets": v.PacketsSent}
-						}
-					}
-					traffic["items"] = items
-
-					results["command"] = "peakinfo"
-					results["argument"] = fmt.Sprintf("%v", nodeid)
-					results["result"] = traffic
-
-				} else {
-					// Return error, no information.
-					results["command"] = "peakinfo"
-					results["argument"] = fmt.Sprintf("%v", nodeid)
-				}
-
-				bresults, err := json.Marshal(results)
-				if err != nil {
-					fmt.Println("Error while making JSON of peak info", nodeid)
-					continue
-				}
-				BrokerSend(bresults, TOPIC_TRAFFIC)
-
-				TrafficHistory.RUnlock()
+	// Compute the maxima of the current minute and of all items at once
+	current := getRoundedMinute(now)
+	minutes := []time.Time{current}
+	for k := range datapoints {
+		if !k.Before(from) && !k.After(to) {
+			minutes = append(minutes, from.Add(k.Sub(from)/resolution*resolution))
+		}
+	}
+	maxima := getPeakMaxima(datapoints, minutes)
+
+	out, in := peakDetectors()
+	out, in = out.forDevice(nodeid), in.forDevice(nodeid)
+	limitbytes, limitpackets, maxbytes, maxpackets := out.limits(maxima[current])
+	inlimitbytes, inlimitpackets, inmaxbytes, inmaxpackets := in.limits(maxima[current])
+	phase, _ := devicePhase(nodeid)
+	next, at := nextPhase(nodeid)
+	verdicts := LastVerdicts(nodeid)
+
+	traffic := make(map[string]interface{})
+	items := make(map[string]interface{})
+	traffic["maxbytes"] = int(limitbytes)
+	traffic["maxpackets"] = int(limitpackets)
+	traffic["maxbytesreceived"] = int(inlimitbytes)
+	traffic["maxpacketsreceived"] = int(inlimitpackets)
+	traffic["derivation"] = out.derivation(maxbytes, maxpackets)
+	traffic["derivationreceived"] = in.derivation(inmaxbytes, inmaxpackets)
+	traffic["phase"] = phase
+	traffic["enforcing"] = phase == PHASE_ENFORCING
+	if next != "" {
+		traffic["nextphase"], traffic["minutestonextphase"] = next, at.Sub(now).Minutes()
+	}
+	traffic["verdicts"] = verdicts
+	if v, exists := verdicts[out.Name()]; exists {
+		traffic["lastverdict"] = v
+	}
 
-			}
+	for k, v := range datapoints {
+		if k.Before(from) || k.After(to) {
+			continue
 		}
-	}()
+		bucket := from.Add(k.Sub(from) / resolution * resolution)
+		lb, lp, _, _ := out.limits(maxima[bucket])
+		ilb, ilp, _, _ := in.limits(maxima[bucket])
+		key := fmt.Sprintf("%0.f", 0-now.Sub(bucket).Minutes())
+		item, ok := items[key].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{"bytes": 0, "packets": 0, "bytesreceived": 0, "packetsreceived": 0,
+				"penaltybytes": false, "penaltypackets": false, "penaltybytesreceived": false,
+				"penaltypacketsreceived": false}
+			items[key] = item
+		}
+		item["bytes"] = item["bytes"].(int) + v.BytesSent
+		item["packets"] = item["packets"].(int) + v.PacketsSent
+		item["bytesreceived"] = item["bytesreceived"].(int) + v.BytesReceived
+		item["packetsreceived"] = item["packetsreceived"].(int) + v.PacketsReceived
+		pb, pp := out.penalised(v.BytesSent, v.PacketsSent, lb, lp)
+		ipb, ipp := in.penalised(v.BytesReceived, v.PacketsReceived, ilb, ilp)
+		item["penaltybytes"] = item["penaltybytes"].(bool) || pb
+		item["penaltypackets"] = item["penaltypackets"].(bool) || pp
+		item["penaltybytesreceived"] = item["penaltybytesreceived"].(bool) || ipb
+		item["penaltypacketsreceived"] = item["penaltypacketsreceived"].(bool) || ipp
+	}
+	traffic["items"] = items
+	traffic["resolution"] = int(resolution.Minutes())
+
+	publishResult("peakinfo", fmt.Sprintf("%v", nodeid), traffic)
 }
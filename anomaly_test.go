@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// Traffic detector that records which minutes were analysed
+type recordingDetector struct {
+	sync.Mutex
+	minutes []time.Time
+}
+
+func (d *recordingDetector) Name() string { return "recorder" }
+
+func (d *recordingDetector) Configure(config json.RawMessage) error { return nil }
+
+func (d *recordingDetector) AnalyseTraffic(deviceid int, minute time.Time) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+	d.minutes = append(d.minutes, minute)
+	return nil
+}
+
+func (d *recordingDetector) analysed() []time.Time {
+	d.Lock()
+	defer d.Unlock()
+	return append([]time.Time{}, d.minutes...)
+}
+
+// Waits until the scheduler is sleeping on the clock again, i.e. done with its work
+func waitForScheduler(t *testing.T, c *ManualClock) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Sleepers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduler did not return to sleep")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduleAnalysis(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Daylight saving time starts at 02:00 local time, 01:00 UTC
+	c := &ManualClock{}
+	c.Set(time.Date(2026, 3, 29, 1, 58, 10, 0, amsterdam))
+	SetClock(c)
+	defer SetClock(systemClock{})
+
+	TrafficHistory.Lock()
+	TrafficHistory.h, TrafficHistory.analysed, TrafficHistory.lastclosed = map[int]*FlowSummary{}, map[int]time.Time{},
+		time.Time{}
+	TrafficHistory.Unlock()
+	rec := &recordingDetector{}
+	RegisterDetector(rec, true)
+	defer func() {
+		Detectors.Lock()
+		delete(Detectors.d, rec.Name())
+		delete(Detectors.settings, rec.Name())
+		Detectors.Unlock()
+	}()
+
+	go scheduleAnalysis()
+	waitForScheduler(t, c)
+
+	local := func(hour int, min int, sec int) time.Time {
+		return time.Date(2026, 3, 29, hour, min, sec, 0, amsterdam)
+	}
+	send := func(ts time.Time, bytes int) {
+		addTraffic(SubFlow{Deviceid: 1, Timestamp: ts, BytesSent: bytes})
+	}
+	advanceTo := func(t2 time.Time) {
+		c.Set(t2)
+		waitForScheduler(t, c)
+	}
+	bytesAt := func(minute time.Time) int {
+		TrafficHistory.RLock()
+		defer TrafficHistory.RUnlock()
+		if dp := TrafficHistory.h[1].Datapoints[minute]; dp != nil {
+			return dp.BytesSent
+		}
+		return -1
+	}
+
+	send(local(1, 58, 5), 100)
+	advanceTo(local(1, 59, 40))
+	send(local(1, 59, 30), 10)
+	advanceTo(local(3, 0, 0))   // 02:00 does not exist, 03:00 CEST is one minute after 01:59 CET
+	send(local(1, 58, 50), 100) // late, but within ALLOWED_LATENESS
+	send(local(3, 0, 20), 1)
+	advanceTo(local(3, 1, 0))   // closes 01:58
+	send(local(1, 58, 59), 100) // too late, its minute is closed
+	send(local(3, 0, 30), 1)
+	advanceTo(local(3, 5, 0))
+
+	m0158 := time.Date(2026, 3, 29, 0, 58, 0, 0, time.UTC)
+	want := []time.Time{m0158, m0158.Add(time.Minute), m0158.Add(2 * time.Minute)}
+	got := rec.analysed()
+	if len(got) != len(want) {
+		t.Fatalf("analysed %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) || got[i].Location() != time.UTC {
+			t.Errorf("minute %v: analysed %v, want %v in UTC", i, got[i], want[i])
+		}
+	}
+	if b := bytesAt(m0158); b != 300 {
+		t.Errorf("01:58 CET: %v bytes, want 300, the too late traffic is stored", b)
+	}
+	if b := bytesAt(m0158.Add(2 * time.Minute)); b != 2 {
+		t.Errorf("03:00 CEST: %v bytes, want 2", b)
+	}
+}
+
+func TestEventMinute(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 30, 0, time.UTC)
+	c := &ManualClock{}
+	c.Set(now)
+	SetClock(c)
+	defer SetClock(systemClock{})
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{"no timestamp", time.Time{}, now.Truncate(time.Minute)},
+		{"late", now.Add(-5 * time.Minute), now.Add(-5 * time.Minute).Truncate(time.Minute)},
+		{"slightly ahead", now.Add(time.Minute), now.Add(time.Minute).Truncate(time.Minute)},
+		{"far in the future", now.Add(time.Hour), now.Truncate(time.Minute)},
+		{"other time zone", now.In(time.FixedZone("UTC+5", 5*3600)), now.Truncate(time.Minute)},
+	}
+	for _, tt := range tests {
+		got := eventMinute(tt.t)
+		if !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Replaces the traffic history of a device for the duration of a test
+func setTraffic(t *testing.T, deviceid int, dps map[time.Time]*Datapoint) {
+	TrafficHistory.Lock()
+	TrafficHistory.h[deviceid] = &FlowSummary{NodeId: deviceid, Datapoints: dps}
+	TrafficHistory.Unlock()
+	t.Cleanup(func() {
+		TrafficHistory.Lock()
+		delete(TrafficHistory.h, deviceid)
+		TrafficHistory.Unlock()
+	})
+}
+
+// Returns minutes of traffic ending at last, the last recent minutes with other traffic
+func trafficMinutes(last time.Time, minutes int, normal Datapoint, recent int, peak Datapoint) map[time.Time]*Datapoint {
+	dps := map[time.Time]*Datapoint{}
+	for i := 0; i < minutes; i++ {
+		dp := normal
+		if i < recent {
+			dp = peak
+		}
+		dps[last.Add(-time.Duration(i)*time.Minute)] = &dp
+	}
+	return dps
+}
+
+func TestPeakDetector(t *testing.T) {
+	minute := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	normal := Datapoint{BytesSent: 1000, BytesReceived: 1000, PacketsSent: 10, PacketsReceived: 10}
+	big := 10 * PEAK_INBOUND_THRESHOLD
+	tests := []struct {
+		name    string
+		inbound bool
+		recent  int
+		peak    Datapoint
+		verdict bool
+	}{
+		{"no peak", false, 5, normal, false},
+		{"single peak minute", false, 1, Datapoint{BytesSent: big}, false},
+		{"peak in most recent minutes", false, 4, Datapoint{BytesSent: big}, true},
+		{"peak below threshold", false, 4, Datapoint{BytesSent: PEAK_THRESHOLD - 1}, false},
+		{"inbound peak, outbound detector", false, 4, Datapoint{BytesReceived: big}, false},
+		{"inbound peak", true, 4, Datapoint{BytesReceived: big}, true},
+	}
+	for _, tt := range tests {
+		setTraffic(t, 9001, trafficMinutes(minute, 60, normal, tt.recent, tt.peak))
+		d := &peakDetector{MaxIncrease: PEAK_MAX_INCREASE, Threshold: PEAK_THRESHOLD, Penalty: PENALTY_THRESHOLD,
+			Action: ACTION_BLOCK_DEVICE, inbound: tt.inbound}
+		if tt.inbound {
+			d.Threshold = PEAK_INBOUND_THRESHOLD
+		}
+		verdicts := d.AnalyseTraffic(9001, minute)
+		if (combineVerdicts(verdicts).Action != ACTION_NONE) != tt.verdict {
+			t.Errorf("%v: got %v, want verdict %v", tt.name, verdicts, tt.verdict)
+		}
+	}
+}
+
+func TestGetPeakMaxima(t *testing.T) {
+	last := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	dps := trafficMinutes(last, 60, Datapoint{BytesSent: 10, PacketsSent: 1, BytesReceived: 20, PacketsReceived: 2},
+		0, Datapoint{})
+	for i := 0; i < 60; i += 7 {
+		dps[last.Add(-time.Duration(i)*time.Minute)] = &Datapoint{BytesSent: 1000 - i, PacketsSent: i,
+			BytesReceived: 500 + i, PacketsReceived: 100 - i}
+	}
+	setTraffic(t, 9001, dps)
+	copied := map[time.Time]Datapoint{}
+	minutes := []time.Time{}
+	for k, v := range dps {
+		copied[k] = *v
+		minutes = append(minutes, k)
+	}
+	maxima := getPeakMaxima(copied, minutes)
+	for _, minute := range minutes {
+		_, _, _, _, maxbytes, maxpackets := getPeak(9001, minute, false)
+		_, _, _, _, inmaxbytes, inmaxpackets := getPeak(9001, minute, true)
+		want := Datapoint{BytesSent: maxbytes, PacketsSent: maxpackets, BytesReceived: inmaxbytes,
+			PacketsReceived: inmaxpackets}
+		if maxima[minute] != want {
+			t.Errorf("%v: maxima %+v, want %+v", minute, maxima[minute], want)
+		}
+	}
+}
+
+func TestHandlePeakInfo(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &ManualClock{}
+	c.Set(now)
+	SetClock(c)
+	defer SetClock(systemClock{})
+
+	// 30 minutes of traffic before now, with a peak 10 minutes ago
+	normal := Datapoint{BytesSent: 1000, PacketsSent: 10, BytesReceived: 2000, PacketsReceived: 20}
+	dps := trafficMinutes(now.Add(-time.Minute), 30, normal, 0, normal)
+	dps[now.Add(-10*time.Minute)] = &Datapoint{BytesSent: 10000000, PacketsSent: 7000000,
+		BytesReceived: 2000, PacketsReceived: 20}
+	setTraffic(t, 9001, dps)
+	defer func() {
+		Phases.Lock()
+		delete(Phases.s, 9001)
+		Phases.Unlock()
+	}()
+
+	unix := func(minutes int) int64 { return now.Add(time.Duration(minutes) * time.Minute).Unix() }
+	tests := []struct {
+		name       string
+		argument   string
+		resolution int
+		items      int
+		penalised  string // key of the item with the peak
+		bytes      int    // bytes sent in that item
+	}{
+		{"node only", "9001", 1, 30, "-10", 10000000},
+		{"range", fmt.Sprintf(`{"node": 9001, "from": %v, "to": %v}`, unix(-15), unix(-5)), 1, 11, "-10",
+			10000000},
+		{"resolution", fmt.Sprintf(`{"node": 9001, "from": %v, "resolution": 5}`, unix(-15)), 5, 3, "-10",
+			10004000},
+		{"resolution raised to the maximum number of items", fmt.Sprintf(`{"node": 9001, "from": %v}`,
+			unix(-48*60)), 2, 15, "-10", 10001000},
+	}
+	for _, tt := range tests {
+		testBroker.results("")
+		handlePeakInfo(json.RawMessage(tt.argument))
+		results := testBroker.results("peakinfo")
+		if len(results) != 1 {
+			t.Fatalf("%v: %v replies, want 1", tt.name, len(results))
+		}
+		reply := struct {
+			Maxbytes, Maxpackets, Maxbytesreceived, Maxpacketsreceived int
+			Derivation, Phase, Nextphase                               string
+			Minutestonextphase                                         float64
+			Resolution                                                 int
+			Items                                                      map[string]struct {
+				Bytes                                              int
+				Penaltybytes, Penaltypackets, Penaltybytesreceived bool
+			}
+		}{}
+		if err := json.Unmarshal(results[0], &reply); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		// The limits are the highest traffic before the last minutes, times the increase
+		if reply.Maxbytes != 12000000 || reply.Maxpackets != 8400000 || reply.Maxbytesreceived != 2400 ||
+			reply.Maxpacketsreceived != 24 {
+			t.Errorf("%v: limits %v/%v, received %v/%v", tt.name, reply.Maxbytes, reply.Maxpackets,
+				reply.Maxbytesreceived, reply.Maxpacketsreceived)
+		}
+		if !strings.Contains(reply.Derivation, "(10000000/7000000)") {
+			t.Errorf("%v: derivation %q", tt.name, reply.Derivation)
+		}
+		if reply.Phase != PHASE_REPORTING || reply.Nextphase != PHASE_ENFORCING || reply.Minutestonextphase != 30 {
+			t.Errorf("%v: phase %v, next %v in %v minutes", tt.name, reply.Phase, reply.Nextphase,
+				reply.Minutestonextphase)
+		}
+		if reply.Resolution != tt.resolution || len(reply.Items) != tt.items {
+			t.Errorf("%v: %v items per %v minutes, want %v per %v", tt.name, len(reply.Items), reply.Resolution,
+				tt.items, tt.resolution)
+		}
+		// Only the peak is penalised, later items are judged by the limits at their start
+		for key, item := range reply.Items {
+			peak := key == tt.penalised
+			if item.Penaltybytes != peak || item.Penaltypackets != peak || item.Penaltybytesreceived {
+				t.Errorf("%v: item %v penalties %v/%v/%v, want %v", tt.name, key, item.Penaltybytes,
+					item.Penaltypackets, item.Penaltybytesreceived, peak)
+			}
+			if peak && item.Bytes != tt.bytes {
+				t.Errorf("%v: item %v has %v bytes, want %v", tt.name, key, item.Bytes, tt.bytes)
+			}
+		}
+	}
+
+	testBroker.results("")
+	handlePeakInfo(json.RawMessage("9002"))
+	if results := testBroker.results("peakinfo"); len(results) != 1 || len(results[0]) != 0 {
+		t.Errorf("unknown node: replies %q, want one without result", results)
+	}
+}
+
+func TestPeakConfigure(t *testing.T) {
+	tests := []struct {
+		config    string
+		valid     bool
+		threshold int
+	}{
+		{`{"threshold": 1000}`, true, 1000},
+		{`{"threshold": 1000, "maxincrease": 0}`, false, PEAK_THRESHOLD},
+		{`{"threshold": 1000, "penalty": "three"}`, false, PEAK_THRESHOLD},
+		{`{"threshold": 1000, "action": "explode"}`, false, PEAK_THRESHOLD},
+		{`{"threshold": -1}`, false, PEAK_THRESHOLD},
+	}
+	for _, tt := range tests {
+		d := &peakDetector{MaxIncrease: PEAK_MAX_INCREASE, Threshold: PEAK_THRESHOLD, Penalty: PENALTY_THRESHOLD,
+			Action: ACTION_BLOCK_DEVICE}
+		if err := d.Configure(json.RawMessage(tt.config)); (err == nil) != tt.valid {
+			t.Errorf("%v: error %v, want valid %v", tt.config, err, tt.valid)
+		}
+		// An invalid configuration is not applied at all
+		if d.Threshold != tt.threshold || d.MaxIncrease <= 0 || d.Action != ACTION_BLOCK_DEVICE {
+			t.Errorf("%v: configured %+v", tt.config, d)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Human approval of blocks for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * While a device is in the reporting phase, blocks are not enforced but
+ * proposed. Every proposal is published with an identifier, and can be
+ * approved (approve_action) or rejected (reject_action) in the SPIN UI.
+ * Proposals that are not decided within APPROVAL_TIMEOUT are applied.
+ * Decisions are remembered per pattern (device, node, action and
+ * detectors), so the same proposal is not asked about again, until the
+ * decision is forgotten (forget_decision). Decided proposals are removed
+ * ALERT_RETENTION after their decision.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const APPROVAL_TIMEOUT = time.Hour          // Undecided proposals are applied after this long
+const APPROVAL_CHECK_INTERVAL = time.Minute // Time between checks for timed out proposals
+
+const APPROVAL_PENDING = "pending"
+const APPROVAL_APPROVED = "approved"
+const APPROVAL_REJECTED = "rejected"
+const APPROVAL_TIMED_OUT = "timedout" // Applied after the timeout
+
+type PendingAction struct {
+	Id        int       `json:"id"`
+	Node      int       `json:"node"`      // SPIN identifier of the node to block
+	Device    int       `json:"device"`    // Device the block is proposed for
+	Action    string    `json:"action"`    // block_remote or block_device
+	Detectors string    `json:"detectors"` // Detectors that proposed the block
+	Reason    string    `json:"reason"`
+	Verdicts  []Verdict `json:"verdicts"`
+	State     string    `json:"state"` // pending, approved, rejected or timedout
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"` // Applied at this time, if still pending
+	Decided   time.Time `json:"decided"`
+}
+
+type ApprovalState struct {
+	Actions   map[int]*PendingAction `json:"actions"`
+	Decisions map[string]string      `json:"decisions"` // Remembered decision (approved, rejected) per pattern
+	NextId    int                    `json:"nextid"`
+}
+
+var Approvals = struct {
+	sync.RWMutex
+	s ApprovalState
+}{s: ApprovalState{Actions: map[int]*PendingAction{}, Decisions: map[string]string{}, NextId: 1}}
+
+// Initialise the approval workflow, with previous proposals and decisions
+func InitApproval(oldstate *ApprovalState) {
+	Approvals.Lock()
+	if oldstate != nil && oldstate.Actions != nil {
+		Approvals.s = *oldstate
+		if Approvals.s.Decisions == nil {
+			Approvals.s.Decisions = map[string]string{}
+		}
+	}
+	Approvals.Unlock()
+
+	RegisterCommand("get_pending_actions", handlePendingActions)
+	RegisterCommand("approve_action", func(argument json.RawMessage) { handleDecideAction(argument, APPROVAL_APPROVED) })
+	RegisterCommand("reject_action", func(argument json.RawMessage) { handleDecideAction(argument, APPROVAL_REJECTED) })
+	RegisterCommand("forget_decision", handleForgetDecision)
+	go func() {
+		for {
+			clock.Sleep(APPROVAL_CHECK_INTERVAL)
+			TimeoutActions()
+		}
+	}()
+}
+
+// Pattern of a proposal, used to remember decisions
+func (a *PendingAction) pattern() string {
+	return fmt.Sprintf("%v %v %v %v", a.Device, a.Node, a.Action, a.Detectors)
+}
+
+// Proposes to block a node on behalf of a device. A remembered approval is applied
+// right away, a remembered rejection or an identical pending proposal is left alone.
+func ProposeBlock(node int, deviceid int, action string, names string, reasons string, verdicts []Verdict) {
+	now := clock.Now()
+	proposal := &PendingAction{Node: node, Device: deviceid, Action: action, Detectors: names, Reason: reasons,
+		Verdicts: verdicts, State: APPROVAL_PENDING, Created: now, Expires: now.Add(APPROVAL_TIMEOUT)}
+
+	Approvals.Lock()
+	decision := Approvals.s.Decisions[proposal.pattern()]
+	if decision == "" {
+		for _, a := range Approvals.s.Actions {
+			if a.State == APPROVAL_PENDING && a.pattern() == proposal.pattern() {
+				Approvals.Unlock()
+				return
+			}
+		}
+		proposal.Id = Approvals.s.NextId
+		Approvals.s.NextId++
+		Approvals.s.Actions[proposal.Id] = proposal
+	}
+	Approvals.Unlock()
+
+	switch decision {
+	case APPROVAL_APPROVED:
+		applyAction(*proposal, ISSUER_USER)
+	case APPROVAL_REJECTED:
+	default:
+		fmt.Println("AP: proposed action", proposal.Id, "to block node", node, "for device", DeviceLabel(deviceid),
+			"by", names, ":", reasons)
+		publishResult("pendingaction", fmt.Sprintf("%v", proposal.Id), proposal)
+	}
+}
+
+// Enforces a proposal
+func applyAction(a PendingAction, issuer string) {
+	what := fmt.Sprintf("node %v of device %v", a.Node, DeviceLabel(a.Device))
+	if a.Action == ACTION_BLOCK_DEVICE {
+		what = fmt.Sprintf("device %v", DeviceLabel(a.Device))
+	}
+	enforceBlock(a.Node, a.Device, what, issuer, a.Detectors, a.Reason, a.Verdicts)
+}
+
+// Applies all pending proposals that timed out, and removes decided proposals beyond retention
+func TimeoutActions() {
+	now := clock.Now()
+	apply := []PendingAction{}
+	Approvals.Lock()
+	for id, a := range Approvals.s.Actions {
+		if a.State == APPROVAL_PENDING && now.After(a.Expires) {
+			a.State, a.Decided = APPROVAL_TIMED_OUT, now
+			apply = append(apply, *a)
+		} else if a.State != APPROVAL_PENDING && now.Sub(a.Decided) > ALERT_RETENTION {
+			delete(Approvals.s.Actions, id)
+		}
+	}
+	Approvals.Unlock()
+
+	for _, a := range apply {
+		fmt.Println("AP: action", a.Id, "was not decided in time, applying")
+		applyAction(a, ISSUER_TIMEOUT)
+		publishResult("pendingaction", fmt.Sprintf("%v", a.Id), a)
+	}
+}
+
+// Returns a copy of all proposals and decisions, for persistence
+func ApprovalsState() ApprovalState {
+	Approvals.RLock()
+	defer Approvals.RUnlock()
+	state := ApprovalState{Actions: map[int]*PendingAction{}, Decisions: map[string]string{}, NextId: Approvals.s.NextId}
+	for id, a := range Approvals.s.Actions {
+		action := *a
+		state.Actions[id] = &action
+	}
+	for pattern, d := range Approvals.s.Decisions {
+		state.Decisions[pattern] = d
+	}
+	return state
+}
+
+// Handles the get_pending_actions command, replies with all pending proposals
+// and the remembered decisions per pattern
+func handlePendingActions(argument json.RawMessage) {
+	Approvals.RLock()
+	actions := []PendingAction{}
+	for _, a := range Approvals.s.Actions {
+		if a.State == APPROVAL_PENDING {
+			actions = append(actions, *a)
+		}
+	}
+	decisions := map[string]string{}
+	for pattern, d := range Approvals.s.Decisions {
+		decisions[pattern] = d
+	}
+	Approvals.RUnlock()
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Id < actions[j].Id })
+	publishResult("pendingactions", "", map[string]interface{}{"actions": actions, "decisions": decisions})
+}
+
+// Handles the forget_decision command, argument is a pattern of get_pending_actions.
+// Replies with the forgotten decision, or without result if there was none.
+func handleForgetDecision(argument json.RawMessage) {
+	var pattern string
+	if err := json.Unmarshal(argument, &pattern); err != nil {
+		return
+	}
+	Approvals.Lock()
+	decision, exists := Approvals.s.Decisions[pattern]
+	delete(Approvals.s.Decisions, pattern)
+	Approvals.Unlock()
+
+	if !exists {
+		publishResult("forgetdecision", pattern, nil)
+		return
+	}
+	fmt.Println("AP: decision", decision, "of", pattern, "forgotten by the user")
+	publishResult("forgetdecision", pattern, decision)
+}
+
+// Handles the approve_action and reject_action commands, argument is the id of the proposal
+func handleDecideAction(argument json.RawMessage, state string) {
+	id, ok := argumentInt(argument)
+	if !ok {
+		return
+	}
+	Approvals.Lock()
+	a, exists := Approvals.s.Actions[id]
+	if !exists || a.State != APPROVAL_PENDING {
+		Approvals.Unlock()
+		return
+	}
+	a.State, a.Decided = state, clock.Now()
+	Approvals.s.Decisions[a.pattern()] = state
+	res := *a
+	Approvals.Unlock()
+
+	fmt.Println("AP: action", id, state, "by the user")
+	if state == APPROVAL_APPROVED {
+		applyAction(res, ISSUER_USER)
+	}
+	publishResult("pendingaction", fmt.Sprintf("%v", id), res)
+}
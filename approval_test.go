@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestApprovalWorkflow(t *testing.T) {
+	c := &ManualClock{}
+	c.Set(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	SetClock(c)
+	defer SetClock(systemClock{})
+	resetSafety(nil, 0, true)
+	defer resetSafety(nil, 0, false)
+	Approvals.Lock()
+	Approvals.s = ApprovalState{Actions: map[int]*PendingAction{}, Decisions: map[string]string{}, NextId: 1}
+	Approvals.Unlock()
+
+	states := func() map[int]string {
+		Approvals.RLock()
+		defer Approvals.RUnlock()
+		res := map[int]string{}
+		for id, a := range Approvals.s.Actions {
+			res[id] = a.State
+		}
+		return res
+	}
+	steps := []struct {
+		name string
+		step func()
+		want map[int]string
+	}{
+		{"propose", func() { ProposeBlock(9001, 9001, ACTION_BLOCK_DEVICE, "test", "", nil) },
+			map[int]string{1: APPROVAL_PENDING}},
+		{"propose again", func() { ProposeBlock(9001, 9001, ACTION_BLOCK_DEVICE, "test", "", nil) },
+			map[int]string{1: APPROVAL_PENDING}},
+		{"reject", func() { handleDecideAction([]byte("1"), APPROVAL_REJECTED) },
+			map[int]string{1: APPROVAL_REJECTED}},
+		{"propose rejected", func() { ProposeBlock(9001, 9001, ACTION_BLOCK_DEVICE, "test", "", nil) },
+			map[int]string{1: APPROVAL_REJECTED}},
+		{"propose other", func() { ProposeBlock(9002, 9002, ACTION_BLOCK_DEVICE, "test", "", nil) },
+			map[int]string{1: APPROVAL_REJECTED, 2: APPROVAL_PENDING}},
+		{"before timeout", func() { c.Advance(APPROVAL_TIMEOUT - time.Minute); TimeoutActions() },
+			map[int]string{1: APPROVAL_REJECTED, 2: APPROVAL_PENDING}},
+		{"timeout", func() { c.Advance(2 * time.Minute); TimeoutActions() },
+			map[int]string{1: APPROVAL_REJECTED, 2: APPROVAL_TIMED_OUT}},
+		{"retention of the rejection", func() { c.Advance(ALERT_RETENTION - APPROVAL_TIMEOUT); TimeoutActions() },
+			map[int]string{2: APPROVAL_TIMED_OUT}},
+		{"retention of the timeout", func() { c.Advance(APPROVAL_TIMEOUT + time.Minute); TimeoutActions() },
+			map[int]string{}},
+	}
+	for _, s := range steps {
+		s.step()
+		got := states()
+		if len(got) != len(s.want) {
+			t.Fatalf("%v: got %v, want %v", s.name, got, s.want)
+		}
+		for id, state := range s.want {
+			if got[id] != state {
+				t.Fatalf("%v: got %v, want %v", s.name, got, s.want)
+			}
+		}
+	}
+	Approvals.RLock()
+	decisions := len(Approvals.s.Decisions)
+	Approvals.RUnlock()
+	if decisions != 1 {
+		t.Errorf("%v decisions remembered, want 1", decisions)
+	}
+
+	// The decision is listed until it is forgotten, after which the block is proposed again
+	pattern := "9001 9001 block_device test"
+	testBroker.results("")
+	handlePendingActions(nil)
+	results := testBroker.results("pendingactions")
+	reply := struct {
+		Actions   []PendingAction   `json:"actions"`
+		Decisions map[string]string `json:"decisions"`
+	}{}
+	if len(results) != 1 || json.Unmarshal(results[0], &reply) != nil || len(reply.Actions) != 0 ||
+		reply.Decisions[pattern] != APPROVAL_REJECTED {
+		t.Errorf("pending actions %q, want only the decision of %q", results, pattern)
+	}
+	handleForgetDecision([]byte(`"` + pattern + `"`))
+	if results := testBroker.results("forgetdecision"); len(results) != 1 || string(results[0]) != `"rejected"` {
+		t.Errorf("forget decision replied %q", results)
+	}
+	ProposeBlock(9001, 9001, ACTION_BLOCK_DEVICE, "test", "", nil)
+	if got := states(); len(got) != 1 || got[3] != APPROVAL_PENDING {
+		t.Errorf("proposals %v after forgetting the decision, want 3 pending", got)
+	}
+}
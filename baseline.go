@@ -0,0 +1,280 @@
+/*
+ * Statistical baseline detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Keeps statistics of the outgoing traffic of every device over rolling
+ * windows (last day, last week and all time): mean, standard deviation,
+ * median, median absolute deviation (MAD) and high percentiles.
+ * A minute is anomalous when it exceeds the z-score or the percentile in
+ * every window that has enough samples. With robust enabled, the z-score is
+ * based on median and MAD instead of mean and standard deviation.
+ * Minutes that were flagged are left out of the statistics, so a single
+ * burst does not raise the baseline. Flags expire after BASELINE_FLAG_TTL,
+ * when a single minute hardly affects the statistics anymore.
+ * Only minutes with traffic are stored, so statistics are over active minutes.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BASELINE_REFRESH = 15 * time.Minute    // Time after which statistics are computed again
+const MAD_SCALE = 1.4826                     // Scales the MAD to the standard deviation of a normal distribution
+const BASELINE_FLAG_TTL = 7 * 24 * time.Hour // Flagged minutes are forgotten after this time
+
+type baselineWindow struct {
+	Name   string
+	Length time.Duration // 0 means all time
+}
+
+var baselineWindows = []baselineWindow{{"day", 24 * time.Hour}, {"week", 7 * 24 * time.Hour}, {"alltime", 0}}
+
+type Stats struct {
+	Samples    int     `json:"samples"`
+	Mean       float64 `json:"mean"`
+	StdDev     float64 `json:"stddev"`
+	Median     float64 `json:"median"`
+	MAD        float64 `json:"mad"`        // Median absolute deviation
+	Percentile float64 `json:"percentile"` // Value of the configured percentile
+}
+
+// Statistics of a single device, per window and per metric (bytes, packets)
+type deviceBaseline struct {
+	computed time.Time
+	bytes    map[string]Stats
+	packets  map[string]Stats
+}
+
+type baselineDetector struct {
+	ZScore     float64 `json:"zscore"`     // Flag minutes above this z-score
+	Percentile float64 `json:"percentile"` // Flag minutes above this percentile (0-100), 0 disables
+	Robust     bool    `json:"robust"`     // Use median and MAD instead of mean and standard deviation
+	MinSamples int     `json:"minsamples"` // Windows with fewer samples are ignored
+	MinBytes   int     `json:"minbytes"`   // Traffic (per minute) below this is always allowed
+	Action     string  `json:"action"`     // Action on an anomalous minute
+
+	sync.Mutex
+	baselines map[int]*deviceBaseline
+	flagged   map[int]map[time.Time]bool // Flagged minutes per device, left out of statistics
+}
+
+var baseline = &baselineDetector{ZScore: 4, Percentile: 99.9, Robust: true, MinSamples: 60,
+	MinBytes: PEAK_THRESHOLD, Action: ACTION_REPORT,
+	baselines: map[int]*deviceBaseline{}, flagged: map[int]map[time.Time]bool{}}
+
+// Initialise the baseline detector, with previously flagged minutes
+func InitBaseline(oldstate *map[int][]time.Time) {
+	if oldstate != nil {
+		baseline.Lock()
+		for deviceid, minutes := range *oldstate {
+			baseline.flagged[deviceid] = map[time.Time]bool{}
+			for _, t := range minutes {
+				baseline.flagged[deviceid][getRoundedMinute(t)] = true
+			}
+		}
+		baseline.Unlock()
+	}
+	RegisterDetector(baseline, true)
+}
+
+// Returns the flagged minutes of all devices, for persistence
+func BaselineState() map[int][]time.Time {
+	baseline.Lock()
+	defer baseline.Unlock()
+	state := map[int][]time.Time{}
+	now := clock.Now()
+	for deviceid, minutes := range baseline.flagged {
+		for t := range minutes {
+			if now.Sub(t) > BASELINE_FLAG_TTL {
+				continue
+			}
+			state[deviceid] = append(state[deviceid], t)
+		}
+	}
+	return state
+}
+
+func (d *baselineDetector) Name() string {
+	return "baseline"
+}
+
+func (d *baselineDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	if err := json.Unmarshal(config, d); err != nil {
+		return err
+	}
+	d.baselines = map[int]*deviceBaseline{} // percentile may have changed
+	return nil
+}
+
+func (d *baselineDetector) AnalyseTraffic(deviceid int, minute time.Time) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+
+	TrafficHistory.RLock()
+	node, exists := TrafficHistory.h[deviceid]
+	if !exists || node.Datapoints[minute] == nil {
+		TrafficHistory.RUnlock()
+		return nil
+	}
+	current := *node.Datapoints[minute]
+	b := d.baselines[deviceid]
+	if b == nil || clock.Now().Sub(b.computed) > BASELINE_REFRESH {
+		b = d.computeBaseline(deviceid, node.Datapoints, minute)
+		d.baselines[deviceid] = b
+	}
+	TrafficHistory.RUnlock()
+
+	if current.BytesSent < d.MinBytes {
+		return nil
+	}
+	reasonb, anomalousb := d.exceeds(float64(current.BytesSent), b.bytes)
+	reasonp, anomalousp := d.exceeds(float64(current.PacketsSent), b.packets)
+	if !anomalousb && !anomalousp {
+		return nil
+	}
+
+	// Leave this minute out of future statistics
+	if d.flagged[deviceid] == nil {
+		d.flagged[deviceid] = map[time.Time]bool{}
+	}
+	d.flagged[deviceid][minute] = true
+
+	reason := fmt.Sprintf("%v bytes (%v), %v packets (%v) in minute %v", current.BytesSent, reasonb,
+		current.PacketsSent, reasonp, minute.Format("15:04"))
+	return []Verdict{{Detector: d.Name(), Deviceid: deviceid, Score: 1, Reason: reason, Action: d.Action}}
+}
+
+// Takes over the flagged minutes of device from, statistics are computed again
+func (d *baselineDetector) MergeDevice(from int, into int) {
+	d.Lock()
+	defer d.Unlock()
+	if d.flagged[from] != nil && d.flagged[into] == nil {
+		d.flagged[into] = map[time.Time]bool{}
+	}
+	for t := range d.flagged[from] {
+		d.flagged[into][t] = true
+	}
+	delete(d.flagged, from)
+	delete(d.baselines, from)
+	delete(d.baselines, into)
+}
+
+// Requires lock on baselineDetector and read lock on TrafficHistory
+// Computes statistics for all windows, leaving out the current and flagged minutes
+func (d *baselineDetector) computeBaseline(deviceid int, dps map[time.Time]*Datapoint, current time.Time) *deviceBaseline {
+	d.expireFlagged(deviceid, current)
+	b := &deviceBaseline{computed: clock.Now(), bytes: map[string]Stats{}, packets: map[string]Stats{}}
+	for _, w := range baselineWindows {
+		bytes := []float64{}
+		packets := []float64{}
+		for t, dp := range dps {
+			if t.Equal(current) || d.flagged[deviceid][t] || (w.Length > 0 && current.Sub(t) > w.Length) {
+				continue
+			}
+			bytes = append(bytes, float64(dp.BytesSent))
+			packets = append(packets, float64(dp.PacketsSent))
+		}
+		b.bytes[w.Name] = computeStats(bytes, d.Percentile)
+		b.packets[w.Name] = computeStats(packets, d.Percentile)
+	}
+	return b
+}
+
+// Requires lock on baselineDetector
+// Forgets flagged minutes of a device older than BASELINE_FLAG_TTL
+func (d *baselineDetector) expireFlagged(deviceid int, now time.Time) {
+	for t := range d.flagged[deviceid] {
+		if now.Sub(t) > BASELINE_FLAG_TTL {
+			delete(d.flagged[deviceid], t)
+		}
+	}
+	if len(d.flagged[deviceid]) == 0 {
+		delete(d.flagged, deviceid)
+	}
+}
+
+// Requires lock on baselineDetector
+// Checks whether a value is anomalous in every window with enough samples
+func (d *baselineDetector) exceeds(value float64, stats map[string]Stats) (string, bool) {
+	reasons := []string{}
+	windows := 0
+	for _, w := range baselineWindows {
+		s := stats[w.Name]
+		if s.Samples < d.MinSamples {
+			continue
+		}
+		windows++
+
+		center, spread := s.Mean, s.StdDev
+		if d.Robust {
+			center, spread = s.Median, MAD_SCALE*s.MAD
+		}
+		z := math.Inf(1)
+		if spread > 0 {
+			z = (value - center) / spread
+		}
+		overz := d.ZScore > 0 && z > d.ZScore
+		overp := d.Percentile > 0 && value > s.Percentile
+		if !overz && !overp {
+			return "", false
+		}
+		reasons = append(reasons, fmt.Sprintf("%v: z=%.1f p%v=%.0f", w.Name, z, d.Percentile, s.Percentile))
+	}
+	return strings.Join(reasons, ", "), windows > 0
+}
+
+// Computes statistics of a list of values, percentile is between 0 and 100
+func computeStats(values []float64, percentile float64) Stats {
+	n := len(values)
+	if n == 0 {
+		return Stats{}
+	}
+	sort.Float64s(values)
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(n)
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(n)
+
+	median := quantile(values, 50)
+	deviations := make([]float64, n)
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	sort.Float64s(deviations)
+
+	return Stats{Samples: n, Mean: mean, StdDev: math.Sqrt(variance), Median: median,
+		MAD: quantile(deviations, 50), Percentile: quantile(values, percentile)}
+}
+
+// Returns the p-th percentile (0-100) of a sorted list, with linear interpolation
+func quantile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	if upper >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[upper]-sorted[lower])
+}
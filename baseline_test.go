@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestQuantile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 50, 0},
+		{[]float64{7}, 99, 7},
+		{sorted, 0, 1},
+		{sorted, 50, 3},
+		{sorted, 100, 5},
+		{sorted, 25, 2},
+		{sorted, 90, 4.6},
+	}
+	for _, tt := range tests {
+		if got := quantile(tt.values, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("quantile(%v, %v) = %v, want %v", tt.values, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	s := computeStats([]float64{2, 4, 4, 4, 5, 5, 7, 9}, 50)
+	want := Stats{Samples: 8, Mean: 5, StdDev: 2, Median: 4.5, MAD: 0.5, Percentile: 4.5}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+	if s := computeStats(nil, 50); s != (Stats{}) {
+		t.Errorf("empty: got %+v", s)
+	}
+}
+
+func TestBaselineExceeds(t *testing.T) {
+	d := &baselineDetector{ZScore: 4, Percentile: 99, Robust: true, MinSamples: 10}
+	enough := Stats{Samples: 100, Mean: 100, StdDev: 10, Median: 100, MAD: 10, Percentile: 150}
+	few := Stats{Samples: 5, Median: 1, MAD: 1, Percentile: 1}
+	tests := []struct {
+		name  string
+		value float64
+		stats map[string]Stats
+		want  bool
+	}{
+		{"normal", 120, map[string]Stats{"day": enough, "week": enough}, false},
+		{"above z and percentile", 1000, map[string]Stats{"day": enough, "week": enough}, true},
+		{"only windows with too few samples", 1000, map[string]Stats{"day": few}, false},
+		{"small windows are ignored", 1000, map[string]Stats{"day": few, "week": enough}, true},
+		{"normal in one window", 1000, map[string]Stats{"day": enough,
+			"week": {Samples: 100, Median: 900, MAD: 100, Percentile: 2000}}, false},
+	}
+	for _, tt := range tests {
+		if _, got := d.exceeds(tt.value, tt.stats); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBaselineExpireFlagged(t *testing.T) {
+	now := time.Date(2026, 1, 8, 12, 0, 0, 0, time.UTC)
+	d := &baselineDetector{flagged: map[int]map[time.Time]bool{
+		1: {now.Add(-time.Hour): true, now.Add(-BASELINE_FLAG_TTL - time.Minute): true},
+		2: {now.Add(-BASELINE_FLAG_TTL - time.Minute): true},
+	}}
+	d.expireFlagged(1, now)
+	d.expireFlagged(2, now)
+	if len(d.flagged[1]) != 1 || !d.flagged[1][now.Add(-time.Hour)] {
+		t.Errorf("device 1: got %v, want only the recent minute", d.flagged[1])
+	}
+	if _, exists := d.flagged[2]; exists {
+		t.Errorf("device 2: got %v, want no flags", d.flagged[2])
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Beaconing detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * A compromised device often "phones home" to its command and control
+ * server at fixed intervals, with tiny payloads that never cause a peak.
+ * This detector groups the flow events of every (device, remote node) pair
+ * into contacts, and measures how regular the intervals between contacts
+ * are with the coefficient of variation (standard deviation / mean).
+ * Highly regular, low volume communication is flagged, unless the remote
+ * node is a known update or time service.
+ * Pairs without contacts for BEACON_IDLE are forgotten, so beacons with
+ * longer intervals are not detected.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const BEACON_HISTORY = 32           // Number of contacts kept per (device, remote) pair
+const BEACON_IDLE = 24 * time.Hour  // Pairs without contacts for this long are forgotten
+const BEACON_EXPIRE = 1 * time.Hour // Time between checks for idle pairs
+
+type beaconPair struct {
+	device int
+	node   int
+}
+
+// Contacts of a device with a remote node
+type beaconTrack struct {
+	times   []time.Time // Start of every contact
+	bytes   []int       // Bytes (both directions) of every contact
+	flagged bool        // Reported before
+}
+
+type beaconDetector struct {
+	MinGap       int      `json:"mingap"`       // Events within this many seconds are the same contact
+	MinContacts  int      `json:"mincontacts"`  // Number of contacts needed before judging
+	MaxCV        float64  `json:"maxcv"`        // Flag intervals with a coefficient of variation below this
+	MaxBytes     int      `json:"maxbytes"`     // Flag only when contacts carry fewer bytes on average
+	AllowDomains []string `json:"allowdomains"` // Known update and time services, and their subdomains
+	AllowPorts   []int    `json:"allowports"`   // Ports of known services, e.g. NTP
+	Action       string   `json:"action"`       // Action on beaconing
+
+	sync.Mutex
+	tracks  map[beaconPair]*beaconTrack
+	expired time.Time // Last check for idle pairs
+}
+
+// Initialise the beacon detector
+func InitBeacon() {
+	RegisterDetector(&beaconDetector{MinGap: 5, MinContacts: 8, MaxCV: 0.1, MaxBytes: 10 * 1024,
+		AllowDomains: []string{"ntp.org", "time.apple.com", "time.windows.com", "time.google.com",
+			"windowsupdate.com", "update.microsoft.com", "connectivitycheck.gstatic.com", "captive.apple.com"},
+		AllowPorts: []int{123}, Action: ACTION_REPORT, tracks: map[beaconPair]*beaconTrack{}}, true)
+}
+
+func (d *beaconDetector) Name() string {
+	return "beacon"
+}
+
+func (d *beaconDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	return json.Unmarshal(config, d)
+}
+
+func (d *beaconDetector) AnalyseFlow(event FlowEvent) []Verdict {
+	d.Lock()
+	d.expireTracks(event.Timestamp)
+	pair := beaconPair{event.Deviceid, event.Flow.NodeId}
+	track, exists := d.tracks[pair]
+	if !exists {
+		track = &beaconTrack{}
+		d.tracks[pair] = track
+	}
+	bytes := event.BytesSent + event.BytesReceived
+	n := len(track.times)
+	if n > 0 && event.Timestamp.Sub(track.times[n-1]) < time.Duration(d.MinGap)*time.Second {
+		// Same contact
+		track.bytes[n-1] += bytes
+		d.Unlock()
+		return nil
+	}
+	track.times = append(track.times, event.Timestamp)
+	track.bytes = append(track.bytes, bytes)
+	if len(track.times) > BEACON_HISTORY {
+		track.times, track.bytes = track.times[1:], track.bytes[1:]
+	}
+
+	if track.flagged || len(track.times) < d.MinContacts || d.isAllowedPort(event.Flow.RemotePort) {
+		d.Unlock()
+		return nil
+	}
+	mean, cv := intervalStats(track.times)
+	avgbytes := 0
+	for _, b := range track.bytes {
+		avgbytes += b
+	}
+	avgbytes /= len(track.bytes)
+	if cv >= d.MaxCV || avgbytes >= d.MaxBytes {
+		d.Unlock()
+		return nil
+	}
+	allowDomains, action := d.AllowDomains, d.Action
+	d.Unlock()
+
+	// requires lock on History, so obtain without holding the detector lock
+	for _, name := range IPToName(event.Deviceid, event.Flow.RemoteIps) {
+		for _, pattern := range allowDomains {
+			if domainMatches(name, pattern) {
+				return nil
+			}
+		}
+	}
+
+	d.Lock()
+	track.flagged = true
+	d.Unlock()
+	return []Verdict{{Detector: d.Name(), Deviceid: event.Deviceid, Score: 1, Action: action,
+		Remote: event.Flow.NodeId, Reason: fmt.Sprintf("contacts node %v (port %v) every %v (cv %.2f), %v bytes on average",
+			event.Flow.NodeId, event.Flow.RemotePort, mean.Round(time.Second), cv, avgbytes)}}
+}
+
+// Requires lock on beaconDetector
+// Forgets pairs without contacts for BEACON_IDLE, at most once per BEACON_EXPIRE
+func (d *beaconDetector) expireTracks(now time.Time) {
+	if now.Sub(d.expired) < BEACON_EXPIRE {
+		return
+	}
+	d.expired = now
+	for pair, track := range d.tracks {
+		if n := len(track.times); n == 0 || now.Sub(track.times[n-1]) > BEACON_IDLE {
+			delete(d.tracks, pair)
+		}
+	}
+}
+
+// Requires lock on beaconDetector
+func (d *beaconDetector) isAllowedPort(port int) bool {
+	for _, p := range d.AllowPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the mean interval between a list of times, and the coefficient of variation of the intervals
+func intervalStats(times []time.Time) (time.Duration, float64) {
+	if len(times) < 2 {
+		return 0, math.Inf(1)
+	}
+	intervals := make([]float64, len(times)-1)
+	mean := 0.0
+	for i := 1; i < len(times); i++ {
+		intervals[i-1] = times[i].Sub(times[i-1]).Seconds()
+		mean += intervals[i-1]
+	}
+	mean /= float64(len(intervals))
+	if mean <= 0 {
+		return 0, math.Inf(1)
+	}
+	variance := 0.0
+	for _, v := range intervals {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(intervals))
+	return time.Duration(mean * float64(time.Second)), math.Sqrt(variance) / mean
+}
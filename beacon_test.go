@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIntervalStats(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds ...int) []time.Time {
+		res := []time.Time{}
+		for _, s := range seconds {
+			res = append(res, start.Add(time.Duration(s)*time.Second))
+		}
+		return res
+	}
+	tests := []struct {
+		name  string
+		times []time.Time
+		mean  time.Duration
+		cv    float64
+	}{
+		{"single contact", at(0), 0, math.Inf(1)},
+		{"same moment", at(0, 0), 0, math.Inf(1)},
+		{"regular", at(0, 60, 120, 180), time.Minute, 0},
+		{"irregular", at(0, 30, 120), 60 * time.Second, 0.5},
+	}
+	for _, tt := range tests {
+		mean, cv := intervalStats(tt.times)
+		if mean != tt.mean || (cv != tt.cv && math.Abs(cv-tt.cv) > 1e-9) {
+			t.Errorf("%v: got %v %v, want %v %v", tt.name, mean, cv, tt.mean, tt.cv)
+		}
+	}
+}
+
+func TestBeaconDetector(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	newDetector := func() *beaconDetector {
+		return &beaconDetector{MinGap: 5, MinContacts: 8, MaxCV: 0.1, MaxBytes: 1000, AllowPorts: []int{123},
+			Action: ACTION_REPORT, tracks: map[beaconPair]*beaconTrack{}}
+	}
+	tests := []struct {
+		name     string
+		interval func(i int) time.Duration
+		bytes    int
+		port     int
+		verdicts int
+	}{
+		{"regular, small", func(i int) time.Duration { return time.Minute }, 100, 443, 1},
+		{"regular, large", func(i int) time.Duration { return time.Minute }, 5000, 443, 0},
+		{"regular, allowed port", func(i int) time.Duration { return time.Minute }, 100, 123, 0},
+		{"irregular", func(i int) time.Duration { return time.Duration(1+i%4) * time.Minute }, 100, 443, 0},
+	}
+	for _, tt := range tests {
+		d := newDetector()
+		verdicts := 0
+		ts := start
+		for i := 0; i < 20; i++ {
+			event := FlowEvent{SubFlow: SubFlow{Deviceid: 9003, Timestamp: ts, BytesSent: tt.bytes},
+				Flow: Flow{NodeId: 77, RemotePort: tt.port}}
+			verdicts += len(d.AnalyseFlow(event))
+			ts = ts.Add(tt.interval(i))
+		}
+		if verdicts != tt.verdicts {
+			t.Errorf("%v: %v verdicts, want %v", tt.name, verdicts, tt.verdicts)
+		}
+	}
+}
+
+func TestBeaconExpireTracks(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	d := &beaconDetector{tracks: map[beaconPair]*beaconTrack{
+		{1, 10}: {times: []time.Time{now.Add(-time.Hour)}},
+		{1, 11}: {times: []time.Time{now.Add(-BEACON_IDLE - time.Minute)}},
+		{2, 10}: {},
+	}}
+	d.expireTracks(now)
+	if len(d.tracks) != 1 || d.tracks[beaconPair{1, 10}] == nil {
+		t.Errorf("got %v tracks, want only the active pair", len(d.tracks))
+	}
+	d.tracks[beaconPair{3, 10}] = &beaconTrack{}
+	d.expireTracks(now.Add(time.Minute))
+	if len(d.tracks) != 2 {
+		t.Errorf("expired again within %v", BEACON_EXPIRE)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Block management for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Blocks issued by the anomaly detection are time-limited. A block is lifted
+ * with remove_block_node once it expires. When the same node offends again,
+ * the next block lasts BLOCK_ESCALATION times longer, until the last tier,
+ * which is permanent. Offences are forgotten after BLOCK_FORGET without a
+ * new block. Active blocks and offences are persisted.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const BLOCK_DURATION = 10 * time.Minute  // Duration of the first block
+const BLOCK_ESCALATION = 6               // Every next block lasts this many times longer
+const BLOCK_TIERS = 4                    // Number of time-limited blocks, the next block is permanent
+const BLOCK_FORGET = 7 * 24 * time.Hour  // Offences are forgotten after this long without a new block
+const BLOCK_CHECK_INTERVAL = time.Minute // Time between checks for expired blocks
+
+type Block struct {
+	Node    int       `json:"node"`    // SPIN identifier of the blocked node
+	Device  int       `json:"device"`  // Device the block was issued for, the node itself for a device block
+	Reason  string    `json:"reason"`  // Why the node was blocked
+	Tier    int       `json:"tier"`    // Number of earlier offences
+	Created time.Time `json:"created"` // Start of the block
+	Expires time.Time `json:"expires"` // End of the block, zero if permanent
+}
+
+type Offence struct {
+	Count int       `json:"count"` // Number of blocks
+	Last  time.Time `json:"last"`  // Start of the last block
+}
+
+type BlockState struct {
+	Active   map[int]*Block   `json:"active"`   // Active blocks, per node
+	Offences map[int]*Offence `json:"offences"` // Offences, per node
+}
+
+var Blocks = struct {
+	sync.RWMutex
+	s BlockState
+}{s: BlockState{Active: map[int]*Block{}, Offences: map[int]*Offence{}}}
+
+// Initialise the block manager, with previously active blocks
+func InitBlocks(oldstate *BlockState) {
+	Blocks.Lock()
+	if oldstate != nil && oldstate.Active != nil {
+		Blocks.s = *oldstate
+		if Blocks.s.Offences == nil {
+			Blocks.s.Offences = map[int]*Offence{}
+		}
+	}
+	Blocks.Unlock()
+
+	RegisterCommand("get_nmc_blocks", handleGetBlocks)
+	RegisterCommand("lift_block", handleLiftBlock)
+	go func() {
+		for {
+			clock.Sleep(BLOCK_CHECK_INTERVAL)
+			ExpireBlocks()
+		}
+	}()
+}
+
+// Returns the duration of a block for a node with a number of earlier offences, 0 means permanent
+func blockDuration(tier int) time.Duration {
+	if tier >= BLOCK_TIERS {
+		return 0
+	}
+	duration := BLOCK_DURATION
+	for i := 0; i < tier; i++ {
+		duration *= BLOCK_ESCALATION
+	}
+	return duration
+}
+
+// Blocks a node on behalf of a device, and records it in the ledger.
+// Returns the block, or nil if the node was blocked already.
+func BlockNode(node int, device int, issuer string, reason string, verdicts []Verdict) *Block {
+	now := clock.Now()
+	Blocks.Lock()
+	if _, exists := Blocks.s.Active[node]; exists {
+		Blocks.Unlock()
+		return nil
+	}
+
+	offence, exists := Blocks.s.Offences[node]
+	if !exists || now.Sub(offence.Last) > BLOCK_FORGET {
+		offence = &Offence{}
+		Blocks.s.Offences[node] = offence
+	}
+	block := &Block{Node: node, Device: device, Reason: reason, Tier: offence.Count, Created: now}
+	if duration := blockDuration(block.Tier); duration > 0 {
+		block.Expires = now.Add(duration)
+	}
+	offence.Count++
+	offence.Last = now
+	Blocks.s.Active[node] = block
+	res := *block
+	Blocks.Unlock()
+
+	SendEnforcement(SPINcommand{SPIN_CMD_ADD_BLOCK, node})
+	RecordEnforcement(LEDGER_BLOCK, node, device, issuer, fmt.Sprintf("%v, %v", reason, res.Until()), verdicts)
+	return &res
+}
+
+// Checks whether a node has an active block
+func IsBlocked(node int) bool {
+	Blocks.RLock()
+	defer Blocks.RUnlock()
+	_, exists := Blocks.s.Active[node]
+	return exists
+}
+
+// Describes when a block ends
+func (b *Block) Until() string {
+	if b.Expires.IsZero() {
+		return "permanently"
+	}
+	return fmt.Sprintf("for %v (tier %v)", b.Expires.Sub(b.Created), b.Tier+1)
+}
+
+// Lifts all blocks that have expired
+func ExpireBlocks() {
+	now := clock.Now()
+	Blocks.Lock()
+	expired := []Block{}
+	for node, block := range Blocks.s.Active {
+		if !block.Expires.IsZero() && now.After(block.Expires) {
+			expired = append(expired, *block)
+			delete(Blocks.s.Active, node)
+		}
+	}
+	Blocks.Unlock()
+	for _, block := range expired {
+		liftBlock(block, ISSUER_EXPIRY, "block expired")
+	}
+}
+
+// Sends and records the lift of a block, which must be removed from Blocks already.
+// Must not be called with a lock on Blocks, as it publishes to the broker.
+func liftBlock(block Block, issuer string, reason string) {
+	SendEnforcement(SPINcommand{SPIN_CMD_REMOVE_BLOCK, block.Node})
+	RecordEnforcement(LEDGER_UNBLOCK, block.Node, block.Device, issuer, reason, nil)
+	fmt.Println("BL: lifted block of node", block.Node)
+}
+
+// Returns a copy of the active blocks and offences, for persistence
+func BlocksState() BlockState {
+	Blocks.RLock()
+	defer Blocks.RUnlock()
+	state := BlockState{Active: map[int]*Block{}, Offences: map[int]*Offence{}}
+	for node, b := range Blocks.s.Active {
+		block := *b
+		state.Active[node] = &block
+	}
+	for node, o := range Blocks.s.Offences {
+		offence := *o
+		state.Offences[node] = &offence
+	}
+	return state
+}
+
+// Handles the get_nmc_blocks command, replies with all active blocks of the NMC.
+// SPIN itself answers get_blocks with its block list, so the NMC uses its own names.
+func handleGetBlocks(argument json.RawMessage) {
+	Blocks.RLock()
+	blocks := []Block{}
+	for _, b := range Blocks.s.Active {
+		blocks = append(blocks, *b)
+	}
+	Blocks.RUnlock()
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Created.Before(blocks[j].Created) })
+	publishResult("nmcblocks", "", blocks)
+}
+
+// Handles the lift_block command, argument is the node. Offences are kept.
+func handleLiftBlock(argument json.RawMessage) {
+	node, ok := argumentInt(argument)
+	if !ok {
+		return
+	}
+	Blocks.Lock()
+	block, exists := Blocks.s.Active[node]
+	delete(Blocks.s.Active, node)
+	Blocks.Unlock()
+	if exists {
+		liftBlock(*block, ISSUER_USER, "lifted by the user")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockDuration(t *testing.T) {
+	tests := []struct {
+		tier int
+		want time.Duration
+	}{
+		{0, BLOCK_DURATION},
+		{1, BLOCK_DURATION * BLOCK_ESCALATION},
+		{BLOCK_TIERS - 1, 216 * BLOCK_DURATION},
+		{BLOCK_TIERS, 0},
+		{BLOCK_TIERS + 5, 0},
+	}
+	for _, tt := range tests {
+		if got := blockDuration(tt.tier); got != tt.want {
+			t.Errorf("tier %v: got %v, want %v", tt.tier, got, tt.want)
+		}
+	}
+}
+
+func TestBlockEscalation(t *testing.T) {
+	c := &ManualClock{}
+	c.Set(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	SetClock(c)
+	defer SetClock(systemClock{})
+	Safety.Lock()
+	Safety.dryrun = true
+	Safety.Unlock()
+	defer func() {
+		Safety.Lock()
+		Safety.dryrun = false
+		Safety.Unlock()
+	}()
+	Blocks.Lock()
+	Blocks.s = BlockState{Active: map[int]*Block{}, Offences: map[int]*Offence{}}
+	Blocks.Unlock()
+
+	const node = 9001
+	for tier := 0; tier <= BLOCK_TIERS; tier++ {
+		block := BlockNode(node, node, ISSUER_DETECTOR, "test", nil)
+		if block == nil || block.Tier != tier {
+			t.Fatalf("offence %v: got %+v, want tier %v", tier+1, block, tier)
+		}
+		if BlockNode(node, node, ISSUER_DETECTOR, "test", nil) != nil {
+			t.Errorf("tier %v: blocked a node that is blocked already", tier)
+		}
+		if tier == BLOCK_TIERS {
+			if !block.Expires.IsZero() {
+				t.Errorf("last tier expires at %v, want permanent", block.Expires)
+			}
+			break
+		}
+		c.Advance(blockDuration(tier) - time.Second)
+		ExpireBlocks()
+		if !IsBlocked(node) {
+			t.Fatalf("tier %v: block lifted before it expired", tier)
+		}
+		c.Advance(2 * time.Second)
+		ExpireBlocks()
+		if IsBlocked(node) {
+			t.Fatalf("tier %v: block not lifted after it expired", tier)
+		}
+	}
+
+	// A permanent block never expires, and offences are forgotten after a while
+	c.Advance(BLOCK_FORGET + time.Hour)
+	ExpireBlocks()
+	if !IsBlocked(node) {
+		t.Fatal("permanent block was lifted")
+	}
+	Blocks.Lock()
+	delete(Blocks.s.Active, node)
+	Blocks.Unlock()
+	if block := BlockNode(node, node, ISSUER_DETECTOR, "test", nil); block == nil || block.Tier != 0 {
+		t.Errorf("after forgetting offences: got %+v, want tier 0", block)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Clock for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * The anomaly pipeline asks this clock for the current time, and sleeps on
+ * it, instead of calling time.Now() and time.Sleep() directly. Tests and
+ * replays of recorded traffic can replace it with a ManualClock, so their
+ * results are deterministic: sleepers wake up when the clock is advanced.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// Wall clock, the default
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// Clock that only moves when told so
+type ManualClock struct {
+	sync.Mutex
+	t       time.Time
+	waiters []manualWaiter
+}
+
+type manualWaiter struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+// Blocks until the clock is set or advanced to at least d from now
+func (c *ManualClock) Sleep(d time.Duration) {
+	c.Lock()
+	if d <= 0 {
+		c.Unlock()
+		return
+	}
+	w := manualWaiter{c.t.Add(d), make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	c.Unlock()
+	<-w.wake
+}
+
+// Returns the number of goroutines sleeping on the clock
+func (c *ManualClock) Sleepers() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.waiters)
+}
+
+func (c *ManualClock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = t
+	c.wake()
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+	c.wake()
+}
+
+// Requires lock on ManualClock
+// Wakes up the sleepers whose time has come
+func (c *ManualClock) wake() {
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.until.After(c.t) {
+			waiting = append(waiting, w)
+		} else {
+			close(w.wake)
+		}
+	}
+	c.waiters = waiting
+}
+
+var clock Clock = systemClock{}
+
+// Replaces the clock, should be called before any module is initialised
+func SetClock(c Clock) {
+	clock = c
+}
@@ -0,0 +1,102 @@
+/*
+ * Command handling for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Listens on the commands topic and dispatches every command to the module
+ * that registered it. Replies are published on the traffic topic, in the
+ * same format as SPIN uses: {"command": ..., "argument": ..., "result": ...}
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Incoming command, the argument is decoded by the handler
+type SPINrequest struct {
+	Command  string          `json:"command"`
+	Argument json.RawMessage `json:"argument"`
+}
+
+type CommandHandler func(argument json.RawMessage)
+
+var commandHandlers = struct {
+	sync.RWMutex
+	h map[string]CommandHandler
+}{h: map[string]CommandHandler{}}
+
+// Registers a handler for a command on the commands topic
+func RegisterCommand(command string, handler CommandHandler) {
+	commandHandlers.Lock()
+	defer commandHandlers.Unlock()
+	commandHandlers.h[command] = handler
+}
+
+func listenCommands() {
+	brokerchan, brokererr := BrokerSubscribe(TOPIC_COMMANDS)
+	if brokererr != nil {
+		fmt.Println("listenCommands: unable to subscribe to commands topic")
+		time.Sleep(1 * time.Second)
+		go listenCommands()
+		return
+	}
+	go func() {
+		for {
+			data, ok := <-brokerchan
+			if !ok {
+				break
+			}
+			var parsed SPINrequest
+			err := json.Unmarshal(data, &parsed)
+			if err != nil {
+				continue
+			}
+
+			commandHandlers.RLock()
+			handler, exists := commandHandlers.h[parsed.Command]
+			commandHandlers.RUnlock()
+			if exists {
+				handler(parsed.Argument)
+			}
+		}
+	}()
+}
+
+// Decodes an argument that holds a number, either as number or as string
+func argumentInt(argument json.RawMessage) (int, bool) {
+	var n int
+	if err := json.Unmarshal(argument, &n); err == nil {
+		return n, true
+	}
+	var s string
+	if err := json.Unmarshal(argument, &s); err == nil {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// Publishes the reply to a command, result may be nil if there is no information
+func publishResult(command string, argument string, result interface{}) {
+	results := make(map[string]interface{})
+	results["command"] = command
+	results["argument"] = argument
+	if result != nil {
+		results["result"] = result
+	}
+
+	bresults, err := json.Marshal(results)
+	if err != nil {
+		fmt.Println("Error while making JSON of", command, argument)
+		return
+	}
+	BrokerSend(bresults, TOPIC_TRAFFIC)
+}
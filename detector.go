@@ -0,0 +1,490 @@
+/*
+ * Detector framework for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Anomaly detectors implement the Detector interface, and at least one of
+ * the TrafficDetector (per-minute traffic of a device), FlowDetector
+ * (every flow event) or DNSDetector (every DNS query) interfaces.
+ * Detectors return verdicts, which are combined into a single decision per
+ * device. That decision goes through the shared report/block pipeline.
+ *
+ * Detectors are registered with RegisterDetector, and can be enabled,
+ * disabled and configured from a JSON file or over MQTT:
+ * {"peak": {"enabled": true, "config": {"maxincrease": 1.5}}}
+ * Settings that are left out keep their stored value, or the default of the
+ * detector, so a configuration alone does not disable a detector.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions, in order of severity
+const ACTION_NONE = "none"                 // Nothing to do
+const ACTION_REPORT = "report"             // Report only
+const ACTION_BLOCK_REMOTE = "block_remote" // Block the remote node
+const ACTION_BLOCK_DEVICE = "block_device" // Block the local device
+
+const DETECTOR_MIN_SCORE = 0.5 // Verdicts with a lower score are not acted upon
+
+type Verdict struct {
+	Detector string   `json:"detector"`           // Name of the detector
+	Deviceid int      `json:"deviceid"`           // SPIN identifier of the device
+	Score    float64  `json:"score"`              // 0 is normal, 1 is certainly anomalous
+	Reason   string   `json:"reason"`             // Human readable explanation
+	Action   string   `json:"action"`             // Suggested action
+	Remote   int      `json:"remote,omitempty"`   // Remote node, blocked for ACTION_BLOCK_REMOTE
+	Evidence []string `json:"evidence,omitempty"` // Offending names or addresses, if any
+}
+
+// Checks whether a verdict asks for an action, i.e. has enough score and an action
+func (v Verdict) Actionable() bool {
+	return v.Score >= DETECTOR_MIN_SCORE && v.Action != ACTION_NONE && v.Action != ""
+}
+
+type Detector interface {
+	Name() string                           // Unique name, used in configuration
+	Configure(config json.RawMessage) error // Apply (partial) configuration
+}
+
+// Detector that is called once a minute of traffic of a device is complete
+type TrafficDetector interface {
+	Detector
+	AnalyseTraffic(deviceid int, minute time.Time) []Verdict
+}
+
+// Detector that is called for every flow event
+type FlowDetector interface {
+	Detector
+	AnalyseFlow(event FlowEvent) []Verdict
+}
+
+// Detector that is called for every DNS query
+type DNSDetector interface {
+	Detector
+	AnalyseQuery(query SubDNS) []Verdict
+}
+
+// Detector that keeps state per device, which is merged when two devices are linked
+type DeviceMerger interface {
+	Detector
+	MergeDevice(from int, into int)
+}
+
+type FlowEvent struct {
+	SubFlow                  // Device, flow and traffic of this event
+	New     bool             // First traffic of this flow
+	Flow    Flow             // Copy of the flow, including this event
+	Mac     net.HardwareAddr // MAC address of the device, if known
+}
+
+type DetectorSettings struct {
+	Enabled *bool           `json:"enabled,omitempty"` // Unset means the default of the detector
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+// Settings s, with the fields that are set in o
+func (s DetectorSettings) overlay(o DetectorSettings) DetectorSettings {
+	if o.Enabled != nil {
+		s.Enabled = o.Enabled
+	}
+	if len(o.Config) > 0 {
+		s.Config = o.Config
+	}
+	return s
+}
+
+type Decision struct {
+	Action   string    // Resulting action
+	Score    float64   // Combined score
+	Remotes  []int     // Remote nodes to block, for ACTION_BLOCK_REMOTE
+	Verdicts []Verdict // Verdicts this decision is based on
+}
+
+// Verdict with the time it was handled
+type RecordedVerdict struct {
+	Verdict
+	Time time.Time `json:"time"`
+}
+
+var Detectors = struct {
+	sync.RWMutex
+	d        map[string]Detector
+	settings map[string]DetectorSettings
+	last     map[int]map[string]RecordedVerdict // Last verdict per device and detector
+}{d: map[string]Detector{}, settings: map[string]DetectorSettings{}, last: map[int]map[string]RecordedVerdict{}}
+
+// Initialise the detector framework. Settings in the file take precedence over stored ones.
+// Should be called before any detector is registered.
+func InitDetectors(oldstate *map[string]DetectorSettings, file string) {
+	Detectors.Lock()
+	if oldstate != nil {
+		for name, s := range *oldstate {
+			Detectors.settings[name] = s
+		}
+	}
+	if file != "" {
+		settings := map[string]DetectorSettings{}
+		bbuf, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(bbuf, &settings)
+		}
+		if err != nil {
+			fmt.Println("InitDetectors(): unable to load", file, ":", err)
+		}
+		for name, s := range settings {
+			Detectors.settings[name] = Detectors.settings[name].overlay(s)
+		}
+	}
+	Detectors.Unlock()
+
+	go dispatchFlows(SubscribeNewTraffic(), true)
+	go dispatchFlows(SubscribeExtraTraffic(), false)
+	go dispatchQueries(SubscribeResolve())
+	RegisterCommand("get_detectors", handleGetDetectors)
+	RegisterCommand("enable_detector", func(argument json.RawMessage) { handleEnableDetector(argument, true) })
+	RegisterCommand("disable_detector", func(argument json.RawMessage) { handleEnableDetector(argument, false) })
+	RegisterCommand("configure_detector", handleConfigureDetector)
+}
+
+// Registers a detector. Stored or configured settings are applied, if present.
+func RegisterDetector(d Detector, enabled bool) {
+	Detectors.Lock()
+	defer Detectors.Unlock()
+	Detectors.d[d.Name()] = d
+
+	s := Detectors.settings[d.Name()]
+	if s.Enabled == nil {
+		s.Enabled = &enabled
+		Detectors.settings[d.Name()] = s
+	}
+	if len(s.Config) > 0 {
+		if err := d.Configure(s.Config); err != nil {
+			fmt.Println("RegisterDetector(): invalid configuration of", d.Name(), ":", err)
+		}
+	}
+}
+
+// Merges the detector state and last verdicts of device from into device into
+func DetectorsMerge(from int, into int) {
+	Detectors.Lock()
+	if Detectors.last[into] == nil && Detectors.last[from] != nil {
+		Detectors.last[into] = map[string]RecordedVerdict{}
+	}
+	for name, v := range Detectors.last[from] {
+		if last, exists := Detectors.last[into][name]; !exists || v.Time.After(last.Time) {
+			v.Deviceid = into
+			Detectors.last[into][name] = v
+		}
+	}
+	delete(Detectors.last, from)
+	Detectors.Unlock()
+
+	Detectors.RLock()
+	defer Detectors.RUnlock()
+	for _, d := range Detectors.d {
+		if dm, ok := d.(DeviceMerger); ok {
+			dm.MergeDevice(from, into)
+		}
+	}
+}
+
+// Requires read lock on Detectors
+func detectorEnabled(name string) bool {
+	enabled := Detectors.settings[name].Enabled
+	return enabled != nil && *enabled
+}
+
+// Runs all enabled traffic detectors for a minute of traffic of a device
+func AnalyseTraffic(deviceid int, minute time.Time) {
+	verdicts := []Verdict{}
+	Detectors.RLock()
+	for name, d := range Detectors.d {
+		if td, ok := d.(TrafficDetector); ok && detectorEnabled(name) {
+			verdicts = append(verdicts, td.AnalyseTraffic(deviceid, minute)...)
+		}
+	}
+	Detectors.RUnlock()
+	handleVerdicts(deviceid, verdicts, true)
+}
+
+// Feeds flow events to all enabled flow detectors
+func dispatchFlows(ch chan SubFlow, isnew bool) {
+	for {
+		flowinfo, cont := <-ch
+		if !cont { // channel is closed
+			break
+		}
+		flow, mac, ok := HistoryGetFlow(flowinfo.Deviceid, flowinfo.Flowid)
+		if !ok {
+			continue
+		}
+		event := FlowEvent{SubFlow: flowinfo, New: isnew, Flow: flow, Mac: mac}
+
+		verdicts := []Verdict{}
+		Detectors.RLock()
+		for name, d := range Detectors.d {
+			if fd, ok := d.(FlowDetector); ok && detectorEnabled(name) {
+				verdicts = append(verdicts, fd.AnalyseFlow(event)...)
+			}
+		}
+		Detectors.RUnlock()
+		if len(verdicts) > 0 {
+			handleVerdicts(flowinfo.Deviceid, verdicts, false)
+		}
+	}
+}
+
+// Feeds DNS queries to all enabled DNS detectors
+func dispatchQueries(ch chan SubDNS) {
+	for {
+		query, cont := <-ch
+		if !cont { // channel is closed
+			break
+		}
+		verdicts := []Verdict{}
+		Detectors.RLock()
+		for name, d := range Detectors.d {
+			if dd, ok := d.(DNSDetector); ok && detectorEnabled(name) {
+				verdicts = append(verdicts, dd.AnalyseQuery(query)...)
+			}
+		}
+		Detectors.RUnlock()
+		if len(verdicts) > 0 {
+			handleVerdicts(query.Deviceid, verdicts, false)
+		}
+	}
+}
+
+// Severity of an action, used to pick the most severe one
+func actionSeverity(action string) int {
+	switch action {
+	case ACTION_REPORT:
+		return 1
+	case ACTION_BLOCK_REMOTE:
+		return 2
+	case ACTION_BLOCK_DEVICE:
+		return 3
+	}
+	return 0
+}
+
+// Combines the verdicts of all detectors into a single decision.
+// Only verdicts with at least DETECTOR_MIN_SCORE count, the most severe action wins.
+// The combined score is the probability that at least one detector is right.
+func combineVerdicts(verdicts []Verdict) Decision {
+	decision := Decision{Action: ACTION_NONE, Verdicts: verdicts}
+	normal := 1.0
+	for _, v := range verdicts {
+		if !v.Actionable() {
+			continue
+		}
+		normal *= 1 - v.Score
+		if actionSeverity(v.Action) > actionSeverity(decision.Action) {
+			decision.Action = v.Action
+		}
+		if v.Action == ACTION_BLOCK_REMOTE && v.Remote > 0 {
+			decision.Remotes = append(decision.Remotes, v.Remote)
+		}
+	}
+	decision.Score = 1 - normal
+	return decision
+}
+
+// Returns the names of the detectors, and the reasons of all verdicts with an action
+func describeVerdicts(verdicts []Verdict, actionable bool) (string, string) {
+	names := map[string]bool{}
+	reasons := []string{}
+	for _, v := range verdicts {
+		if v.Actionable() != actionable {
+			continue
+		}
+		names[strings.ToUpper(v.Detector)] = true
+		reason := v.Detector + ": " + v.Reason
+		if len(v.Evidence) > 0 {
+			reason += " (" + strings.Join(v.Evidence, ", ") + ")"
+		}
+		reasons = append(reasons, reason)
+	}
+	list := []string{}
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, "+"), strings.Join(reasons, "; ")
+}
+
+// The report/block pipeline: combines verdicts, and acts upon the decision
+// depending on the phase the device is in.
+func handleVerdicts(deviceid int, verdicts []Verdict, logokay bool) {
+	verdicts = applyPolicy(deviceid, verdicts)
+	recordLastVerdicts(deviceid, verdicts)
+	RecordVerdicts(deviceid, verdicts)
+	decision := combineVerdicts(verdicts)
+	label := DeviceLabel(deviceid)
+	if decision.Action == ACTION_NONE {
+		if logokay {
+			_, reasons := describeVerdicts(verdicts, false)
+			fmt.Println("AD: device", label, "all okay", reasons)
+		}
+		return
+	}
+
+	names, reasons := describeVerdicts(verdicts, true)
+	phase, duration := devicePhase(deviceid)
+	if phase != PHASE_MEASURING {
+		for _, v := range verdicts {
+			if v.Actionable() {
+				RaiseAlert(v)
+			}
+		}
+	}
+	switch {
+	case phase == PHASE_MEASURING: // Only measuring
+	case phase == PHASE_REPORTING && decision.Action == ACTION_BLOCK_REMOTE: // Ask the user
+		for _, remote := range decision.Remotes {
+			ProposeBlock(remote, deviceid, decision.Action, names, reasons, verdicts)
+		}
+	case phase == PHASE_REPORTING && decision.Action == ACTION_BLOCK_DEVICE:
+		ProposeBlock(deviceid, deviceid, decision.Action, names, reasons, verdicts)
+	case phase == PHASE_REPORTING || decision.Action == ACTION_REPORT: // Reporting, not blocking
+		fmt.Println("AD:", names, "device", label, "no action taken:", reasons,
+			"score", fmt.Sprintf("%.2f", decision.Score), duration)
+	case decision.Action == ACTION_BLOCK_REMOTE:
+		for _, remote := range decision.Remotes {
+			enforceBlock(remote, deviceid, fmt.Sprintf("remote node %v of device %v", remote, label),
+				ISSUER_DETECTOR, names, reasons, verdicts)
+		}
+	case decision.Action == ACTION_BLOCK_DEVICE: // Block bad traffic!
+		enforceBlock(deviceid, deviceid, fmt.Sprintf("device %v (score %.2f, %.0f minutes)", label,
+			decision.Score, duration), ISSUER_DETECTOR, names, reasons, verdicts)
+	}
+}
+
+// Blocks a node on behalf of a device, unless it is blocked already or a safety rail prevents it
+func enforceBlock(node int, deviceid int, what string, issuer string, names string, reasons string, verdicts []Verdict) {
+	if IsBlocked(node) {
+		return
+	}
+	if issuer == ISSUER_DETECTOR {
+		if ok, why := RiskAllowsBlock(deviceid); !ok {
+			fmt.Println("AD:", names, "not blocking", what, "(", why, "):", reasons)
+			return
+		}
+	}
+	if ok, why := AllowBlock(node, deviceid); !ok {
+		fmt.Println("AD:", names, "not blocking", what, "(", why, "):", reasons)
+		return
+	}
+	if block := BlockNode(node, deviceid, issuer, names+": "+reasons, verdicts); block != nil {
+		fmt.Println("AD: BLOCKED", what, block.Until(), "for", names, ":", reasons)
+	}
+}
+
+// Remembers the last verdict of every detector for a device
+func recordLastVerdicts(deviceid int, verdicts []Verdict) {
+	now := clock.Now()
+	Detectors.Lock()
+	defer Detectors.Unlock()
+	if Detectors.last[deviceid] == nil {
+		Detectors.last[deviceid] = map[string]RecordedVerdict{}
+	}
+	for _, v := range verdicts {
+		Detectors.last[deviceid][v.Detector] = RecordedVerdict{v, now}
+	}
+}
+
+// Returns the last verdict of every detector for a device
+func LastVerdicts(deviceid int) map[string]RecordedVerdict {
+	Detectors.RLock()
+	defer Detectors.RUnlock()
+	last := map[string]RecordedVerdict{}
+	for name, v := range Detectors.last[deviceid] {
+		last[name] = v
+	}
+	return last
+}
+
+// Returns a copy of the settings of all detectors, for persistence
+func DetectorState() map[string]DetectorSettings {
+	Detectors.RLock()
+	defer Detectors.RUnlock()
+	state := map[string]DetectorSettings{}
+	for name, s := range Detectors.settings {
+		state[name] = s
+	}
+	return state
+}
+
+// Handles the get_detectors command, replies with settings and configuration of all detectors
+func handleGetDetectors(argument json.RawMessage) {
+	Detectors.RLock()
+	result := map[string]DetectorSettings{}
+	for name, d := range Detectors.d {
+		config, _ := json.Marshal(d) // exported fields of a detector are its configuration
+		enabled := detectorEnabled(name)
+		result[name] = DetectorSettings{Enabled: &enabled, Config: config}
+	}
+	Detectors.RUnlock()
+	publishResult("detectors", "", result)
+}
+
+// Handles the enable_detector and disable_detector commands, argument is the name
+func handleEnableDetector(argument json.RawMessage, enabled bool) {
+	var name string
+	if err := json.Unmarshal(argument, &name); err != nil {
+		return
+	}
+	Detectors.Lock()
+	defer Detectors.Unlock()
+	s, exists := Detectors.settings[name]
+	if !exists {
+		return
+	}
+	s.Enabled = &enabled
+	Detectors.settings[name] = s
+	fmt.Println("AD: detector", name, "enabled:", enabled)
+}
+
+// Handles the configure_detector command, argument is {"name": ..., "config": {...}}
+func handleConfigureDetector(argument json.RawMessage) {
+	var arg struct {
+		Name   string          `json:"name"`
+		Config json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(argument, &arg); err != nil {
+		return
+	}
+	if err := ConfigureDetector(arg.Name, arg.Config); err != nil {
+		fmt.Println("AD: unable to configure detector", arg.Name, ":", err)
+	}
+}
+
+// Applies configuration to a detector, and stores it for later runs
+func ConfigureDetector(name string, config json.RawMessage) error {
+	Detectors.Lock()
+	defer Detectors.Unlock()
+	d, exists := Detectors.d[name]
+	if !exists {
+		return errors.New("no such detector")
+	}
+	if err := d.Configure(config); err != nil {
+		return err
+	}
+	s := Detectors.settings[name]
+	s.Config, _ = json.Marshal(d)
+	Detectors.settings[name] = s
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCombineVerdicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		verdicts []Verdict
+		action   string
+		score    float64
+		remotes  int
+	}{
+		{"no verdicts", nil, ACTION_NONE, 0, 0},
+		{"below minimum score", []Verdict{{Score: 0.4, Action: ACTION_BLOCK_DEVICE}}, ACTION_NONE, 0, 0},
+		{"no action", []Verdict{{Score: 1, Action: ACTION_NONE}}, ACTION_NONE, 0, 0},
+		{"single report", []Verdict{{Score: 0.5, Action: ACTION_REPORT}}, ACTION_REPORT, 0.5, 0},
+		{"most severe action wins", []Verdict{{Score: 0.5, Action: ACTION_BLOCK_DEVICE},
+			{Score: 0.5, Action: ACTION_REPORT}}, ACTION_BLOCK_DEVICE, 0.75, 0},
+		{"remotes are collected", []Verdict{{Score: 1, Action: ACTION_BLOCK_REMOTE, Remote: 7},
+			{Score: 0.6, Action: ACTION_BLOCK_REMOTE, Remote: 8}}, ACTION_BLOCK_REMOTE, 1, 2},
+		{"remote without node", []Verdict{{Score: 1, Action: ACTION_BLOCK_REMOTE}}, ACTION_BLOCK_REMOTE, 1, 0},
+	}
+	for _, tt := range tests {
+		d := combineVerdicts(tt.verdicts)
+		if d.Action != tt.action || math.Abs(d.Score-tt.score) > 1e-9 || len(d.Remotes) != tt.remotes {
+			t.Errorf("%v: got %v %.2f %v, want %v %.2f with %v remotes", tt.name, d.Action, d.Score, d.Remotes,
+				tt.action, tt.score, tt.remotes)
+		}
+	}
+}
+
+type testDetector struct {
+	Limit int `json:"limit"`
+}
+
+func (d *testDetector) Name() string { return "test" }
+
+func (d *testDetector) Configure(config json.RawMessage) error { return json.Unmarshal(config, d) }
+
+func (d *testDetector) AnalyseTraffic(deviceid int, minute time.Time) []Verdict { return nil }
+
+func TestRegisterDetectorSettings(t *testing.T) {
+	off := false
+	tests := []struct {
+		name     string
+		stored   *DetectorSettings
+		file     *DetectorSettings
+		fallback bool
+		enabled  bool
+		limit    int
+	}{
+		{"nothing configured", nil, nil, true, true, 0},
+		{"default disabled", nil, nil, false, false, 0},
+		{"config only", nil, &DetectorSettings{Config: json.RawMessage(`{"limit": 5}`)}, true, true, 5},
+		{"stored disabled, file config", &DetectorSettings{Enabled: &off},
+			&DetectorSettings{Config: json.RawMessage(`{"limit": 5}`)}, true, false, 5},
+	}
+	for _, tt := range tests {
+		Detectors.Lock()
+		delete(Detectors.settings, "test")
+		if tt.stored != nil {
+			Detectors.settings["test"] = *tt.stored
+		}
+		if tt.file != nil {
+			Detectors.settings["test"] = Detectors.settings["test"].overlay(*tt.file)
+		}
+		Detectors.Unlock()
+
+		d := &testDetector{}
+		RegisterDetector(d, tt.fallback)
+		Detectors.Lock()
+		enabled := detectorEnabled("test")
+		delete(Detectors.d, "test")
+		delete(Detectors.settings, "test")
+		Detectors.Unlock()
+		if enabled != tt.enabled || d.Limit != tt.limit {
+			t.Errorf("%v: enabled %v limit %v, want %v %v", tt.name, enabled, d.Limit, tt.enabled, tt.limit)
+		}
+	}
+}
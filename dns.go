@@ -0,0 +1,327 @@
+/*
+ * DNS anomaly detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Three detectors look at the DNS queries of every device:
+ * - dga: names that look randomly generated (domain generation algorithms),
+ *   scored on character entropy and the share of common English bigrams
+ * - tunnel: long names, or many distinct names under a single parent
+ *   domain, as used to carry data over DNS
+ * - dnsburst: a sudden burst of queries
+ * All of them count within a sliding window per device, and report the
+ * offending names as evidence. A device is reported once per window.
+ * Windows without queries for a whole window are dropped.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DNS_EVIDENCE = 5 // Maximum number of names in a verdict
+
+// The most common bigrams in English text
+const DNS_COMMON_BIGRAMS = "th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng se ha as ou io le ve co me de hi ri ro ic ne ea ra ce li ch ll be ma si om ur ca el ta la ns di fo ho pe ec pr no ct us ac ot il tr ly nc et ut ss so rs un lo wa ge ie wh ee wi em ad ol rt po we na ul ni ts mo ow pa im mi ai sh ir su id os iv ia am fi ci vi pl ig tu ev ld ry mp fe bl ab gh ty op wo sa ay ex ke fr oo av ag if ap gr od bo sp rd do uc bu ei ov by rm ep tt oc fa ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va um pp ua up lu go"
+
+var dnsBigrams = func() map[string]bool {
+	bigrams := map[string]bool{}
+	for _, b := range strings.Fields(DNS_COMMON_BIGRAMS) {
+		bigrams[b] = true
+	}
+	return bigrams
+}()
+
+// Names flagged by a DNS detector for a device, within the window
+type dnsWindow struct {
+	names   []string
+	times   []time.Time
+	flagged time.Time // Last verdict
+}
+
+// Requires lock on the detector
+// Drops entries older than the window, and adds a new one
+func (w *dnsWindow) add(name string, t time.Time, window time.Duration) {
+	first := 0
+	for first < len(w.times) && t.Sub(w.times[first]) > window {
+		first++
+	}
+	w.names, w.times = append(w.names[first:], name), append(w.times[first:], t)
+}
+
+// Requires lock on the detector
+// Checks whether the window holds nothing of interest anymore: no names and no verdict within the window
+func (w *dnsWindow) idle(now time.Time, window time.Duration) bool {
+	n := len(w.times)
+	return (n == 0 || now.Sub(w.times[n-1]) > window) && now.Sub(w.flagged) > window
+}
+
+// Requires lock on the detector
+// Returns up to DNS_EVIDENCE distinct names, most recent first
+func (w *dnsWindow) evidence() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for i := len(w.names) - 1; i >= 0 && len(names) < DNS_EVIDENCE; i-- {
+		if !seen[w.names[i]] {
+			seen[w.names[i]] = true
+			names = append(names, w.names[i])
+		}
+	}
+	return names
+}
+
+// Initialise the DNS detectors
+func InitDNS() {
+	RegisterDetector(&dgaDetector{Window: 600, MinLength: 10, MinEntropy: 3.2, MaxBigrams: 0.3, MinNames: 3,
+		Action: ACTION_REPORT, windows: map[int]*dnsWindow{}}, true)
+	RegisterDetector(&tunnelDetector{Window: 600, MaxLength: 60, MaxSubdomains: 100, Action: ACTION_REPORT,
+		windows: map[string]*dnsWindow{}, flagged: map[int]time.Time{}}, true)
+	RegisterDetector(&burstDetector{Window: 60, MaxQueries: 300, Action: ACTION_REPORT,
+		windows: map[int]*dnsWindow{}}, true)
+}
+
+// Returns the parent (registered) domain of a name, e.g. example.co.uk for www.example.co.uk
+func parentDomain(name string) string {
+	labels := strings.Split(normaliseDomain(name), ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 {
+		// Country code top-level domains with second-level registrations
+		switch labels[len(labels)-2] {
+		case "co", "com", "net", "org", "gov", "ac", "edu":
+			n = 3
+		}
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// Returns the Shannon entropy of a string, in bits per character
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+	h := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(len(s))
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// Returns the share of the bigrams of a string that are common in English
+func commonBigrams(s string) float64 {
+	if len(s) < 2 {
+		return 1
+	}
+	common := 0
+	for i := 0; i+2 <= len(s); i++ {
+		if dnsBigrams[s[i:i+2]] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(s)-1)
+}
+
+// Domain generation algorithm detector
+type dgaDetector struct {
+	Window     int     `json:"window"`     // Length of the sliding window, in seconds
+	MinLength  int     `json:"minlength"`  // Shorter labels are never suspicious
+	MinEntropy float64 `json:"minentropy"` // Suspicious above this entropy, in bits per character
+	MaxBigrams float64 `json:"maxbigrams"` // Suspicious below this share of common bigrams (0-1)
+	MinNames   int     `json:"minnames"`   // Suspicious names within the window before reporting
+	Action     string  `json:"action"`     // Action on generated names
+
+	sync.Mutex
+	windows map[int]*dnsWindow
+	expired time.Time // Last check for idle windows
+}
+
+func (d *dgaDetector) Name() string {
+	return "dga"
+}
+
+func (d *dgaDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	return json.Unmarshal(config, d)
+}
+
+// Returns the entropy and bigram share of the label below the public suffix, and whether it looks generated
+func (d *dgaDetector) score(name string) (float64, float64, bool) {
+	label := strings.SplitN(parentDomain(name), ".", 2)[0]
+	if len(label) < d.MinLength {
+		return 0, 1, false
+	}
+	h, b := entropy(label), commonBigrams(label)
+	return h, b, h >= d.MinEntropy && b <= d.MaxBigrams
+}
+
+func (d *dgaDetector) AnalyseQuery(query SubDNS) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+	window := time.Duration(d.Window) * time.Second
+	if query.Timestamp.Sub(d.expired) > window {
+		d.expired = query.Timestamp
+		for id, w := range d.windows {
+			if w.idle(query.Timestamp, window) {
+				delete(d.windows, id)
+			}
+		}
+	}
+	h, b, generated := d.score(query.Request)
+	if !generated {
+		return nil
+	}
+	w, exists := d.windows[query.Deviceid]
+	if !exists {
+		w = &dnsWindow{}
+		d.windows[query.Deviceid] = w
+	}
+	w.add(normaliseDomain(query.Request), query.Timestamp, window)
+	if len(w.names) < d.MinNames || query.Timestamp.Sub(w.flagged) < window {
+		return nil
+	}
+	w.flagged = query.Timestamp
+	return []Verdict{{Detector: d.Name(), Deviceid: query.Deviceid, Score: 1, Action: d.Action,
+		Reason: fmt.Sprintf("%v generated looking names in %v, last with entropy %.2f and %.0f%% common bigrams",
+			len(w.names), window, h, b*100), Evidence: w.evidence()}}
+}
+
+// DNS tunnelling detector
+type tunnelDetector struct {
+	Window        int    `json:"window"`        // Length of the sliding window, in seconds
+	MaxLength     int    `json:"maxlength"`     // Maximum length of the name below the parent domain
+	MaxSubdomains int    `json:"maxsubdomains"` // Maximum distinct names under a single parent domain within the window
+	Action        string `json:"action"`        // Action on tunnelling
+
+	sync.Mutex
+	windows map[string]*dnsWindow // Per device and parent domain
+	flagged map[int]time.Time     // Last verdict per device
+	expired time.Time             // Last check for idle windows
+}
+
+func (d *tunnelDetector) Name() string {
+	return "tunnel"
+}
+
+func (d *tunnelDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	return json.Unmarshal(config, d)
+}
+
+func (d *tunnelDetector) AnalyseQuery(query SubDNS) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+	window := time.Duration(d.Window) * time.Second
+	if query.Timestamp.Sub(d.expired) > window {
+		d.expired = query.Timestamp
+		for key, w := range d.windows {
+			if w.idle(query.Timestamp, window) {
+				delete(d.windows, key)
+			}
+		}
+		for id, t := range d.flagged {
+			if query.Timestamp.Sub(t) > window {
+				delete(d.flagged, id)
+			}
+		}
+	}
+	name := normaliseDomain(query.Request)
+	parent := parentDomain(name)
+	sub := strings.TrimSuffix(strings.TrimSuffix(name, parent), ".")
+
+	key := fmt.Sprintf("%v %v", query.Deviceid, parent)
+	w, exists := d.windows[key]
+	if !exists {
+		w = &dnsWindow{}
+		d.windows[key] = w
+	}
+	w.add(name, query.Timestamp, window)
+
+	reason := ""
+	switch {
+	case d.MaxLength > 0 && len(sub) > d.MaxLength:
+		reason = fmt.Sprintf("subdomain of %v characters under %v", len(sub), parent)
+	case d.MaxSubdomains > 0 && distinct(w.names) > d.MaxSubdomains:
+		reason = fmt.Sprintf("%v distinct names under %v in %v", distinct(w.names), parent, window)
+	}
+	if reason == "" || query.Timestamp.Sub(d.flagged[query.Deviceid]) < window {
+		return nil
+	}
+	d.flagged[query.Deviceid] = query.Timestamp
+	return []Verdict{{Detector: d.Name(), Deviceid: query.Deviceid, Score: 1, Action: d.Action,
+		Reason: reason, Evidence: w.evidence()}}
+}
+
+// Returns the number of distinct strings in a list
+func distinct(list []string) int {
+	sorted := append([]string{}, list...)
+	sort.Strings(sorted)
+	n := 0
+	for i := range sorted {
+		if i == 0 || sorted[i] != sorted[i-1] {
+			n++
+		}
+	}
+	return n
+}
+
+// DNS query burst detector
+type burstDetector struct {
+	Window     int    `json:"window"`     // Length of the sliding window, in seconds
+	MaxQueries int    `json:"maxqueries"` // Maximum queries of a device within the window
+	Action     string `json:"action"`     // Action on a burst
+
+	sync.Mutex
+	windows map[int]*dnsWindow
+	expired time.Time // Last check for idle windows
+}
+
+func (d *burstDetector) Name() string {
+	return "dnsburst"
+}
+
+func (d *burstDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	return json.Unmarshal(config, d)
+}
+
+func (d *burstDetector) AnalyseQuery(query SubDNS) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+	window := time.Duration(d.Window) * time.Second
+	if query.Timestamp.Sub(d.expired) > window {
+		d.expired = query.Timestamp
+		for id, w := range d.windows {
+			if w.idle(query.Timestamp, window) {
+				delete(d.windows, id)
+			}
+		}
+	}
+	w, exists := d.windows[query.Deviceid]
+	if !exists {
+		w = &dnsWindow{}
+		d.windows[query.Deviceid] = w
+	}
+	w.add(normaliseDomain(query.Request), query.Timestamp, window)
+	if d.MaxQueries <= 0 || len(w.names) <= d.MaxQueries || query.Timestamp.Sub(w.flagged) < window {
+		return nil
+	}
+	w.flagged = query.Timestamp
+	return []Verdict{{Detector: d.Name(), Deviceid: query.Deviceid, Score: 1, Action: d.Action,
+		Reason:   fmt.Sprintf("%v queries (%v distinct names) in %v", len(w.names), distinct(w.names), window),
+		Evidence: w.evidence()}}
+}
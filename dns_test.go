@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParentDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"www.Example.com.", "example.com"},
+		{"a.b.example.nl", "example.nl"},
+		{"www.example.co.uk", "example.co.uk"},
+		{"example.co.uk", "example.co.uk"},
+		{"localhost", "localhost"},
+	}
+	for _, tt := range tests {
+		if got := parentDomain(tt.name); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEntropyAndBigrams(t *testing.T) {
+	tests := []struct {
+		s       string
+		entropy float64
+		bigrams float64
+	}{
+		{"aaaa", 0, 0},
+		{"zxqv", 2, 0},
+		{"the", math.Log2(3), 1},
+		{"a", 0, 1},
+	}
+	for _, tt := range tests {
+		if got := entropy(tt.s); math.Abs(got-tt.entropy) > 1e-9 {
+			t.Errorf("entropy(%v) = %v, want %v", tt.s, got, tt.entropy)
+		}
+		if got := commonBigrams(tt.s); math.Abs(got-tt.bigrams) > 1e-9 {
+			t.Errorf("commonBigrams(%v) = %v, want %v", tt.s, got, tt.bigrams)
+		}
+	}
+}
+
+func TestDGAScore(t *testing.T) {
+	d := &dgaDetector{MinLength: 10, MinEntropy: 3.2, MaxBigrams: 0.3}
+	tests := []struct {
+		name      string
+		generated bool
+	}{
+		{"www.google.com", false},
+		{"cdn.internationalbusiness.com", false},
+		{"weatherforecast.example.nl", false},
+		{"xjw7qkz2vbp9ty.com", true},
+		{"www.qzvkxjwpfymb.net", true},
+		{"short.xkqz.com", false},
+	}
+	for _, tt := range tests {
+		h, b, generated := d.score(tt.name)
+		if generated != tt.generated {
+			t.Errorf("%v: entropy %.2f bigrams %.2f generated %v, want %v", tt.name, h, b, generated, tt.generated)
+		}
+	}
+}
+
+func TestTunnelDetector(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	newDetector := func() *tunnelDetector {
+		return &tunnelDetector{Window: 600, MaxLength: 60, MaxSubdomains: 10, Action: ACTION_REPORT,
+			windows: map[string]*dnsWindow{}, flagged: map[int]time.Time{}}
+	}
+	long := ""
+	for len(long) < 61 {
+		long += "a"
+	}
+	tests := []struct {
+		name     string
+		queries  []string
+		verdicts int
+	}{
+		{"normal", []string{"www.example.com", "mail.example.com", "www.example.com"}, 0},
+		{"long subdomain", []string{long + ".example.com"}, 1},
+		{"many subdomains", func() []string {
+			res := []string{}
+			for i := 0; i < 20; i++ {
+				res = append(res, fmt.Sprintf("c%v.t.example.com", i))
+			}
+			return res
+		}(), 1},
+	}
+	for _, tt := range tests {
+		d := newDetector()
+		verdicts := 0
+		for i, q := range tt.queries {
+			verdicts += len(d.AnalyseQuery(SubDNS{Deviceid: 9004, Request: q,
+				Timestamp: start.Add(time.Duration(i) * time.Second)}))
+		}
+		if verdicts != tt.verdicts {
+			t.Errorf("%v: %v verdicts, want %v", tt.name, verdicts, tt.verdicts)
+		}
+	}
+}
+
+func TestDNSWindowsExpire(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := &burstDetector{Window: 60, MaxQueries: 300, windows: map[int]*dnsWindow{}}
+	d.AnalyseQuery(SubDNS{Deviceid: 1, Request: "example.com", Timestamp: start})
+	d.AnalyseQuery(SubDNS{Deviceid: 2, Request: "example.com", Timestamp: start.Add(30 * time.Second)})
+	if len(d.windows) != 2 {
+		t.Fatalf("got %v windows, want 2", len(d.windows))
+	}
+	d.AnalyseQuery(SubDNS{Deviceid: 2, Request: "example.com", Timestamp: start.Add(100 * time.Second)})
+	if len(d.windows) != 1 || d.windows[2] == nil {
+		t.Errorf("got %v windows, want only device 2", len(d.windows))
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Device fingerprinting for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Classifies devices into a category (smart-tv, ip-camera, phone, ...) and
+ * probable vendor, based on a local signature file. A signature consists of
+ * domain patterns, remote ports and MAC prefixes (OUI). Every matching item
+ * adds to the score of a signature, the best signature wins.
+ * See signatures.json for an example.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FINGERPRINT_INTERVAL = 5 * time.Minute // Time between classification runs
+const FINGERPRINT_DOMAIN_WEIGHT = 3          // Score of a matching domain pattern
+const FINGERPRINT_PORT_WEIGHT = 1            // Score of a matching remote port
+const FINGERPRINT_OUI_WEIGHT = 2             // Score of a matching MAC prefix
+const FINGERPRINT_VOLUME_WEIGHT = 1          // Score of a matching rate or upload share
+const FINGERPRINT_MIN_MINUTES = 60           // Minutes of traffic before volume is compared
+const FINGERPRINT_PRIOR = 2                  // confidence = score / (score + prior)
+const FINGERPRINT_MIN_CONFIDENCE = 0.5       // Minimum confidence to classify a device
+
+type Signature struct {
+	Name     string    `json:"name"`     // Name of this signature
+	Category string    `json:"category"` // Device category, e.g. smart-tv
+	Vendor   string    `json:"vendor"`   // Probable vendor, may be empty
+	Domains  []string  `json:"domains"`  // Domain patterns, also match subdomains
+	Ports    []int     `json:"ports"`    // Remote ports
+	Oui      []string  `json:"oui"`      // MAC prefixes, e.g. 44:19:b6
+	MinRate  int       `json:"minrate"`  // Minimum average bytes per active minute, 0 is no minimum
+	MaxRate  int       `json:"maxrate"`  // Maximum average bytes per active minute, 0 is no maximum
+	Upload   []float64 `json:"upload"`   // Range (min, max) of the share of bytes sent, between 0 and 1
+}
+
+// Traffic volume of a device, over all stored minutes
+type trafficVolume struct {
+	Minutes int     // Minutes with traffic
+	Rate    float64 // Average bytes (sent and received) per minute with traffic
+	Upload  float64 // Share of bytes sent, between 0 and 1
+}
+
+type DeviceClass struct {
+	Category   string    `json:"category"`   // Device category, e.g. smart-tv
+	Vendor     string    `json:"vendor"`     // Probable vendor
+	Signature  string    `json:"signature"`  // Name of the matching signature
+	Confidence float64   `json:"confidence"` // Between 0 and 1
+	Updated    time.Time `json:"updated"`    // Time of classification
+}
+
+var Signatures = struct {
+	sync.RWMutex
+	file string
+	s    []Signature
+}{}
+
+// Initialise fingerprinting, file is the path to the signature file
+func InitFingerprint(file string) {
+	if file == "" {
+		return
+	}
+	Signatures.Lock()
+	Signatures.file = file
+	Signatures.Unlock()
+
+	ReloadSignatures()
+	RegisterCommand("reload_signatures", func(argument json.RawMessage) { ReloadSignatures() })
+	go func() {
+		for {
+			clock.Sleep(FINGERPRINT_INTERVAL)
+			ClassifyDevices()
+		}
+	}()
+}
+
+// (Re)loads the signature file and classifies all devices again
+func ReloadSignatures() {
+	Signatures.Lock()
+	if Signatures.file == "" {
+		Signatures.Unlock()
+		return
+	}
+	bbuf, err := ioutil.ReadFile(Signatures.file)
+	if err == nil {
+		sigs := []Signature{}
+		if err = json.Unmarshal(bbuf, &sigs); err == nil {
+			Signatures.s = sigs
+			fmt.Println("FP: loaded", len(sigs), "signatures from", Signatures.file)
+		}
+	}
+	if err != nil {
+		fmt.Println("FP: unable to load signatures from", Signatures.file, ":", err)
+	}
+	Signatures.Unlock()
+
+	ClassifyDevices()
+}
+
+// Classifies all devices, and stores the result in the History
+func ClassifyDevices() {
+	Signatures.RLock()
+	defer Signatures.RUnlock()
+	if len(Signatures.s) == 0 {
+		return
+	}
+
+	volumes := trafficVolumes()
+	History.Lock()
+	defer History.Unlock()
+	for deviceid, dev := range History.m.Devices {
+		class := classifyDevice(dev, volumes[deviceid])
+		if class == nil {
+			continue
+		}
+		if dev.Class == nil || dev.Class.Signature != class.Signature {
+			fmt.Println("FP: device", deviceLabel(dev), "classified as", class.Category, class.Vendor,
+				"confidence", fmt.Sprintf("%.2f", class.Confidence))
+		}
+		dev.Class = class
+		History.m.Devices[deviceid] = dev
+	}
+}
+
+// Returns the traffic volume of all devices
+func trafficVolumes() map[int]trafficVolume {
+	TrafficHistory.RLock()
+	defer TrafficHistory.RUnlock()
+	res := map[int]trafficVolume{}
+	for deviceid, node := range TrafficHistory.h {
+		sent, total := 0, 0
+		for _, dp := range node.Datapoints {
+			sent += dp.BytesSent
+			total += dp.BytesSent + dp.BytesReceived
+		}
+		v := trafficVolume{Minutes: len(node.Datapoints)}
+		if v.Minutes > 0 {
+			v.Rate = float64(total) / float64(v.Minutes)
+		}
+		if total > 0 {
+			v.Upload = float64(sent) / float64(total)
+		}
+		res[deviceid] = v
+	}
+	return res
+}
+
+// Returns the score of the traffic volume of a device for a signature
+func volumeScore(sig Signature, v trafficVolume) int {
+	if v.Minutes < FINGERPRINT_MIN_MINUTES {
+		return 0
+	}
+	score := 0
+	if (sig.MinRate > 0 || sig.MaxRate > 0) && v.Rate >= float64(sig.MinRate) &&
+		(sig.MaxRate == 0 || v.Rate <= float64(sig.MaxRate)) {
+		score += FINGERPRINT_VOLUME_WEIGHT
+	}
+	if len(sig.Upload) == 2 && v.Upload >= sig.Upload[0] && v.Upload <= sig.Upload[1] {
+		score += FINGERPRINT_VOLUME_WEIGHT
+	}
+	return score
+}
+
+// Requires read lock on Signatures
+// Returns best matching class, or nil if no signature is good enough
+func classifyDevice(dev Device, volume trafficVolume) *DeviceClass {
+	ports := map[int]bool{}
+	for _, flow := range dev.Flows {
+		ports[flow.RemotePort] = true
+	}
+	mac := ""
+	if dev.Mac != nil {
+		mac = dev.Mac.String()
+	}
+
+	var best *Signature
+	bestscore := 0
+	for i, sig := range Signatures.s {
+		score := 0
+		for _, pattern := range sig.Domains {
+			for domain := range dev.Resolved {
+				if domainMatches(domain, pattern) {
+					score += FINGERPRINT_DOMAIN_WEIGHT
+					break
+				}
+			}
+		}
+		for _, port := range sig.Ports {
+			if ports[port] {
+				score += FINGERPRINT_PORT_WEIGHT
+			}
+		}
+		for _, prefix := range sig.Oui {
+			if mac != "" && strings.HasPrefix(mac, strings.ToLower(prefix)) {
+				score += FINGERPRINT_OUI_WEIGHT
+				break
+			}
+		}
+		score += volumeScore(sig, volume)
+		if score > bestscore {
+			best, bestscore = &Signatures.s[i], score
+		}
+	}
+
+	confidence := float64(bestscore) / float64(bestscore+FINGERPRINT_PRIOR)
+	if best == nil || confidence < FINGERPRINT_MIN_CONFIDENCE {
+		return nil
+	}
+	vendor := best.Vendor
+	if vendor == "" {
+		vendor = dev.Manufacturer
+	}
+	return &DeviceClass{Category: best.Category, Vendor: vendor, Signature: best.Name,
+		Confidence: confidence, Updated: clock.Now()}
+}
+
+// Returns the category of a device, or an empty string if unknown
+func DeviceCategory(deviceid int) string {
+	History.RLock()
+	defer History.RUnlock()
+	dev, exists := History.m.Devices[deviceid]
+	if !exists || dev.Class == nil {
+		return ""
+	}
+	return dev.Class.Category
+}
+
+// Checks whether domain equals pattern or is a subdomain of it.
+// A leading "*." in the pattern is ignored.
+func domainMatches(domain string, pattern string) bool {
+	domain = normaliseDomain(domain)
+	pattern = normaliseDomain(strings.TrimPrefix(pattern, "*."))
+	return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassifyDevice(t *testing.T) {
+	Signatures.Lock()
+	Signatures.s = []Signature{
+		{Name: "camera", Category: "ip-camera", Domains: []string{"cam.example"}, Ports: []int{554},
+			Oui: []string{"44:19:b6"}, Upload: []float64{0.7, 1}},
+		{Name: "tv", Category: "smart-tv", Domains: []string{"tv.example"}, MinRate: 1000000,
+			Upload: []float64{0, 0.1}},
+	}
+	Signatures.Unlock()
+	defer func() {
+		Signatures.Lock()
+		Signatures.s = nil
+		Signatures.Unlock()
+	}()
+
+	camera, _ := net.ParseMAC("44:19:b6:00:00:01")
+	tests := []struct {
+		name       string
+		dev        Device
+		volume     trafficVolume
+		signature  string
+		confidence float64
+	}{
+		{"nothing matches", Device{}, trafficVolume{}, "", 0},
+		{"port only", Device{Flows: []Flow{{RemotePort: 554}}}, trafficVolume{}, "", 0},
+		{"domain", Device{Resolved: map[string][]net.IP{"api.cam.example": nil}}, trafficVolume{}, "camera", 0.6},
+		{"domain and oui", Device{Resolved: map[string][]net.IP{"cam.example": nil}, Mac: camera},
+			trafficVolume{}, "camera", 5.0 / 7},
+		{"volume only", Device{}, trafficVolume{Minutes: 120, Rate: 2000000, Upload: 0.05}, "tv", 0.5},
+		{"volume, too little history", Device{}, trafficVolume{Minutes: 10, Rate: 2000000, Upload: 0.05}, "", 0},
+	}
+	for _, tt := range tests {
+		Signatures.RLock()
+		class := classifyDevice(tt.dev, tt.volume)
+		Signatures.RUnlock()
+		if tt.signature == "" {
+			if class != nil {
+				t.Errorf("%v: got %v, want no class", tt.name, class.Signature)
+			}
+			continue
+		}
+		if class == nil || class.Signature != tt.signature || class.Confidence != tt.confidence {
+			t.Errorf("%v: got %+v, want %v with confidence %.2f", tt.name, class, tt.signature, tt.confidence)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+/*
+ * GeoIP and ASN enrichment for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Enriches remote endpoints with their country and autonomous system.
+ * Only local database files are used, no lookups over the network.
+ * Supported are MaxMind databases (.mmdb, e.g. GeoLite2-Country and
+ * GeoLite2-ASN) and CSV files with lines: network,country,asn,organisation
+ * e.g.: 192.0.2.0/24,NL,1140,SIDN
+ * Multiple files can be combined, the first file with an answer wins.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type GeoInfo struct {
+	Country string `json:"country,omitempty"` // ISO 3166 country code
+	ASN     uint   `json:"asn,omitempty"`     // Autonomous system number
+	ASOrg   string `json:"asorg,omitempty"`   // Organisation of the autonomous system
+}
+
+// A database that can answer geo lookups
+type geoDatabase interface {
+	lookup(ip net.IP) GeoInfo
+	close()
+}
+
+var GeoIP = struct {
+	sync.RWMutex
+	files []string      // Database files, in order of preference
+	dbs   []geoDatabase // Opened databases, same order as files
+}{}
+
+// Initialise GeoIP lookups, files is a comma separated list of database files
+func InitGeoIP(files string) {
+	GeoIP.Lock()
+	for _, fp := range strings.Split(files, ",") {
+		if fp = strings.TrimSpace(fp); fp != "" {
+			GeoIP.files = append(GeoIP.files, fp)
+		}
+	}
+	GeoIP.Unlock()
+
+	ReloadGeoIP()
+	RegisterCommand("reload_geoip", func(argument json.RawMessage) { ReloadGeoIP() })
+}
+
+// (Re)opens all database files, and updates the enrichment of known flows.
+// If a file cannot be opened, the old version of that file is kept.
+func ReloadGeoIP() {
+	GeoIP.Lock()
+	if len(GeoIP.files) == 0 {
+		GeoIP.Unlock()
+		return
+	}
+	if len(GeoIP.dbs) != len(GeoIP.files) {
+		GeoIP.dbs = make([]geoDatabase, len(GeoIP.files))
+	}
+	for i, fp := range GeoIP.files {
+		db, err := openGeoDatabase(fp)
+		if err != nil {
+			fmt.Println("GeoIP: unable to load", fp, ":", err)
+			continue
+		}
+		if GeoIP.dbs[i] != nil {
+			GeoIP.dbs[i].close()
+		}
+		GeoIP.dbs[i] = db
+		fmt.Println("GeoIP: loaded", fp)
+	}
+	GeoIP.Unlock()
+
+	HistoryEnrichFlows()
+}
+
+func openGeoDatabase(fp string) (geoDatabase, error) {
+	if strings.HasSuffix(strings.ToLower(fp), ".csv") {
+		return openGeoCSV(fp)
+	}
+	reader, err := maxminddb.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	return &geoMMDB{reader}, nil
+}
+
+// Looks up a single address. Returns nil if nothing is known about it.
+func GeoLookup(ip net.IP) *GeoInfo {
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return nil
+	}
+	GeoIP.RLock()
+	defer GeoIP.RUnlock()
+
+	info := GeoInfo{}
+	for _, db := range GeoIP.dbs {
+		if db == nil {
+			continue
+		}
+		res := db.lookup(ip)
+		if info.Country == "" {
+			info.Country = res.Country
+		}
+		if info.ASN == 0 {
+			info.ASN, info.ASOrg = res.ASN, res.ASOrg
+		}
+	}
+	if info.Country == "" && info.ASN == 0 {
+		return nil
+	}
+	return &info
+}
+
+// Looks up a list of addresses, the first address with a result is returned
+func GeoLookupAll(ips []net.IP) *GeoInfo {
+	for _, ip := range ips {
+		if info := GeoLookup(ip); info != nil {
+			return info
+		}
+	}
+	return nil
+}
+
+// Human readable representation, as used in alerts
+func (g *GeoInfo) String() string {
+	if g == nil {
+		return "unknown"
+	}
+	country := g.Country
+	if country == "" {
+		country = "??"
+	}
+	if g.ASN == 0 {
+		return country
+	}
+	return fmt.Sprintf("%v AS%v %v", country, g.ASN, g.ASOrg)
+}
+
+// MaxMind database
+
+type geoMMDB struct {
+	reader *maxminddb.Reader
+}
+
+// Fields of the GeoLite2/GeoIP2 Country, City and ASN databases
+type mmdbRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+func (db *geoMMDB) lookup(ip net.IP) GeoInfo {
+	var record mmdbRecord
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return GeoInfo{}
+	}
+	return GeoInfo{Country: record.Country.IsoCode, ASN: record.AutonomousSystemNumber,
+		ASOrg: record.AutonomousSystemOrganization}
+}
+
+func (db *geoMMDB) close() {
+	db.reader.Close()
+}
+
+// CSV database, stored as list of ranges sorted by first address. Networks
+// can be nested (e.g. a /24 of another country in a /16), the most specific
+// network containing an address is used.
+
+type geoRange struct {
+	first  net.IP // first address of range, 16 bytes
+	last   net.IP // last address of range, 16 bytes
+	info   GeoInfo
+	parent int // index of the smallest range containing this one, -1 if none
+}
+
+type geoCSV struct {
+	ranges []geoRange
+}
+
+func openGeoCSV(fp string) (geoDatabase, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	db := &geoCSV{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(record[0]))
+		if err != nil {
+			continue // header, or invalid line
+		}
+		info := GeoInfo{}
+		if len(record) > 1 {
+			info.Country = strings.ToUpper(strings.TrimSpace(record[1]))
+		}
+		if len(record) > 2 {
+			asn, _ := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(record[2]), "AS"), 10, 32)
+			info.ASN = uint(asn)
+		}
+		if len(record) > 3 {
+			info.ASOrg = strings.TrimSpace(record[3])
+		}
+		first, last := networkRange(ipnet)
+		db.ranges = append(db.ranges, geoRange{first, last, info, -1})
+	}
+	if len(db.ranges) == 0 {
+		return nil, errors.New("no networks found in file")
+	}
+	// Networks are either nested or disjoint, sorting the larger of networks with the
+	// same first address first puts every network right after the networks containing it
+	sort.Slice(db.ranges, func(i, j int) bool {
+		if c := bytes.Compare(db.ranges[i].first, db.ranges[j].first); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(db.ranges[i].last, db.ranges[j].last) > 0
+	})
+	enclosing := []int{}
+	for i := range db.ranges {
+		for len(enclosing) > 0 && bytes.Compare(db.ranges[enclosing[len(enclosing)-1]].last, db.ranges[i].first) < 0 {
+			enclosing = enclosing[:len(enclosing)-1]
+		}
+		if len(enclosing) > 0 {
+			db.ranges[i].parent = enclosing[len(enclosing)-1]
+		}
+		enclosing = append(enclosing, i)
+	}
+	return db, nil
+}
+
+// Returns the first and last address of a network, both as 16 byte addresses
+func networkRange(ipnet *net.IPNet) (net.IP, net.IP) {
+	first := ipnet.IP.To16()
+	mask := ipnet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	last := make(net.IP, net.IPv6len)
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+	return first, last
+}
+
+func (db *geoCSV) lookup(ip net.IP) GeoInfo {
+	ip = ip.To16()
+	// find the last range that starts at or before ip, every range containing
+	// ip contains that one, so the most specific one is its first parent containing ip
+	idx := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].first, ip) > 0
+	}) - 1
+	for idx >= 0 && bytes.Compare(ip, db.ranges[idx].last) > 0 {
+		idx = db.ranges[idx].parent
+	}
+	if idx >= 0 {
+		return db.ranges[idx].info
+	}
+	return GeoInfo{}
+}
+
+func (db *geoCSV) close() {}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoCSVLookup(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "geo.csv")
+	csv := "# network,country,asn,organisation\n" +
+		"network,country,asn,organisation\n" +
+		"192.0.2.0/24,nl,AS1140,SIDN\n" +
+		"198.51.100.0/25,de\n" +
+		"2001:db8::/32,NL,64496,Example\n" +
+		"203.0.113.64/26,be\n" +
+		"203.0.0.0/16,fr\n" +
+		"203.0.113.0/24,lu\n" +
+		"203.0.113.80/28,ch\n"
+	if err := os.WriteFile(fp, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openGeoCSV(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want GeoInfo
+	}{
+		{"192.0.2.1", GeoInfo{Country: "NL", ASN: 1140, ASOrg: "SIDN"}},
+		{"192.0.2.255", GeoInfo{Country: "NL", ASN: 1140, ASOrg: "SIDN"}},
+		{"192.0.3.0", GeoInfo{}},
+		{"198.51.100.127", GeoInfo{Country: "DE"}},
+		{"198.51.100.128", GeoInfo{}},
+		{"2001:db8:1::1", GeoInfo{Country: "NL", ASN: 64496, ASOrg: "Example"}},
+		{"10.0.0.1", GeoInfo{}},
+		{"203.0.1.1", GeoInfo{Country: "FR"}},
+		{"203.0.113.1", GeoInfo{Country: "LU"}},
+		{"203.0.113.65", GeoInfo{Country: "BE"}},
+		{"203.0.113.81", GeoInfo{Country: "CH"}},
+		{"203.0.113.100", GeoInfo{Country: "BE"}},
+		{"203.0.113.200", GeoInfo{Country: "LU"}},
+		{"203.0.200.1", GeoInfo{Country: "FR"}},
+	}
+	for _, tt := range tests {
+		if got := db.lookup(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGeoInfoString(t *testing.T) {
+	tests := []struct {
+		info *GeoInfo
+		want string
+	}{
+		{nil, "unknown"},
+		{&GeoInfo{Country: "NL"}, "NL"},
+		{&GeoInfo{ASN: 1140, ASOrg: "SIDN"}, "?? AS1140 SIDN"},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -11,6 +11,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"sync"
@@ -39,15 +40,33 @@ type Flow struct {
 	RemotePort      int       `json:"remoteport"`      // Port of remote server
 	FirstActivity   time.Time `json:"firstactivity"`   // First time that activity was logged
 	LastActivity    time.Time `json:"lastactivity"`    // Last activity of this flow
+	Geo             *GeoInfo  `json:"geo,omitempty"`   // Country and AS of the remote ip addresses, if known
 }
 
 type Device struct {
-	Mac       net.HardwareAddr    `json:"mac"`       // Mac address of this device.
-	SpinId    int                 `json:"spinid"`    // SPIN node identifier, used for quick verification of MAC. And internal references.
-	Lastseen  time.Time           `json:"lastseen"`  // Timestamp of last moment the device sent or received traffic
-	Flows     []Flow              `json:"flows"`     // An array of flows for this device
-	Resolved  map[string][]net.IP `json:"resolved"`  // Resolved domains for this device. The key is the DNS request (domain).
-	Addresses []net.IP            `json:"addresses"` // local addresses at which this device is known
+	Mac          net.HardwareAddr    `json:"mac"`                    // Mac address of this device.
+	SpinId       int                 `json:"spinid"`                 // SPIN node identifier, used for quick verification of MAC. And internal references.
+	Name         string              `json:"name,omitempty"`         // Name of this device, as provided by SPIN
+	Firstseen    time.Time           `json:"firstseen"`              // Timestamp of the moment the device was first seen
+	Lastseen     time.Time           `json:"lastseen"`               // Timestamp of last moment the device sent or received traffic
+	Flows        []Flow              `json:"flows"`                  // An array of flows for this device
+	Resolved     map[string][]net.IP `json:"resolved"`               // Resolved domains for this device. The key is the DNS request (domain).
+	Addresses    []net.IP            `json:"addresses"`              // local addresses at which this device is known
+	Class        *DeviceClass        `json:"class,omitempty"`        // Category and vendor of this device, if known
+	Manufacturer string              `json:"manufacturer,omitempty"` // Manufacturer of the network interface, from the OUI registry
+	RandomMac    bool                `json:"randommac,omitempty"`    // MAC address is locally administered, e.g. randomized
+}
+
+// Summary of a device, as used in device listings
+type DeviceInfo struct {
+	SpinId       int          `json:"spinid"`
+	Name         string       `json:"name,omitempty"`
+	Mac          string       `json:"mac,omitempty"`
+	Manufacturer string       `json:"manufacturer,omitempty"`
+	RandomMac    bool         `json:"randommac,omitempty"`
+	Class        *DeviceClass `json:"class,omitempty"`
+	Lastseen     time.Time    `json:"lastseen"`
+	Risk         *RiskScore   `json:"risk,omitempty"`
 }
 
 var subscribers = struct {
@@ -62,18 +81,20 @@ var subscribers = struct {
 	NewTraffic: []chan SubFlow{}}
 
 type SubDNS struct {
-	Deviceid int      // SPIN id for the device
-	Request  string   // DNS request, e.g.: example.nl
-	Reply    []net.IP // DNS reply, e.g.: 127.0.0.1
+	Deviceid  int       // SPIN id for the device
+	Request   string    // DNS request, e.g.: example.nl
+	Reply     []net.IP  // DNS reply, e.g.: 127.0.0.1
+	Timestamp time.Time // Time of the query, as reported by SPIN (UTC)
 }
 
 type SubFlow struct {
-	Deviceid        int // SPIN id for the device
-	Flowid          int // The Flow id with changes
-	BytesReceived   int // Number of bytes received by the local device
-	BytesSent       int // Number of bytes sent by the local device to the remote one
-	PacketsReceived int // Number of packets received
-	PacketsSent     int // Number of packets sent
+	Deviceid        int       // SPIN id for the device
+	Flowid          int       // The Flow id with changes
+	BytesReceived   int       // Number of bytes received by the local device
+	BytesSent       int       // Number of bytes sent by the local device to the remote one
+	PacketsReceived int       // Number of packets received
+	PacketsSent     int       // Number of packets sent
+	Timestamp       time.Time // Time of the traffic, as reported by SPIN (UTC)
 }
 
 // channel to which we listen for messages
@@ -106,6 +127,8 @@ func InitHistory(stored *HistoryDB) {
 		}
 	}()
 	History.initialised = true
+	RegisterCommand("get_device_flows", handleDeviceFlows)
+	RegisterCommand("get_devices", handleDevices)
 }
 
 // Adds a flow or dnsquery to the history file
@@ -145,6 +168,22 @@ func HistoryAdd(msg SPINdata) bool {
 			// Now, process flow
 			deviceid := local.Id
 			dev := getDevice(deviceid)
+			if dev.Mac == nil {
+				// MAC address is only known from traffic, so set it as soon as we see it
+				dev.Mac, _ = net.ParseMAC(local.Mac)
+				dev.Manufacturer, dev.RandomMac = OUILookup(dev.Mac), IsLocalMac(dev.Mac)
+			}
+			if local.Name != "" {
+				dev.Name = local.Name
+			}
+			if local.Lastseen > 0 {
+				dev.Lastseen = time.Unix(int64(local.Lastseen), 0)
+			}
+			localips := []net.IP{}
+			for _, v := range local.Ips {
+				localips = append(localips, net.ParseIP(v))
+			}
+			dev.Addresses = mergeIP(dev.Addresses, localips)
 
 			// Compute relevant variables from flow
 			ips := []net.IP{}
@@ -152,6 +191,11 @@ func HistoryAdd(msg SPINdata) bool {
 				ips = append(ips, net.ParseIP(v))
 			}
 
+			timestamp := clock.Now().UTC()
+			if msg.Result.Timestamp > 0 {
+				timestamp = time.Unix(int64(msg.Result.Timestamp), 0).UTC()
+			}
+
 			byReceived, bySent, packReceived, packSent := 0, 0, 0, 0
 			if local.Id == flow.From.Id {
 				byReceived, bySent, packReceived, packSent = 0, flow.Size, 0, flow.Count
@@ -165,10 +209,11 @@ func HistoryAdd(msg SPINdata) bool {
 				histflow = Flow{RemoteIps: ips, NodeId: remote.Id, RemotePort: remoteport, BytesReceived: byReceived,
 					BytesSent: bySent, PacketsReceived: packReceived, PacketsSent: packSent,
 					FirstActivity: time.Unix(int64(msg.Result.Timestamp), 0),
-					LastActivity:  time.Unix(int64(msg.Result.Timestamp), 0)}
+					LastActivity:  time.Unix(int64(msg.Result.Timestamp), 0),
+					Geo:           GeoLookupAll(ips)}
 				dev.Flows = append(dev.Flows, histflow)
 				idx, _ := findFlow(dev.Flows, remote.Id, remoteport) // Obtain index of newly added flow
-				go notifyNewTraffic(deviceid, idx, byReceived, bySent, packReceived, packSent)
+				go notifyNewTraffic(deviceid, idx, byReceived, bySent, packReceived, packSent, timestamp)
 			} else {
 				// update
 				histflow.RemoteIps = mergeIP(histflow.RemoteIps, ips)
@@ -177,8 +222,11 @@ func HistoryAdd(msg SPINdata) bool {
 				histflow.PacketsReceived += packReceived
 				histflow.PacketsSent += packSent
 				histflow.LastActivity = time.Unix(int64(msg.Result.Timestamp), 0)
+				if histflow.Geo == nil {
+					histflow.Geo = GeoLookupAll(histflow.RemoteIps)
+				}
 				dev.Flows[idx] = histflow
-				go notifyExtraTraffic(deviceid, idx, byReceived, bySent, packReceived, packSent)
+				go notifyExtraTraffic(deviceid, idx, byReceived, bySent, packReceived, packSent, timestamp)
 			}
 
 			// Store results
@@ -217,11 +265,11 @@ func HistoryAdd(msg SPINdata) bool {
 		dev.Resolved[msg.Result.Query] = dnsq
 
 		// merge set of node ips
-		rip = []net.IP{}
+		nip := []net.IP{}
 		for _, i := range msg.Result.From.Ips {
-			rip = append(rip, net.ParseIP(i))
+			nip = append(nip, net.ParseIP(i))
 		}
-		dev.Addresses = mergeIP(dev.Addresses, rip)
+		dev.Addresses = mergeIP(dev.Addresses, nip)
 
 		// and update the lastseen field
 		dev.Lastseen = time.Unix(int64(msg.Result.From.Lastseen), 0)
@@ -230,7 +278,11 @@ func HistoryAdd(msg SPINdata) bool {
 		// put results back to History
 		History.m.Devices[deviceid] = dev
 
-		go notifyResolve(deviceid, msg.Result.Query, rip)
+		timestamp := clock.Now().UTC()
+		if msg.Result.Timestamp > 0 {
+			timestamp = time.Unix(int64(msg.Result.Timestamp), 0).UTC()
+		}
+		go notifyResolve(deviceid, msg.Result.Query, rip, timestamp)
 
 		return true
 	}
@@ -243,7 +295,7 @@ func getDevice(deviceid int) Device {
 	dev, exists := History.m.Devices[deviceid]
 	// If not yet there, make an empty one
 	if !exists {
-		dev = Device{Mac: nil, SpinId: deviceid, Lastseen: time.Now(),
+		dev = Device{Mac: nil, SpinId: deviceid, Firstseen: clock.Now(), Lastseen: clock.Now(),
 			Flows: []Flow{}, Resolved: make(map[string][]net.IP),
 			Addresses: []net.IP{}}
 		go notifyNewDevice(deviceid) // notify interested parties
@@ -268,6 +320,34 @@ func mergeIP(ip1 []net.IP, ip2 []net.IP) []net.IP {
 	return ip1
 }
 
+// Checks whether ip is in the list of ip addresses
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, comp := range ips {
+		if comp.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the known addresses of a node: of the device, or of the remote node in any flow
+func HistoryNodeAddresses(node int) []net.IP {
+	History.RLock()
+	defer History.RUnlock()
+	if dev, exists := History.m.Devices[node]; exists {
+		return append([]net.IP{}, dev.Addresses...)
+	}
+	ips := []net.IP{}
+	for _, dev := range History.m.Devices {
+		for _, flow := range dev.Flows {
+			if flow.NodeId == node {
+				ips = mergeIP(ips, flow.RemoteIps)
+			}
+		}
+	}
+	return ips
+}
+
 // Subscribe to DNS resolve results
 func SubscribeResolve() chan SubDNS {
 	subscribers.Lock()
@@ -278,9 +358,9 @@ func SubscribeResolve() chan SubDNS {
 	return ch
 }
 
-func notifyResolve(deviceid int, request string, reply []net.IP) {
+func notifyResolve(deviceid int, request string, reply []net.IP, timestamp time.Time) {
 	// make new SubDNS
-	msg := SubDNS{Deviceid: deviceid, Request: request, Reply: reply}
+	msg := SubDNS{Deviceid: deviceid, Request: request, Reply: reply, Timestamp: timestamp}
 
 	subscribers.RLock()
 	defer subscribers.RUnlock()
@@ -317,14 +397,14 @@ func SubscribeNewTraffic() chan SubFlow {
 	return ch
 }
 
-func notifyNewTraffic(deviceid int, flowid int, byRecv int, bySent int, paRecv int, paSent int) {
+func notifyNewTraffic(deviceid int, flowid int, byRecv int, bySent int, paRecv int, paSent int, timestamp time.Time) {
 	subscribers.RLock()
 	defer subscribers.RUnlock()
 
 	for _, ch := range subscribers.NewTraffic {
 		// We make a new flow for every subscriber, so that they will not bother eachother
 		msg := SubFlow{Deviceid: deviceid, Flowid: flowid, BytesReceived: byRecv, BytesSent: bySent,
-			PacketsReceived: paRecv, PacketsSent: paSent}
+			PacketsReceived: paRecv, PacketsSent: paSent, Timestamp: timestamp}
 		ch <- msg
 	}
 }
@@ -339,13 +419,13 @@ func SubscribeExtraTraffic() chan SubFlow {
 	return ch
 }
 
-func notifyExtraTraffic(deviceid int, flowid int, byRecv int, bySent int, paRecv int, paSent int) {
+func notifyExtraTraffic(deviceid int, flowid int, byRecv int, bySent int, paRecv int, paSent int, timestamp time.Time) {
 	subscribers.RLock()
 	defer subscribers.RUnlock()
 
 	for _, ch := range subscribers.ExtraTraffic {
 		msg := SubFlow{Deviceid: deviceid, Flowid: flowid, BytesReceived: byRecv, BytesSent: bySent,
-			PacketsReceived: paRecv, PacketsSent: paSent}
+			PacketsReceived: paRecv, PacketsSent: paSent, Timestamp: timestamp}
 		ch <- msg
 	}
 }
@@ -356,6 +436,7 @@ func notifyExtraTraffic(deviceid int, flowid int, byRecv int, bySent int, paRecv
 func flowdup(flow Flow) Flow {
 	tmp := flow // now tmp contains copy-by-ref slice
 	// manually copy slice into tmp
+	tmp.RemoteIps = make([]net.IP, len(flow.RemoteIps))
 	copy(tmp.RemoteIps, flow.RemoteIps)
 	return tmp
 }
@@ -372,6 +453,169 @@ func findFlow(flows []Flow, id int, port int) (int, Flow) {
 	return -1, Flow{}
 }
 
+// Returns a copy of a flow of a device, and the MAC address of that device
+// The flowid is the index as provided to subscribers (SubFlow.Flowid)
+func HistoryGetFlow(deviceid int, flowid int) (Flow, net.HardwareAddr, bool) {
+	History.RLock()
+	defer History.RUnlock()
+	dev, exists := History.m.Devices[deviceid]
+	if !exists || flowid < 0 || flowid >= len(dev.Flows) {
+		return Flow{}, nil, false
+	}
+	return flowdup(dev.Flows[flowid]), dev.Mac, true
+}
+
+// Looks up the geo information of all flows again, e.g. after a database reload
+func HistoryEnrichFlows() {
+	History.Lock()
+	defer History.Unlock()
+	for deviceid, dev := range History.m.Devices {
+		for idx := range dev.Flows {
+			dev.Flows[idx].Geo = GeoLookupAll(dev.Flows[idx].RemoteIps)
+		}
+		History.m.Devices[deviceid] = dev
+	}
+}
+
+// Handles the get_device_flows command, replies with all flows of a device
+func handleDeviceFlows(argument json.RawMessage) {
+	deviceid, ok := argumentInt(argument)
+	if !ok || deviceid <= 0 {
+		return
+	}
+	History.RLock()
+	dev, exists := History.m.Devices[deviceid]
+	flows := []Flow{}
+	if exists {
+		for _, flow := range dev.Flows {
+			flows = append(flows, flowdup(flow))
+		}
+	}
+	History.RUnlock()
+
+	if !exists {
+		publishResult("deviceflows", fmt.Sprintf("%v", deviceid), nil)
+		return
+	}
+	publishResult("deviceflows", fmt.Sprintf("%v", deviceid), flows)
+}
+
+// Looks up the manufacturer of all devices again, e.g. after a registry reload
+func HistoryResolveManufacturers() {
+	History.Lock()
+	defer History.Unlock()
+	for deviceid, dev := range History.m.Devices {
+		dev.Manufacturer, dev.RandomMac = OUILookup(dev.Mac), IsLocalMac(dev.Mac)
+		History.m.Devices[deviceid] = dev
+	}
+}
+
+// Requires read lock on History
+func deviceInfo(dev Device) DeviceInfo {
+	info := DeviceInfo{SpinId: dev.SpinId, Name: dev.Name, Manufacturer: dev.Manufacturer, RandomMac: dev.RandomMac,
+		Class: dev.Class, Lastseen: dev.Lastseen}
+	if dev.Mac != nil {
+		info.Mac = dev.Mac.String()
+	}
+	return info
+}
+
+// Returns a summary of all devices
+func HistoryDeviceInfo() []DeviceInfo {
+	History.RLock()
+	defer History.RUnlock()
+	devices := []DeviceInfo{}
+	for _, dev := range History.m.Devices {
+		devices = append(devices, deviceInfo(dev))
+	}
+	return devices
+}
+
+// Handles the get_devices command, replies with a summary of all devices
+func handleDevices(argument json.RawMessage) {
+	devices := HistoryDeviceInfo()
+	for i := range devices {
+		devices[i].Risk = DeviceRisk(devices[i].SpinId)
+	}
+	publishResult("devices", "", devices)
+}
+
+// Returns a human readable description of a device, as used in log lines and alerts.
+// E.g.: 12 (Apple, Inc. aa:bb:cc:dd:ee:ff)
+func DeviceLabel(deviceid int) string {
+	History.RLock()
+	defer History.RUnlock()
+	dev, exists := History.m.Devices[deviceid]
+	if !exists {
+		return fmt.Sprintf("%v", deviceid)
+	}
+	return deviceLabel(dev)
+}
+
+// Requires read lock on History
+func deviceLabel(dev Device) string {
+	if dev.Mac == nil {
+		return fmt.Sprintf("%v", dev.SpinId)
+	}
+	manufacturer := dev.Manufacturer
+	if dev.RandomMac {
+		manufacturer = "randomized MAC"
+	}
+	if manufacturer == "" {
+		return fmt.Sprintf("%v (%v)", dev.SpinId, dev.Mac)
+	}
+	return fmt.Sprintf("%v (%v %v)", dev.SpinId, manufacturer, dev.Mac)
+}
+
+// Merges all history of device from into device into, and removes device from.
+// Flows to the same remote node and port are combined.
+func HistoryMergeDevices(from int, into int) bool {
+	History.Lock()
+	defer History.Unlock()
+	src, exists := History.m.Devices[from]
+	if !exists {
+		return false
+	}
+	dst, exists := History.m.Devices[into]
+	if !exists {
+		return false
+	}
+
+	for _, flow := range src.Flows {
+		idx, histflow := findFlow(dst.Flows, flow.NodeId, flow.RemotePort)
+		if idx < 0 {
+			dst.Flows = append(dst.Flows, flowdup(flow))
+			continue
+		}
+		histflow.RemoteIps = mergeIP(histflow.RemoteIps, flow.RemoteIps)
+		histflow.BytesReceived += flow.BytesReceived
+		histflow.BytesSent += flow.BytesSent
+		histflow.PacketsReceived += flow.PacketsReceived
+		histflow.PacketsSent += flow.PacketsSent
+		if flow.FirstActivity.Before(histflow.FirstActivity) {
+			histflow.FirstActivity = flow.FirstActivity
+		}
+		if flow.LastActivity.After(histflow.LastActivity) {
+			histflow.LastActivity = flow.LastActivity
+		}
+		dst.Flows[idx] = histflow
+	}
+	for domain, ips := range src.Resolved {
+		dst.Resolved[domain] = mergeIP(dst.Resolved[domain], ips)
+	}
+	dst.Addresses = mergeIP(dst.Addresses, src.Addresses)
+	if !src.Firstseen.IsZero() && src.Firstseen.Before(dst.Firstseen) {
+		dst.Firstseen = src.Firstseen
+	}
+	if dst.Name == "" {
+		dst.Name = src.Name
+	}
+
+	History.m.Devices[into] = dst
+	delete(History.m.Devices, from)
+	return true
+}
+
 // Returns a list of all devices
 func HistoryListDevices() []int {
 	History.RLock()
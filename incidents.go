@@ -0,0 +1,281 @@
+/*
+ * Incident correlation for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Alerts that belong together are correlated into incidents. An alert joins
+ * an incident that was active within INCIDENT_WINDOW and shares one of its
+ * indicators: the device, the remote node or an item of evidence (domain
+ * or address). This groups one device tripping several detectors, as well
+ * as many devices contacting the same remote at once (botnet-style).
+ * The severity of an incident is the highest severity of its alerts, and
+ * critical when INCIDENT_MANY_DEVICES or more devices are involved.
+ * Incidents are open, acknowledged or resolved. Incidents without new
+ * alerts for INCIDENT_RESOLVE are resolved automatically. Incidents older
+ * than INCIDENT_MAX_AGE take no new alerts, so a device that keeps alerting
+ * starts a new incident every INCIDENT_MAX_AGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const INCIDENT_WINDOW = 15 * time.Minute // Alerts within this time of an incident may join it
+const INCIDENT_RESOLVE = 24 * time.Hour  // Incidents without alerts for this long are resolved
+const INCIDENT_MAX_AGE = 24 * time.Hour  // Incidents older than this take no new alerts
+const INCIDENT_MANY_DEVICES = 3          // Incidents with this many devices are critical
+const INCIDENT_MAX_TIMELINE = 100        // Maximum number of events in the timeline of an incident
+
+const INCIDENT_OPEN = "open"
+const INCIDENT_ACKNOWLEDGED = "acknowledged"
+const INCIDENT_RESOLVED = "resolved"
+
+type IncidentEvent struct {
+	Time     time.Time `json:"time"`
+	Alert    int       `json:"alert"` // Id of the alert
+	Device   int       `json:"device"`
+	Detector string    `json:"detector"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+type Incident struct {
+	Id         int             `json:"id"`
+	State      string          `json:"state"`    // open, acknowledged or resolved
+	Severity   string          `json:"severity"` // Combined severity
+	Devices    []int           `json:"devices"`
+	Detectors  []string        `json:"detectors"`
+	Indicators []string        `json:"indicators"` // Shared remotes, domains and addresses
+	Alerts     []int           `json:"alerts"`
+	Timeline   []IncidentEvent `json:"timeline"`
+	Created    time.Time       `json:"created"`
+	Updated    time.Time       `json:"updated"` // Time of the last alert
+	Resolved   time.Time       `json:"resolved"`
+}
+
+type IncidentState struct {
+	Incidents map[int]*Incident `json:"incidents"`
+	NextId    int               `json:"nextid"`
+}
+
+var Incidents = struct {
+	sync.RWMutex
+	s IncidentState
+}{s: IncidentState{Incidents: map[int]*Incident{}, NextId: 1}}
+
+// Initialise incident correlation, with previously stored incidents
+func InitIncidents(oldstate *IncidentState) {
+	Incidents.Lock()
+	if oldstate != nil && oldstate.Incidents != nil {
+		Incidents.s = *oldstate
+	}
+	Incidents.Unlock()
+
+	RegisterCommand("get_incidents", handleGetIncidents)
+	RegisterCommand("ack_incident", func(argument json.RawMessage) { handleIncidentState(argument, INCIDENT_ACKNOWLEDGED) })
+	RegisterCommand("resolve_incident", func(argument json.RawMessage) { handleIncidentState(argument, INCIDENT_RESOLVED) })
+}
+
+// Indicators of an alert and the verdict that raised it
+func alertIndicators(alert Alert, v Verdict) []string {
+	indicators := []string{fmt.Sprintf("device %v", alert.Device)}
+	if v.Remote > 0 {
+		indicators = append(indicators, fmt.Sprintf("node %v", v.Remote))
+	}
+	return append(indicators, v.Evidence...)
+}
+
+// Adds an alert to the incident it correlates with, or to a new incident
+func CorrelateAlert(alert Alert, v Verdict) {
+	now := alert.Lastseen
+	indicators := alertIndicators(alert, v)
+
+	Incidents.Lock()
+	resolveIncidents(now)
+	matches := []*Incident{}
+	for _, inc := range Incidents.s.Incidents {
+		if inc.State == INCIDENT_RESOLVED || now.Sub(inc.Updated) > INCIDENT_WINDOW ||
+			now.Sub(inc.Created) > INCIDENT_MAX_AGE {
+			continue
+		}
+		for _, i := range indicators {
+			if containsString(inc.Indicators, i) {
+				matches = append(matches, inc)
+				break
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Id < matches[j].Id })
+
+	var inc *Incident
+	if len(matches) == 0 {
+		inc = &Incident{Id: Incidents.s.NextId, State: INCIDENT_OPEN, Created: now}
+		Incidents.s.NextId++
+		Incidents.s.Incidents[inc.Id] = inc
+	} else {
+		// Join the oldest incident, and merge the others into it
+		inc = matches[0]
+		for _, other := range matches[1:] {
+			mergeIncident(inc, other)
+			delete(Incidents.s.Incidents, other.Id)
+		}
+	}
+	before := fmt.Sprintf("%v %v %v", inc.Severity, len(inc.Devices), len(inc.Detectors))
+
+	for _, i := range indicators {
+		if !containsString(inc.Indicators, i) {
+			inc.Indicators = append(inc.Indicators, i)
+		}
+	}
+	if !containsInt(inc.Alerts, alert.Id) {
+		inc.Alerts = append(inc.Alerts, alert.Id)
+	}
+	if !containsInt(inc.Devices, alert.Device) {
+		inc.Devices = append(inc.Devices, alert.Device)
+	}
+	if !containsString(inc.Detectors, alert.Detector) {
+		inc.Detectors = append(inc.Detectors, alert.Detector)
+	}
+	inc.Timeline = append(inc.Timeline, IncidentEvent{Time: now, Alert: alert.Id, Device: alert.Device,
+		Detector: alert.Detector, Severity: verdictSeverity(v), Message: v.Reason})
+	if len(inc.Timeline) > INCIDENT_MAX_TIMELINE {
+		inc.Timeline = inc.Timeline[len(inc.Timeline)-INCIDENT_MAX_TIMELINE:]
+	}
+	inc.Updated = now
+	updateSeverity(inc, verdictSeverity(v))
+
+	changed := len(matches) != 1 || fmt.Sprintf("%v %v %v", inc.Severity, len(inc.Devices), len(inc.Detectors)) != before
+	res := inc.copy()
+	Incidents.Unlock()
+
+	if changed {
+		fmt.Println("IN: incident", res.Id, res.Severity, "with", len(res.Devices), "devices and detectors", res.Detectors)
+		publishResult("incident", fmt.Sprintf("%v", res.Id), res)
+	}
+}
+
+func (inc *Incident) copy() Incident {
+	c := *inc
+	c.Devices = append([]int(nil), inc.Devices...)
+	c.Detectors = append([]string(nil), inc.Detectors...)
+	c.Indicators = append([]string(nil), inc.Indicators...)
+	c.Alerts = append([]int(nil), inc.Alerts...)
+	c.Timeline = append([]IncidentEvent(nil), inc.Timeline...)
+	return c
+}
+
+// Requires lock on Incidents
+// Merges incident other into inc
+func mergeIncident(inc *Incident, other *Incident) {
+	for _, i := range other.Indicators {
+		if !containsString(inc.Indicators, i) {
+			inc.Indicators = append(inc.Indicators, i)
+		}
+	}
+	for _, a := range other.Alerts {
+		if !containsInt(inc.Alerts, a) {
+			inc.Alerts = append(inc.Alerts, a)
+		}
+	}
+	for _, d := range other.Devices {
+		if !containsInt(inc.Devices, d) {
+			inc.Devices = append(inc.Devices, d)
+		}
+	}
+	for _, d := range other.Detectors {
+		if !containsString(inc.Detectors, d) {
+			inc.Detectors = append(inc.Detectors, d)
+		}
+	}
+	inc.Timeline = append(inc.Timeline, other.Timeline...)
+	sort.Slice(inc.Timeline, func(i, j int) bool { return inc.Timeline[i].Time.Before(inc.Timeline[j].Time) })
+	updateSeverity(inc, other.Severity)
+}
+
+// Requires lock on Incidents
+// Raises the severity of an incident to at least severity, or critical if many devices are involved
+func updateSeverity(inc *Incident, severity string) {
+	if alertSeverityLevel(severity) > alertSeverityLevel(inc.Severity) {
+		inc.Severity = severity
+	}
+	if len(inc.Devices) >= INCIDENT_MANY_DEVICES {
+		inc.Severity = SEVERITY_CRITICAL
+	}
+}
+
+// Requires lock on Incidents
+// Resolves incidents without recent alerts, and removes resolved incidents beyond retention
+func resolveIncidents(now time.Time) {
+	for id, inc := range Incidents.s.Incidents {
+		if inc.State != INCIDENT_RESOLVED && now.Sub(inc.Updated) > INCIDENT_RESOLVE {
+			inc.State, inc.Resolved = INCIDENT_RESOLVED, now
+		}
+		if inc.State == INCIDENT_RESOLVED && now.Sub(inc.Resolved) > ALERT_RETENTION {
+			delete(Incidents.s.Incidents, id)
+		}
+	}
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of all incidents, for persistence
+func IncidentsState() IncidentState {
+	Incidents.RLock()
+	defer Incidents.RUnlock()
+	state := IncidentState{Incidents: map[int]*Incident{}, NextId: Incidents.s.NextId}
+	for id, inc := range Incidents.s.Incidents {
+		incident := inc.copy()
+		state.Incidents[id] = &incident
+	}
+	return state
+}
+
+// Handles the get_incidents command, replies with all incidents that are not resolved, newest first
+func handleGetIncidents(argument json.RawMessage) {
+	Incidents.Lock()
+	resolveIncidents(clock.Now())
+	incidents := []Incident{}
+	for _, inc := range Incidents.s.Incidents {
+		if inc.State != INCIDENT_RESOLVED {
+			incidents = append(incidents, inc.copy())
+		}
+	}
+	Incidents.Unlock()
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].Updated.After(incidents[j].Updated) })
+	publishResult("incidents", "", incidents)
+}
+
+// Handles the ack_incident and resolve_incident commands, argument is the id of the incident
+func handleIncidentState(argument json.RawMessage, state string) {
+	id, ok := argumentInt(argument)
+	if !ok {
+		return
+	}
+	Incidents.Lock()
+	inc, exists := Incidents.s.Incidents[id]
+	if !exists || inc.State == INCIDENT_RESOLVED {
+		Incidents.Unlock()
+		return
+	}
+	inc.State = state
+	if state == INCIDENT_RESOLVED {
+		inc.Resolved = clock.Now()
+	}
+	res := inc.copy()
+	Incidents.Unlock()
+	publishResult("incident", fmt.Sprintf("%v", id), res)
+}
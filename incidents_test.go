@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCorrelateAlert(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &ManualClock{}
+	c.Set(start)
+	SetClock(c)
+	defer SetClock(systemClock{})
+	resetAlerts()
+	defer resetAlerts()
+
+	steps := []struct {
+		name     string
+		at       time.Duration // since the start of the test
+		alert    int
+		verdict  Verdict
+		incident int // incident the alert ends up in
+		devices  int // number of devices in that incident
+		severity string
+	}{
+		{"first alert", 0, 1, Verdict{Detector: "dga", Deviceid: 9001, Action: ACTION_REPORT},
+			1, 1, SEVERITY_WARNING},
+		{"same device, other detector", time.Minute, 2, Verdict{Detector: "scan", Deviceid: 9001,
+			Action: ACTION_BLOCK_DEVICE}, 1, 1, SEVERITY_CRITICAL},
+		{"unrelated device", 2 * time.Minute, 3, Verdict{Detector: "dga", Deviceid: 9002, Action: ACTION_REPORT},
+			2, 1, SEVERITY_WARNING},
+		{"shared remote", 3 * time.Minute, 4, Verdict{Detector: "beacon", Deviceid: 9003, Remote: 42,
+			Action: ACTION_REPORT}, 3, 1, SEVERITY_WARNING},
+		{"shared evidence joins and merges", 4 * time.Minute, 5, Verdict{Detector: "dga", Deviceid: 9002,
+			Remote: 42, Action: ACTION_REPORT}, 2, 2, SEVERITY_WARNING},
+		{"many devices", 5 * time.Minute, 6, Verdict{Detector: "beacon", Deviceid: 9004, Remote: 42,
+			Action: ACTION_REPORT}, 2, 3, SEVERITY_CRITICAL},
+		{"after the window", 5*time.Minute + INCIDENT_WINDOW + time.Minute, 7, Verdict{Detector: "dga",
+			Deviceid: 9001, Action: ACTION_REPORT}, 4, 1, SEVERITY_WARNING},
+	}
+	for _, s := range steps {
+		c.Set(start.Add(s.at))
+		CorrelateAlert(Alert{Id: s.alert, Device: s.verdict.Deviceid, Detector: s.verdict.Detector, Lastseen: c.Now()},
+			s.verdict)
+		Incidents.RLock()
+		inc, exists := Incidents.s.Incidents[s.incident]
+		var got Incident
+		if exists {
+			got = inc.copy()
+		}
+		Incidents.RUnlock()
+		if !exists || !containsInt(got.Alerts, s.alert) || len(got.Devices) != s.devices || got.Severity != s.severity {
+			t.Errorf("%v: incident %v is %+v, want alert %v, %v devices, severity %v", s.name, s.incident, got,
+				s.alert, s.devices, s.severity)
+		}
+	}
+	Incidents.RLock()
+	_, merged := Incidents.s.Incidents[3]
+	Incidents.RUnlock()
+	if merged {
+		t.Error("incident 3 still exists after it was merged")
+	}
+}
+
+func TestCorrelateAlertMaxAge(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	resetAlerts()
+	defer resetAlerts()
+
+	// A device that alerts every 10 minutes does not grow one incident forever
+	v := Verdict{Detector: "dga", Deviceid: 9001, Action: ACTION_REPORT}
+	for i := 0; i <= int(INCIDENT_MAX_AGE/(10*time.Minute))+1; i++ {
+		seen := start.Add(time.Duration(i) * 10 * time.Minute)
+		CorrelateAlert(Alert{Id: 1, Device: 9001, Detector: "dga", Lastseen: seen}, v)
+	}
+	Incidents.RLock()
+	n := len(Incidents.s.Incidents)
+	Incidents.RUnlock()
+	if n != 2 {
+		t.Errorf("%v incidents, want 2", n)
+	}
+}
+
+func TestCorrelateAcrossDevices(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &ManualClock{}
+	c.Set(start)
+	SetClock(c)
+	defer SetClock(systemClock{})
+	resetAlerts()
+	defer resetAlerts()
+
+	// Devices beaconing to the same remote, and scanning the same port
+	beacon := &beaconDetector{MinGap: 5, MinContacts: 8, MaxCV: 0.1, MaxBytes: 1000, Action: ACTION_REPORT,
+		tracks: map[beaconPair]*beaconTrack{}}
+	scan := &scanDetector{Window: 300, HorizontalHosts: 100, SuspectPorts: []int{23}, SuspectHosts: 20,
+		Action: ACTION_REPORT, contacts: map[int][]scanContact{}, flagged: map[int]time.Time{}}
+	tests := []struct {
+		name     string
+		detector FlowDetector
+		devices  []int
+		gap      time.Duration
+		flow     func(i int) Flow
+	}{
+		{"beacon", beacon, []int{9001, 9002, 9003}, time.Minute,
+			func(i int) Flow { return Flow{NodeId: 77, RemotePort: 443} }},
+		{"scan", scan, []int{9004, 9005}, time.Second,
+			func(i int) Flow { return Flow{NodeId: 1000 + i, RemotePort: 23} }},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 30; i++ {
+			for _, device := range tt.devices {
+				event := FlowEvent{SubFlow: SubFlow{Deviceid: device, Timestamp: c.Now(), BytesSent: 100},
+					Flow: tt.flow(i), New: true}
+				for _, v := range tt.detector.AnalyseFlow(event) {
+					CorrelateAlert(Alert{Id: device, Device: device, Detector: v.Detector, Lastseen: c.Now()}, v)
+				}
+			}
+			c.Advance(tt.gap)
+		}
+
+		Incidents.RLock()
+		found := false
+		for _, inc := range Incidents.s.Incidents {
+			if len(inc.Devices) == len(tt.devices) && containsInt(inc.Devices, tt.devices[0]) {
+				found = true
+			}
+		}
+		Incidents.RUnlock()
+		if !found {
+			t.Errorf("%v: devices %v are not correlated into one incident", tt.name, tt.devices)
+		}
+	}
+}
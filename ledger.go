@@ -0,0 +1,244 @@
+/*
+ * Enforcement ledger for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Every block and unblock of the NMC is written to a persisted ledger:
+ * who or what issued it, the detectors and reason, the verdicts it was
+ * based on and when. The ledger is reconciled with the block list that SPIN
+ * publishes ("blocks" filter messages), which tells blocks of the NMC apart
+ * from blocks made by the user in the SPIN UI, and reveals drift:
+ * - missing: the NMC has an active block that SPIN does not list
+ * - lingering: SPIN still lists a block that the NMC lifted
+ * - external: SPIN lists a block that the NMC did not issue
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const LEDGER_MAX_ENTRIES = 5000 // Oldest entries are removed beyond this
+
+const LEDGER_BLOCK = "block"
+const LEDGER_UNBLOCK = "unblock"
+const LEDGER_EXTERNAL = "external" // Block in SPIN that was not issued by the NMC
+
+const ISSUER_DETECTOR = "detector" // Issued by the anomaly detection
+const ISSUER_EXPIRY = "expiry"     // Block expired
+const ISSUER_USER = "user"         // Issued or approved over MQTT
+const ISSUER_TIMEOUT = "timeout"   // Proposed block that was not decided in time
+const ISSUER_SPIN = "spin"         // Seen in the block list of SPIN
+
+const DRIFT_MISSING = "missing"
+const DRIFT_LINGERING = "lingering"
+const DRIFT_EXTERNAL = "external"
+
+type LedgerEntry struct {
+	Id        int       `json:"id"`
+	Action    string    `json:"action"`              // block, unblock or external
+	Node      int       `json:"node"`                // SPIN identifier of the node, 0 if unknown
+	Device    int       `json:"device,omitempty"`    // Device the action was taken for
+	Issuer    string    `json:"issuer"`              // detector, expiry, user or spin
+	Detectors []string  `json:"detectors,omitempty"` // Detectors that caused the action
+	Reason    string    `json:"reason"`
+	Evidence  []Verdict `json:"evidence,omitempty"`  // Verdicts at the time of the action
+	Entry     string    `json:"entry,omitempty"`     // Entry in the block list of SPIN, for external blocks
+	Time      time.Time `json:"time"`                // Time of the action
+	Confirmed time.Time `json:"confirmed,omitempty"` // First time SPIN listed (or no longer listed) the result
+}
+
+type Drift struct {
+	Kind  string `json:"kind"`           // missing, lingering or external
+	Node  int    `json:"node,omitempty"` // SPIN identifier of the node, if known
+	Entry string `json:"entry,omitempty"`
+}
+
+type LedgerState struct {
+	Entries []*LedgerEntry `json:"entries"`
+	NextId  int            `json:"nextid"`
+}
+
+var Ledger = struct {
+	sync.RWMutex
+	s     LedgerState
+	drift map[string]bool // Drift reported in the last reconciliation
+}{s: LedgerState{Entries: []*LedgerEntry{}, NextId: 1}, drift: map[string]bool{}}
+
+// Initialise the ledger, and reconcile with every block list of SPIN
+func InitLedger(oldstate *LedgerState) {
+	Ledger.Lock()
+	if oldstate != nil && oldstate.Entries != nil {
+		Ledger.s = *oldstate
+	}
+	Ledger.Unlock()
+
+	RegisterCommand("get_ledger", handleGetLedger)
+	go func() {
+		ch := BrokerSubscribeFilter()
+		for {
+			filter, cont := <-ch
+			if !cont { // channel is closed
+				break
+			}
+			if filter.Command == "blocks" {
+				Reconcile(filter.Result)
+			}
+		}
+	}()
+}
+
+// Records an enforcement action in the ledger
+func RecordEnforcement(action string, node int, device int, issuer string, reason string, verdicts []Verdict) {
+	detectors := []string{}
+	for _, v := range verdicts {
+		if v.Actionable() {
+			detectors = append(detectors, v.Detector)
+		}
+	}
+	Ledger.Lock()
+	defer Ledger.Unlock()
+	addLedgerEntry(&LedgerEntry{Action: action, Node: node, Device: device, Issuer: issuer,
+		Detectors: detectors, Reason: reason, Evidence: verdicts, Time: clock.Now()})
+}
+
+// Requires lock on Ledger
+func addLedgerEntry(e *LedgerEntry) {
+	e.Id = Ledger.s.NextId
+	Ledger.s.NextId++
+	Ledger.s.Entries = append(Ledger.s.Entries, e)
+	if len(Ledger.s.Entries) > LEDGER_MAX_ENTRIES {
+		Ledger.s.Entries = Ledger.s.Entries[len(Ledger.s.Entries)-LEDGER_MAX_ENTRIES:]
+	}
+}
+
+// Requires lock on Ledger
+// Returns the last block or unblock of a node, or nil
+func lastEnforcement(node int) *LedgerEntry {
+	for i := len(Ledger.s.Entries) - 1; i >= 0; i-- {
+		e := Ledger.s.Entries[i]
+		if e.Node == node && (e.Action == LEDGER_BLOCK || e.Action == LEDGER_UNBLOCK) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Requires lock on Ledger
+// Checks whether an external block was recorded before
+func externalRecorded(entry string) bool {
+	for _, e := range Ledger.s.Entries {
+		if e.Action == LEDGER_EXTERNAL && e.Entry == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares the block list of SPIN (node identifiers or addresses) with the ledger, and reports drift
+func Reconcile(list []string) {
+	listed := map[string]bool{}
+	for _, entry := range list {
+		listed[entry] = true
+	}
+
+	// Addresses of all nodes the ledger knows about, HistoryNodeAddresses requires lock on History
+	Ledger.RLock()
+	nodes := map[int]bool{}
+	for _, e := range Ledger.s.Entries {
+		if e.Node > 0 {
+			nodes[e.Node] = true
+		}
+	}
+	Ledger.RUnlock()
+	addresses := map[int][]string{}
+	for node := range nodes {
+		addresses[node] = []string{strconv.Itoa(node)}
+		for _, ip := range HistoryNodeAddresses(node) {
+			addresses[node] = append(addresses[node], ip.String())
+		}
+	}
+	active := BlocksState().Active
+
+	now := clock.Now()
+	drift := []Drift{}
+	accounted := map[string]bool{}
+	Ledger.Lock()
+	for node := range nodes {
+		present := false
+		for _, a := range addresses[node] {
+			if listed[a] {
+				present = true
+				accounted[a] = true
+			}
+		}
+		last := lastEnforcement(node)
+		_, blocked := active[node]
+		switch {
+		case blocked && !present:
+			drift = append(drift, Drift{Kind: DRIFT_MISSING, Node: node})
+		case !blocked && present && last != nil && last.Action == LEDGER_UNBLOCK:
+			drift = append(drift, Drift{Kind: DRIFT_LINGERING, Node: node})
+		case last != nil && last.Confirmed.IsZero():
+			last.Confirmed = now
+		}
+	}
+	for _, entry := range list {
+		if accounted[entry] {
+			continue
+		}
+		drift = append(drift, Drift{Kind: DRIFT_EXTERNAL, Entry: entry})
+		if !externalRecorded(entry) {
+			addLedgerEntry(&LedgerEntry{Action: LEDGER_EXTERNAL, Issuer: ISSUER_SPIN, Entry: entry,
+				Reason: "blocked outside of the NMC", Time: now})
+		}
+	}
+
+	// Report only drift that is new since the last reconciliation
+	current := map[string]bool{}
+	report := []Drift{}
+	for _, d := range drift {
+		key := fmt.Sprintf("%v %v %v", d.Kind, d.Node, d.Entry)
+		current[key] = true
+		if !Ledger.drift[key] {
+			report = append(report, d)
+		}
+	}
+	Ledger.drift = current
+	Ledger.Unlock()
+
+	for _, d := range report {
+		if d.Kind == DRIFT_EXTERNAL {
+			fmt.Println("LE: drift,", d.Entry, "is blocked in SPIN, but not by the NMC")
+		} else {
+			fmt.Println("LE: drift,", d.Kind, "block of node", d.Node)
+		}
+	}
+	if len(report) > 0 {
+		publishResult("ledgerdrift", "", drift)
+	}
+}
+
+// Handles the get_ledger command, argument is an optional node to filter on
+func handleGetLedger(argument json.RawMessage) {
+	node, filter := argumentInt(argument)
+	Ledger.RLock()
+	entries := []LedgerEntry{}
+	for _, e := range Ledger.s.Entries {
+		if !filter || e.Node == node || e.Device == node {
+			entries = append(entries, *e)
+		}
+	}
+	Ledger.RUnlock()
+	if filter {
+		publishResult("ledger", fmt.Sprintf("%v", node), entries)
+	} else {
+		publishResult("ledger", "", entries)
+	}
+}
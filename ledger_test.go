@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT client that records published messages instead of sending them
+type testClient struct {
+	mqtt.Client
+	sync.Mutex
+	published [][]byte
+}
+
+type testToken struct {
+	mqtt.Token
+}
+
+func (t testToken) Wait() bool { return true }
+
+func (t testToken) Error() error { return nil }
+
+func (c *testClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	if message, ok := payload.([]byte); ok {
+		c.published = append(c.published, message)
+	}
+	return testToken{}
+}
+
+// Returns the results of all published replies to a command, and forgets all published messages
+func (c *testClient) results(command string) []json.RawMessage {
+	c.Lock()
+	defer c.Unlock()
+	res := []json.RawMessage{}
+	for _, message := range c.published {
+		reply := struct {
+			Command string          `json:"command"`
+			Result  json.RawMessage `json:"result"`
+		}{}
+		if json.Unmarshal(message, &reply) == nil && reply.Command == command {
+			res = append(res, reply.Result)
+		}
+	}
+	c.published = nil
+	return res
+}
+
+var testBroker = &testClient{}
+
+func init() {
+	client = testBroker
+}
+
+func TestReconcile(t *testing.T) {
+	c := &ManualClock{}
+	c.Set(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	SetClock(c)
+	defer SetClock(systemClock{})
+
+	tests := []struct {
+		name   string
+		action string // last action of the NMC on node 9001, empty if none
+		active bool   // whether the NMC has an active block of node 9001
+		list   []string
+		drift  []string
+	}{
+		{"blocked and listed", LEDGER_BLOCK, true, []string{"9001"}, []string{}},
+		{"blocked, not listed", LEDGER_BLOCK, true, []string{}, []string{"missing 9001 "}},
+		{"lifted, still listed", LEDGER_UNBLOCK, false, []string{"9001"}, []string{"lingering 9001 "}},
+		{"lifted and not listed", LEDGER_UNBLOCK, false, []string{}, []string{}},
+		{"blocked in SPIN only", "", false, []string{"192.0.2.1"}, []string{"external 0 192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		Ledger.Lock()
+		Ledger.s, Ledger.drift = LedgerState{Entries: []*LedgerEntry{}, NextId: 1}, map[string]bool{}
+		if tt.action != "" {
+			addLedgerEntry(&LedgerEntry{Action: tt.action, Node: 9001, Time: c.Now()})
+		}
+		Ledger.Unlock()
+		Blocks.Lock()
+		Blocks.s = BlockState{Active: map[int]*Block{}, Offences: map[int]*Offence{}}
+		if tt.active {
+			Blocks.s.Active[9001] = &Block{Node: 9001, Device: 9001}
+		}
+		Blocks.Unlock()
+
+		testBroker.results("")
+		Reconcile(tt.list)
+		Reconcile(tt.list) // drift is recorded once
+		if published := len(testBroker.results("ledgerdrift")); published != len(tt.drift) {
+			t.Errorf("%v: drift published %v times, want %v", tt.name, published, len(tt.drift))
+		}
+
+		Ledger.RLock()
+		drift := []string{}
+		for key := range Ledger.drift {
+			drift = append(drift, key)
+		}
+		externals := 0
+		for _, e := range Ledger.s.Entries {
+			if e.Action == LEDGER_EXTERNAL {
+				externals++
+			}
+		}
+		confirmed := tt.action != "" && !Ledger.s.Entries[0].Confirmed.IsZero()
+		Ledger.RUnlock()
+		sort.Strings(drift)
+		if len(drift) != len(tt.drift) || (len(drift) > 0 && drift[0] != tt.drift[0]) {
+			t.Errorf("%v: drift %q, want %q", tt.name, drift, tt.drift)
+		}
+		if tt.action == "" && externals != len(tt.list) {
+			t.Errorf("%v: %v external entries, want %v", tt.name, externals, len(tt.list))
+		}
+		if tt.action != "" && confirmed != (len(tt.drift) == 0) {
+			t.Errorf("%v: confirmed %v, want %v", tt.name, confirmed, len(tt.drift) == 0)
+		}
+	}
+	Blocks.Lock()
+	Blocks.s = BlockState{Active: map[int]*Block{}, Offences: map[int]*Offence{}}
+	Blocks.Unlock()
+}
@@ -0,0 +1,261 @@
+/*
+ * Device linking for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Phones rotate their (randomized) MAC addresses, and IPv6 privacy extensions
+ * rotate source addresses. Each rotation shows up as a new device, with its
+ * own short history. The linker compares new devices with recently vanished
+ * ones, and proposes to merge them when their behaviour is near-identical:
+ * - the set of resolved domains (Jaccard similarity)
+ * - the name of the device
+ * - a shared local ip address (e.g. the same DHCP lease)
+ * - the new device appeared shortly after the old one vanished
+ * Proposals must be confirmed by the user (confirm_merge / reject_merge).
+ * Decided proposals are removed ALERT_RETENTION after their decision, which
+ * is longer than LINK_WINDOW, so a rejected pair is not proposed again.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const LINK_INTERVAL = 5 * time.Minute  // Time between linking runs
+const LINK_VANISHED = 15 * time.Minute // A device is vanished when not seen for this long
+const LINK_WINDOW = 24 * time.Hour     // Only link devices that vanished/appeared within this window
+const LINK_MIN_DOMAINS = 5             // New device needs this many resolved domains before it is compared
+const LINK_THRESHOLD = 0.6             // Minimum score for a merge proposal
+const LINK_WEIGHT_DNS = 0.45           // Weight of the similarity of resolved domains, the weights add up to 1
+const LINK_WEIGHT_NAME = 0.3           // Weight of an identical device name
+const LINK_WEIGHT_ADDRESS = 0.15       // Weight of a shared local address
+const LINK_WEIGHT_TIMING = 0.1         // Weight of the new device appearing right after the old one vanished
+
+const MERGE_PROPOSED = "proposed"
+const MERGE_CONFIRMED = "confirmed"
+const MERGE_REJECTED = "rejected"
+
+type MergeProposal struct {
+	Id      int       `json:"id"`
+	From    int       `json:"from"`    // SPIN identifier of the vanished device
+	Into    int       `json:"into"`    // SPIN identifier of the new device
+	Score   float64   `json:"score"`   // Between 0 and 1
+	Reasons []string  `json:"reasons"` // Explanation of the score
+	State   string    `json:"state"`   // proposed, confirmed or rejected
+	Created time.Time `json:"created"`
+	Decided time.Time `json:"decided"`
+}
+
+type LinkerState struct {
+	Proposals map[int]*MergeProposal `json:"proposals"`
+	NextId    int                    `json:"nextid"`
+}
+
+var Linker = struct {
+	sync.RWMutex
+	s LinkerState
+}{s: LinkerState{Proposals: map[int]*MergeProposal{}, NextId: 1}}
+
+// Initialise device linking
+func InitLinker(oldstate *LinkerState) {
+	Linker.Lock()
+	if oldstate != nil && oldstate.Proposals != nil {
+		Linker.s = *oldstate
+	}
+	Linker.Unlock()
+
+	RegisterCommand("get_merge_proposals", handleMergeProposals)
+	RegisterCommand("confirm_merge", handleConfirmMerge)
+	RegisterCommand("reject_merge", handleRejectMerge)
+	go func() {
+		for {
+			clock.Sleep(LINK_INTERVAL)
+			LinkDevices()
+		}
+	}()
+}
+
+// Compares all new devices with vanished ones, and creates merge proposals.
+// Removes decided proposals beyond retention.
+func LinkDevices() {
+	now := clock.Now()
+	candidates := []MergeProposal{}
+
+	History.RLock()
+	for into, newdev := range History.m.Devices {
+		if !isRotatingDevice(newdev) || now.Sub(newdev.Firstseen) > LINK_WINDOW ||
+			len(newdev.Resolved) < LINK_MIN_DOMAINS {
+			continue
+		}
+		for from, olddev := range History.m.Devices {
+			if from == into || now.Sub(olddev.Lastseen) < LINK_VANISHED ||
+				now.Sub(olddev.Lastseen) > LINK_WINDOW || olddev.Lastseen.After(newdev.Firstseen.Add(LINK_VANISHED)) {
+				continue
+			}
+			score, reasons := linkScore(olddev, newdev)
+			if score >= LINK_THRESHOLD {
+				candidates = append(candidates, MergeProposal{From: from, Into: into, Score: score, Reasons: reasons})
+			}
+		}
+	}
+	History.RUnlock()
+
+	// best candidates first, so every device is proposed only once
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+
+	Linker.Lock()
+	defer Linker.Unlock()
+	for id, p := range Linker.s.Proposals {
+		if p.State != MERGE_PROPOSED && now.Sub(p.Decided) > ALERT_RETENTION {
+			delete(Linker.s.Proposals, id)
+		}
+	}
+	for _, c := range candidates {
+		if proposalExists(c.From, c.Into) {
+			continue
+		}
+		p := c
+		p.Id, p.State, p.Created = Linker.s.NextId, MERGE_PROPOSED, now
+		Linker.s.NextId++
+		Linker.s.Proposals[p.Id] = &p
+		fmt.Println("LI: proposal", p.Id, "to merge device", p.From, "into", p.Into,
+			"score", fmt.Sprintf("%.2f", p.Score), p.Reasons)
+	}
+}
+
+// Devices that may rotate their identity: randomized MAC, or no MAC at all
+func isRotatingDevice(dev Device) bool {
+	return dev.Mac == nil || dev.RandomMac
+}
+
+// Requires lock on Linker
+// Checks whether a proposal involving one of the devices is still open, or this pair was decided before
+func proposalExists(from int, into int) bool {
+	for _, p := range Linker.s.Proposals {
+		if p.From == from && p.Into == into {
+			return true
+		}
+		if p.State == MERGE_PROPOSED && (p.From == from || p.Into == into) {
+			return true
+		}
+	}
+	return false
+}
+
+// Requires read lock on History
+// Returns a similarity score between 0 and 1 of two devices, with an explanation
+func linkScore(olddev Device, newdev Device) (float64, []string) {
+	score := 0.0
+	reasons := []string{}
+
+	shared := 0
+	for domain := range newdev.Resolved {
+		if _, exists := olddev.Resolved[domain]; exists {
+			shared++
+		}
+	}
+	union := len(olddev.Resolved) + len(newdev.Resolved) - shared
+	if union > 0 {
+		jaccard := float64(shared) / float64(union)
+		score += LINK_WEIGHT_DNS * jaccard
+		reasons = append(reasons, fmt.Sprintf("%v shared domains (similarity %.2f)", shared, jaccard))
+	}
+
+	if newdev.Name != "" && newdev.Name == olddev.Name {
+		score += LINK_WEIGHT_NAME
+		reasons = append(reasons, fmt.Sprintf("same name %v", newdev.Name))
+	}
+
+	for _, ip := range newdev.Addresses {
+		if containsIP(olddev.Addresses, ip) {
+			score += LINK_WEIGHT_ADDRESS
+			reasons = append(reasons, fmt.Sprintf("shared address %v", ip))
+			break
+		}
+	}
+
+	gap := newdev.Firstseen.Sub(olddev.Lastseen)
+	if gap < 0 {
+		gap = 0
+	}
+	if gap < LINK_WINDOW {
+		score += LINK_WEIGHT_TIMING * (1 - float64(gap)/float64(LINK_WINDOW))
+		reasons = append(reasons, fmt.Sprintf("appeared %v after the other vanished", gap.Round(time.Minute)))
+	}
+	return score, reasons
+}
+
+// Merges two devices: history, traffic datapoints, learned destinations, learning phase,
+// detector state (e.g. baselines), alerts and risk. Short-lived detector windows of
+// device from (scans, beacons, DNS) are not merged, they expire on their own.
+func mergeDevices(from int, into int) bool {
+	if !HistoryMergeDevices(from, into) {
+		return false
+	}
+	TrafficHistoryMerge(from, into)
+	DestinationsMerge(from, into)
+	PhasesMerge(from, into)
+	DetectorsMerge(from, into)
+	AlertsMerge(from, into)
+	RiskMerge(from, into)
+	fmt.Println("LI: merged device", from, "into", DeviceLabel(into))
+	return true
+}
+
+// Handles the get_merge_proposals command, replies with all open proposals
+func handleMergeProposals(argument json.RawMessage) {
+	Linker.RLock()
+	proposals := []MergeProposal{}
+	for _, p := range Linker.s.Proposals {
+		if p.State == MERGE_PROPOSED {
+			proposals = append(proposals, *p)
+		}
+	}
+	Linker.RUnlock()
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].Id < proposals[j].Id })
+	publishResult("mergeproposals", "", proposals)
+}
+
+// Handles the confirm_merge command, argument is the proposal id
+func handleConfirmMerge(argument json.RawMessage) {
+	p := decideProposal(argument, MERGE_CONFIRMED)
+	if p == nil {
+		return
+	}
+	if !mergeDevices(p.From, p.Into) {
+		fmt.Println("LI: unable to merge device", p.From, "into", p.Into, ", device no longer exists")
+	}
+	publishResult("mergeproposal", fmt.Sprintf("%v", p.Id), p)
+}
+
+// Handles the reject_merge command, argument is the proposal id
+func handleRejectMerge(argument json.RawMessage) {
+	p := decideProposal(argument, MERGE_REJECTED)
+	if p == nil {
+		return
+	}
+	publishResult("mergeproposal", fmt.Sprintf("%v", p.Id), p)
+}
+
+// Marks an open proposal as decided, returns a copy or nil if there is no such open proposal
+func decideProposal(argument json.RawMessage, state string) *MergeProposal {
+	id, ok := argumentInt(argument)
+	if !ok {
+		return nil
+	}
+	Linker.Lock()
+	defer Linker.Unlock()
+	p, exists := Linker.s.Proposals[id]
+	if !exists || p.State != MERGE_PROPOSED {
+		return nil
+	}
+	p.State, p.Decided = state, clock.Now()
+	res := *p
+	return &res
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLinkScore(t *testing.T) {
+	vanished := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	domains := func(names ...string) map[string][]net.IP {
+		res := map[string][]net.IP{}
+		for _, n := range names {
+			res[n] = nil
+		}
+		return res
+	}
+	ip := net.ParseIP("192.168.1.10")
+	old := Device{Name: "phone", Lastseen: vanished, Resolved: domains("a.example", "b.example", "c.example", "d.example"),
+		Addresses: []net.IP{ip}}
+
+	tests := []struct {
+		name  string
+		dev   Device
+		score float64
+	}{
+		{"identical, right after", Device{Name: "phone", Firstseen: vanished, Resolved: old.Resolved,
+			Addresses: []net.IP{ip}}, 1},
+		{"nothing shared, a day later", Device{Name: "other", Firstseen: vanished.Add(LINK_WINDOW),
+			Resolved: domains("x.example")}, 0},
+		{"half the domains, right after", Device{Firstseen: vanished, Resolved: domains("a.example", "b.example")},
+			LINK_WEIGHT_DNS*0.5 + LINK_WEIGHT_TIMING},
+		{"same name, half a day later", Device{Name: "phone", Firstseen: vanished.Add(LINK_WINDOW / 2)},
+			LINK_WEIGHT_NAME + LINK_WEIGHT_TIMING*0.5},
+		{"appeared before vanishing", Device{Firstseen: vanished.Add(-time.Hour), Addresses: []net.IP{ip}},
+			LINK_WEIGHT_ADDRESS + LINK_WEIGHT_TIMING},
+	}
+	for _, tt := range tests {
+		score, reasons := linkScore(old, tt.dev)
+		if math.Abs(score-tt.score) > 1e-9 {
+			t.Errorf("%v: score %v, want %v (%v)", tt.name, score, tt.score, reasons)
+		}
+		if score < 0 || score > 1 {
+			t.Errorf("%v: score %v outside 0-1", tt.name, score)
+		}
+	}
+}
+
+func TestLinkerRetention(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := &ManualClock{}
+	c.Set(now)
+	SetClock(c)
+	defer SetClock(systemClock{})
+
+	Linker.Lock()
+	Linker.s = LinkerState{Proposals: map[int]*MergeProposal{
+		1: {Id: 1, From: 9001, Into: 9002, State: MERGE_REJECTED, Decided: now.Add(-ALERT_RETENTION - time.Hour)},
+		2: {Id: 2, From: 9003, Into: 9004, State: MERGE_CONFIRMED, Decided: now.Add(-24 * time.Hour)},
+		3: {Id: 3, From: 9005, Into: 9006, State: MERGE_PROPOSED, Created: now.Add(-ALERT_RETENTION - time.Hour)},
+	}, NextId: 4}
+	Linker.Unlock()
+	defer func() {
+		Linker.Lock()
+		Linker.s = LinkerState{Proposals: map[int]*MergeProposal{}, NextId: 1}
+		Linker.Unlock()
+	}()
+
+	LinkDevices()
+	Linker.RLock()
+	defer Linker.RUnlock()
+	if _, exists := Linker.s.Proposals[1]; exists {
+		t.Error("proposal decided beyond retention is kept")
+	}
+	if len(Linker.s.Proposals) != 2 || Linker.s.Proposals[2] == nil || Linker.s.Proposals[3] == nil {
+		t.Errorf("got proposals %v, want the recent decision and the open proposal", Linker.s.Proposals)
+	}
+}
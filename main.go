@@ -21,10 +21,36 @@ func main() {
 	restoreFilePtr := flag.String("db", ".spin-nmc-history.db", "restore database file")
 	mqttHostPtr := flag.String("mqtthost", "valibox.", "Host of mqtt server")
 	mqttPortPtr := flag.String("mqttport", "1883", "Port of mqtt server")
+	newdestLearnPtr := flag.Duration("newdest-learning", NEWDEST_LEARNING, "time to learn destinations of a device before reporting new ones")
+	newdestAllowPtr := flag.String("newdest-allowlist", "", "JSON file with allowed destinations per device")
+	newdestBlockPtr := flag.Bool("newdest-block", false, "block the remote node when a device contacts a new destination")
+	geoipPtr := flag.String("geoip", "", "comma separated list of GeoIP/ASN database files (.mmdb or .csv)")
+	signaturesPtr := flag.String("signatures", "signatures.json", "JSON file with device fingerprint signatures, empty disables fingerprinting")
+	ouiPtr := flag.String("oui", "", "comma separated list of IEEE OUI registry files (oui.csv, mam.csv, oui36.csv or oui.txt)")
+	detectorsPtr := flag.String("detectors", "", "JSON file with settings of the anomaly detectors")
+	policiesPtr := flag.String("policies", "", "JSON file with default, per category and per device anomaly policies, set_policy overrides these")
+	protectedPtr := flag.String("protected", "", "comma separated list of MAC addresses or names of devices that are never blocked")
+	maxBlocksPtr := flag.Int("max-blocks", 10, "maximum number of blocks per hour, 0 is unlimited")
+	minRiskPtr := flag.Float64("min-risk", 0, "minimum risk score (0-100) of a device for automatic blocks, 0 disables")
+	threatsPtr := flag.String("threats", "", "file with known malicious remotes for risk scores, a domain or ip address per line")
+	dryRunPtr := flag.Bool("dry-run", false, "log blocks instead of sending them to SPIN")
+	dohPtr := flag.String("doh", "doh.txt", "file with DNS-over-HTTPS providers, a domain or ip address per line, empty disables DoH detection")
 	flag.Parse()
 
 	var hs *HistoryDB = nil
 	var as *map[int]*FlowSummary = nil
+	var ds *map[int]*DestinationSet = nil
+	var ls *LinkerState = nil
+	var dets *map[string]DetectorSettings = nil
+	var bs *map[int][]time.Time = nil
+	var bl *BlockState = nil
+	var le *LedgerState = nil
+	var ap *ApprovalState = nil
+	var al *AlertState = nil
+	var in *IncidentState = nil
+	var po *PolicyConfig = nil
+	var ph *map[int]*DevicePhase = nil
+	var rs *ResolverUsage = nil
 	if !*freshPtr {
 		/* Continue from old state, if present */
 		persist, err := load(*restoreFilePtr)
@@ -36,14 +62,57 @@ func main() {
 		} else {
 			hs = &persist.HistoryState
 			as = &persist.TrafficHistoryState
+			ds = &persist.DestinationState
+			ls = &persist.LinkerState
+			dets = &persist.DetectorState
+			bs = &persist.BaselineState
+			bl = &persist.BlockState
+			le = &persist.LedgerState
+			ap = &persist.ApprovalState
+			al = &persist.AlertState
+			in = &persist.IncidentState
+			po = &persist.PolicyState
+			ph = &persist.PhaseState
+			rs = &persist.ResolverState
 		}
 	}
 	InitHistory(hs) // initialize history service
-	InitAnomaly(as) // Anomaly detection
+	// Time-limited blocks, their ledger and safety rails, restored before detectors can issue new ones
+	InitSafety(*protectedPtr, *maxBlocksPtr, *dryRunPtr)
+	InitLedger(le)
+	InitBlocks(bl)
+	InitApproval(ap)
+	InitAlerts(al)
+	InitIncidents(in)
+	InitRisk(*minRiskPtr, *threatsPtr)
+	// Policies, before any verdict is handled
+	InitPolicies(po, *policiesPtr)
+	// Learning phases per device
+	InitPhases(ph)
+	// Detector framework, before any detector registers itself
+	InitDetectors(dets, *detectorsPtr)
+	InitAnomaly(as)  // Anomaly detection
+	InitBaseline(bs) // Statistical baseline detection
+	InitSeasonal()   // Time-of-day and day-of-week baselines
+	InitRatio()      // Upload/download ratio shifts
+	InitScan()       // Fan-out and port scans
+	InitBeacon()     // Periodic low volume connections
+	InitDNS()        // Generated names, tunnelling and query bursts
+	// Devices bypassing the local resolver
+	InitResolver(rs, *dohPtr)
+	// Country and AS lookups, after history is restored so stored flows are enriched too
+	InitGeoIP(*geoipPtr)
+	InitOUI(*ouiPtr)                // MAC vendor lookups, before classification uses them
+	InitFingerprint(*signaturesPtr) // Device classification
+	InitLinker(ls)                  // Linking of devices with rotating addresses
+	// New destination detection
+	InitNewDest(ds, *newdestLearnPtr, *newdestAllowPtr, *newdestBlockPtr)
 
 	// Connect to MQTT Broker of valibox
 	ConnectToBroker(*mqttHostPtr, *mqttPortPtr)
+	listenCommands()
 	HandleKillSignal()
+	HandleReloadSignal()
 
 	for {
 		time.Sleep(5 * time.Minute)
@@ -71,3 +140,20 @@ func HandleKillSignal() {
 		os.Exit(1)
 	}()
 }
+
+// Reload databases on SIGHUP
+func HandleReloadSignal() {
+	csig := make(chan os.Signal, 2)
+	signal.Notify(csig, syscall.SIGHUP)
+	go func() {
+		for {
+			<-csig
+			fmt.Println("Reloading databases...")
+			ReloadGeoIP()
+			ReloadOUI()
+			ReloadSignatures()
+			ReloadDohList()
+			ReloadPolicies()
+		}
+	}()
+}
@@ -190,7 +190,7 @@ func BrokerSendCommand(command SPINcommand) {
 
 func BrokerSend(message []byte, topic string) error {
 	if token := client.Publish(topic, 0, false, message); token.Wait() && token.Error() != nil {
-		errors.New(fmt.Sprintf("MQTT: Error sending message: %v", token.Error()))
+		return errors.New(fmt.Sprintf("MQTT: Error sending message: %v", token.Error()))
 	}
 	return nil
 }
@@ -0,0 +1,366 @@
+/*
+ * New-destination detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * IoT devices typically talk to a small and stable set of destinations.
+ * During a learning period we store, per device, all destinations (domains,
+ * remote ips, remote ports and, if GeoIP is available, countries) it
+ * contacts. After that period, every flow to a destination outside that set
+ * is reported, unless it is allowlisted.
+ * Optionally, the remote node is blocked (instead of the whole device).
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const NEWDEST_LEARNING = 48 * time.Hour // Default time to learn destinations of a device
+
+type DestinationSet struct {
+	NodeId    int             `json:"nodeid"`    // SPIN identifier of the local device
+	Since     time.Time       `json:"since"`     // Start of the learning period
+	Domains   map[string]bool `json:"domains"`   // Domains contacted by this device
+	Ips       map[string]bool `json:"ips"`       // Remote ip addresses contacted by this device
+	Ports     map[int]bool    `json:"ports"`     // Remote ports contacted by this device
+	Countries map[string]bool `json:"countries"` // Countries of the remote ip addresses
+	Asns      map[uint]bool   `json:"asns"`      // Autonomous systems of the remote ip addresses
+}
+
+// Allowlist entry, any of the fields may be empty
+type allowEntry struct {
+	domain string     // domain, also matches its subdomains
+	ipnet  *net.IPNet // ip address or prefix
+	port   int        // remote port
+}
+
+var Destinations = struct {
+	sync.RWMutex
+	d     map[int]*DestinationSet // index is SPIN identifier of the device
+	allow map[string][]allowEntry // index is MAC address or SPIN identifier, "*" applies to all devices
+}{d: map[int]*DestinationSet{}, allow: map[string][]allowEntry{}}
+
+// New-destination detector, configuration of the detector framework
+type newDestDetector struct {
+	Learning  int    `json:"learning"`  // Duration of the learning period, in minutes
+	Block     bool   `json:"block"`     // Block remote node on a new destination
+	Allowlist string `json:"allowlist"` // Path to a JSON allowlist, may be empty
+}
+
+// Initialise new-destination detection
+// allowfile is an optional path to a JSON allowlist
+func InitNewDest(oldstate *map[int]*DestinationSet, learning time.Duration, allowfile string, blockNode bool) {
+	Destinations.Lock()
+	if oldstate != nil && *oldstate != nil {
+		Destinations.d = *oldstate
+	}
+	Destinations.Unlock()
+
+	d := &newDestDetector{Learning: int(learning.Minutes()), Block: blockNode, Allowlist: allowfile}
+	d.loadAllowlist()
+	RegisterDetector(d, true)
+}
+
+func (d *newDestDetector) Name() string {
+	return "newdest"
+}
+
+func (d *newDestDetector) Configure(config json.RawMessage) error {
+	allowfile := d.Allowlist
+	if err := json.Unmarshal(config, d); err != nil {
+		return err
+	}
+	if d.Allowlist != allowfile {
+		d.loadAllowlist()
+	}
+	return nil
+}
+
+// Loads the configured allowlist, an empty path clears the allowlist
+func (d *newDestDetector) loadAllowlist() {
+	allow := map[string][]allowEntry{}
+	if d.Allowlist != "" {
+		var err error
+		if allow, err = loadAllowlist(d.Allowlist); err != nil {
+			fmt.Println("ND: unable to load allowlist:", err)
+			return
+		}
+	}
+	Destinations.Lock()
+	Destinations.allow = allow
+	Destinations.Unlock()
+}
+
+// Loads an allowlist from a JSON file. The file holds an object with as key
+// a MAC address, SPIN identifier or "*" (all devices), and as value a list
+// of allowed destinations. A destination is a domain ("example.com"), an ip
+// address or prefix ("192.0.2.1", "192.0.2.0/24") or a port (":123").
+func loadAllowlist(fp string) (map[string][]allowEntry, error) {
+	bbuf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string][]string{}
+	if err := json.Unmarshal(bbuf, &raw); err != nil {
+		return nil, err
+	}
+
+	allow := map[string][]allowEntry{}
+	for device, list := range raw {
+		key := strings.ToLower(device)
+		for _, item := range list {
+			entry, err := parseAllowEntry(item)
+			if err != nil {
+				return nil, err
+			}
+			allow[key] = append(allow[key], entry)
+		}
+	}
+	return allow, nil
+}
+
+func parseAllowEntry(item string) (allowEntry, error) {
+	switch {
+	case strings.HasPrefix(item, ":"):
+		port, err := strconv.Atoi(item[1:])
+		if err != nil {
+			return allowEntry{}, fmt.Errorf("invalid port in allowlist: %v", item)
+		}
+		return allowEntry{port: port}, nil
+	case strings.Contains(item, "/"):
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return allowEntry{}, fmt.Errorf("invalid prefix in allowlist: %v", item)
+		}
+		return allowEntry{ipnet: ipnet}, nil
+	case net.ParseIP(item) != nil:
+		ip := net.ParseIP(item)
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return allowEntry{ipnet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	return allowEntry{domain: normaliseDomain(item)}, nil
+}
+
+// Reads a list of domains, ip addresses and prefixes, one per line ('#' starts a comment).
+// Returns the entries, and the lines that are not valid entries.
+func readEntryList(path string) ([]allowEntry, []string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fp.Close()
+
+	entries, invalid := []allowEntry{}, []string{}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		entry, err := parseAllowEntry(line)
+		if err != nil || entry.port > 0 {
+			invalid = append(invalid, line)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, invalid, scanner.Err()
+}
+
+// Checks whether one of the names or addresses matches a domain or prefix entry
+func entriesMatch(entries []allowEntry, names []string, ips []net.IP) bool {
+	for _, entry := range entries {
+		for _, ip := range ips {
+			if entry.ipnet != nil && entry.ipnet.Contains(ip) {
+				return true
+			}
+		}
+		for _, name := range names {
+			if entry.domain != "" && domainMatches(name, entry.domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Lowercases a domain and strips the trailing dot
+func normaliseDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// Requires read lock on Destinations
+// Checks whether a destination is allowlisted for this device
+func isAllowed(deviceid int, mac net.HardwareAddr, domains []string, ips []net.IP, port int) bool {
+	keys := []string{"*", strconv.Itoa(deviceid)}
+	if mac != nil {
+		keys = append(keys, mac.String())
+	}
+	for _, key := range keys {
+		for _, entry := range Destinations.allow[key] {
+			if entry.port != 0 && entry.port == port {
+				return true
+			}
+		}
+		if entriesMatch(Destinations.allow[key], domains, ips) {
+			return true
+		}
+	}
+	return false
+}
+
+// Only new flows are checked
+func (d *newDestDetector) AnalyseFlow(event FlowEvent) []Verdict {
+	if !event.New {
+		return nil
+	}
+	return d.checkDestination(event.Deviceid, event.Flow, event.Mac)
+}
+
+// Learns or checks the destination of a single flow
+func (d *newDestDetector) checkDestination(deviceid int, flow Flow, mac net.HardwareAddr) []Verdict {
+	// requires lock on History, so obtain before locking
+	domains := IPToName(deviceid, flow.RemoteIps)
+	now := clock.Now()
+
+	Destinations.Lock()
+	defer Destinations.Unlock()
+
+	set, exists := Destinations.d[deviceid]
+	if !exists {
+		set = &DestinationSet{NodeId: deviceid, Since: now, Domains: map[string]bool{},
+			Ips: map[string]bool{}, Ports: map[int]bool{}}
+		Destinations.d[deviceid] = set
+	}
+	if set.Countries == nil {
+		// Not present in older stored states
+		set.Countries, set.Asns = map[string]bool{}, map[uint]bool{}
+	}
+
+	learning := now.Sub(set.Since) < time.Duration(d.Learning)*time.Minute
+	newDomains, newIps, newPort := learnDestination(set, domains, flow.RemoteIps, flow.RemotePort)
+	newCountry := learnGeo(set, flow.Geo)
+
+	// A destination is known if we have seen its port and country, and one of its names or addresses
+	known := !newPort && !newCountry && (len(newDomains) < len(domains) || len(newIps) < len(flow.RemoteIps))
+	if learning || known || isAllowed(deviceid, mac, domains, flow.RemoteIps, flow.RemotePort) {
+		return nil
+	}
+
+	dest := strings.Join(domains, ",")
+	if dest == "" {
+		dest = strings.Join(newIps, ",")
+	}
+	if dest == "" {
+		// Only the port or country is new
+		ips := []string{}
+		for _, ip := range flow.RemoteIps {
+			ips = append(ips, ip.String())
+		}
+		dest = strings.Join(ips, ",")
+	}
+	verdict := Verdict{Detector: d.Name(), Deviceid: deviceid, Score: 1, Action: ACTION_REPORT,
+		Remote: flow.NodeId,
+		Reason: fmt.Sprintf("new destination %v on port %v in %v (new domains: %v, new ips: %v, new port: %v, new country: %v)",
+			dest, flow.RemotePort, flow.Geo, newDomains, newIps, newPort, newCountry)}
+	if dest != "" {
+		verdict.Evidence = strings.Split(dest, ",")
+	}
+	if d.Block && flow.NodeId > 0 {
+		verdict.Action = ACTION_BLOCK_REMOTE
+	}
+	return []Verdict{verdict}
+}
+
+// Requires write lock on Destinations
+// Adds destination to the set, and returns the parts that were not known before
+func learnDestination(set *DestinationSet, domains []string, ips []net.IP, port int) ([]string, []string, bool) {
+	newDomains := []string{}
+	newIps := []string{}
+	for _, domain := range domains {
+		domain = normaliseDomain(domain)
+		if !set.Domains[domain] {
+			newDomains = append(newDomains, domain)
+			set.Domains[domain] = true
+		}
+	}
+	for _, ip := range ips {
+		if !set.Ips[ip.String()] {
+			newIps = append(newIps, ip.String())
+			set.Ips[ip.String()] = true
+		}
+	}
+	newPort := !set.Ports[port]
+	set.Ports[port] = true
+	return newDomains, newIps, newPort
+}
+
+// Requires write lock on Destinations
+// Adds country and AS to the set, returns whether the country was new
+func learnGeo(set *DestinationSet, geo *GeoInfo) bool {
+	if geo == nil {
+		return false
+	}
+	if geo.ASN != 0 {
+		set.Asns[geo.ASN] = true
+	}
+	if geo.Country == "" || set.Countries[geo.Country] {
+		return false
+	}
+	set.Countries[geo.Country] = true
+	return true
+}
+
+// Adds the learned destinations of device from to device into, and removes device from.
+// The learning period of the merged set starts at the earliest of both.
+func DestinationsMerge(from int, into int) {
+	Destinations.Lock()
+	defer Destinations.Unlock()
+	src, exists := Destinations.d[from]
+	if !exists {
+		return
+	}
+	delete(Destinations.d, from)
+	dst, exists := Destinations.d[into]
+	if !exists {
+		src.NodeId = into
+		Destinations.d[into] = src
+		return
+	}
+	if src.Since.Before(dst.Since) {
+		dst.Since = src.Since
+	}
+	for k := range src.Domains {
+		dst.Domains[k] = true
+	}
+	for k := range src.Ips {
+		dst.Ips[k] = true
+	}
+	for k := range src.Ports {
+		dst.Ports[k] = true
+	}
+	if dst.Countries == nil {
+		dst.Countries, dst.Asns = map[string]bool{}, map[uint]bool{}
+	}
+	for k := range src.Countries {
+		dst.Countries[k] = true
+	}
+	for k := range src.Asns {
+		dst.Asns[k] = true
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowEntry(t *testing.T) {
+	tests := []struct {
+		item   string
+		domain string
+		ipnet  string
+		port   int
+		err    bool
+	}{
+		{item: ":123", port: 123},
+		{item: ":abc", err: true},
+		{item: "192.0.2.0/24", ipnet: "192.0.2.0/24"},
+		{item: "192.0.2.0/99", err: true},
+		{item: "192.0.2.1", ipnet: "192.0.2.1/32"},
+		{item: "2001:db8::1", ipnet: "2001:db8::1/128"},
+		{item: "Example.COM.", domain: "example.com"},
+	}
+	for _, tt := range tests {
+		entry, err := parseAllowEntry(tt.item)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v, want error %v", tt.item, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		ipnet := ""
+		if entry.ipnet != nil {
+			ipnet = entry.ipnet.String()
+		}
+		if entry.domain != tt.domain || ipnet != tt.ipnet || entry.port != tt.port {
+			t.Errorf("%v: got %+v, want domain %q ipnet %q port %v", tt.item, entry, tt.domain, tt.ipnet, tt.port)
+		}
+	}
+}
+
+func TestLearnDestination(t *testing.T) {
+	set := &DestinationSet{Domains: map[string]bool{}, Ips: map[string]bool{}, Ports: map[int]bool{}}
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+
+	domains, newips, port := learnDestination(set, []string{"Example.com."}, ips, 443)
+	if len(domains) != 1 || domains[0] != "example.com" || len(newips) != 1 || !port {
+		t.Errorf("first flow: got %v %v %v, want everything new", domains, newips, port)
+	}
+	domains, newips, port = learnDestination(set, []string{"example.com"}, ips, 443)
+	if len(domains) != 0 || len(newips) != 0 || port {
+		t.Errorf("second flow: got %v %v %v, want nothing new", domains, newips, port)
+	}
+}
+
+func TestInitNewDestWithoutStoredDestinations(t *testing.T) {
+	var stored map[int]*DestinationSet // state written before destinations were stored
+	InitNewDest(&stored, NEWDEST_LEARNING, "", false)
+	Destinations.RLock()
+	defer Destinations.RUnlock()
+	if Destinations.d == nil {
+		t.Fatal("destinations map is nil after restoring a state without destinations")
+	}
+}
+
+func TestCheckDestinationNewPort(t *testing.T) {
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{SpinId: 9001}
+	History.Unlock()
+	ip := net.ParseIP("192.0.2.1")
+	Destinations.Lock()
+	Destinations.d[9001] = &DestinationSet{NodeId: 9001, Since: clock.Now().Add(-NEWDEST_LEARNING),
+		Domains: map[string]bool{}, Ips: map[string]bool{ip.String(): true}, Ports: map[int]bool{443: true}}
+	Destinations.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		History.Unlock()
+		Destinations.Lock()
+		delete(Destinations.d, 9001)
+		Destinations.Unlock()
+	}()
+
+	d := &newDestDetector{Learning: 60}
+	verdicts := d.checkDestination(9001, Flow{NodeId: 42, RemoteIps: []net.IP{ip}, RemotePort: 8443}, nil)
+	if len(verdicts) != 1 || !strings.HasPrefix(verdicts[0].Reason, "new destination 192.0.2.1 on port 8443") {
+		t.Errorf("got %v, want a new destination 192.0.2.1 on port 8443", verdicts)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * MAC vendor (OUI) lookup for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Resolves MAC addresses to their manufacturer, using the IEEE registry.
+ * Both the CSV files (oui.csv, mam.csv, oui36.csv) and the text file
+ * (oui.txt) as published by the IEEE are supported.
+ * Locally administered MAC addresses, as used by phones for private Wi-Fi
+ * addresses, are detected without the registry.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var OUIRegistry = struct {
+	sync.RWMutex
+	files  []string
+	prefix map[string]string // Index is uppercase hex prefix (6, 7 or 9 digits), value is organisation
+}{prefix: map[string]string{}}
+
+// Initialise OUI lookups, files is a comma separated list of registry files
+func InitOUI(files string) {
+	OUIRegistry.Lock()
+	for _, fp := range strings.Split(files, ",") {
+		if fp = strings.TrimSpace(fp); fp != "" {
+			OUIRegistry.files = append(OUIRegistry.files, fp)
+		}
+	}
+	OUIRegistry.Unlock()
+
+	ReloadOUI()
+	RegisterCommand("reload_oui", func(argument json.RawMessage) { ReloadOUI() })
+}
+
+// (Re)loads the registry files, and resolves all known devices again
+func ReloadOUI() {
+	OUIRegistry.Lock()
+	prefix := map[string]string{}
+	for _, fp := range OUIRegistry.files {
+		n, err := loadOUIFile(fp, prefix)
+		if err != nil {
+			fmt.Println("OUI: unable to load", fp, ":", err)
+			continue
+		}
+		fmt.Println("OUI: loaded", n, "assignments from", fp)
+	}
+	if len(prefix) > 0 {
+		OUIRegistry.prefix = prefix
+	}
+	OUIRegistry.Unlock()
+
+	HistoryResolveManufacturers()
+}
+
+// Loads a registry file into prefix, returns the number of assignments read
+func loadOUIFile(fp string, prefix map[string]string) (int, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	if strings.HasSuffix(strings.ToLower(fp), ".csv") {
+		// Registry,Assignment,Organization Name,Organization Address
+		r := csv.NewReader(bufio.NewReader(f))
+		r.FieldsPerRecord = -1
+		r.LazyQuotes = true
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			if len(record) < 3 || !isHex(record[1]) {
+				continue // header
+			}
+			prefix[strings.ToUpper(record[1])] = strings.TrimSpace(record[2])
+			n++
+		}
+		return n, nil
+	}
+
+	// Text format, e.g.: 00-22-72   (hex)		American Micro-Fuel Device Corp.
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "(hex)", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		assignment := strings.Replace(strings.TrimSpace(fields[0]), "-", "", -1)
+		if !isHex(assignment) {
+			continue
+		}
+		prefix[strings.ToUpper(assignment)] = strings.TrimSpace(fields[1])
+		n++
+	}
+	return n, scanner.Err()
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range strings.ToUpper(s) {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks whether a MAC address is locally administered, e.g. randomized
+func IsLocalMac(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&0x02 != 0
+}
+
+// Returns the manufacturer of a MAC address, or an empty string if unknown.
+// Longer (MA-S, MA-M) assignments take precedence over MA-L.
+func OUILookup(mac net.HardwareAddr) string {
+	if len(mac) < 3 || IsLocalMac(mac) {
+		return ""
+	}
+	hex := strings.ToUpper(strings.Replace(mac.String(), ":", "", -1))
+
+	OUIRegistry.RLock()
+	defer OUIRegistry.RUnlock()
+	for _, length := range []int{9, 7, 6} {
+		if len(hex) < length {
+			continue
+		}
+		if org, exists := OUIRegistry.prefix[hex[:length]]; exists {
+			return org
+		}
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOUILookup(t *testing.T) {
+	dir := t.TempDir()
+	txt := filepath.Join(dir, "oui.txt")
+	csv := filepath.Join(dir, "mam.csv")
+	if err := os.WriteFile(txt, []byte("OUI/MA-L\t\tOrganization\n"+
+		"44-19-B6   (hex)\t\tHangzhou Hikvision Digital Technology Co.,Ltd.\n"+
+		"441 9B6     (base 16)\t\tHangzhou Hikvision Digital Technology Co.,Ltd.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(csv, []byte("Registry,Assignment,Organization Name,Organization Address\n"+
+		"MA-M,4419B6A,\"Smaller Assignee, Inc.\",Somewhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prefix := map[string]string{}
+	for _, fp := range []string{txt, csv} {
+		if n, err := loadOUIFile(fp, prefix); err != nil || n != 1 {
+			t.Fatalf("%v: read %v assignments, error %v", fp, n, err)
+		}
+	}
+	OUIRegistry.Lock()
+	old := OUIRegistry.prefix
+	OUIRegistry.prefix = prefix
+	OUIRegistry.Unlock()
+	defer func() {
+		OUIRegistry.Lock()
+		OUIRegistry.prefix = old
+		OUIRegistry.Unlock()
+	}()
+
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{"44:19:b6:00:00:01", "Hangzhou Hikvision Digital Technology Co.,Ltd."},
+		{"44:19:b6:a0:00:01", "Smaller Assignee, Inc."},
+		{"00:11:22:33:44:55", ""},
+		{"46:19:b6:00:00:01", ""}, // locally administered
+	}
+	for _, tt := range tests {
+		mac, _ := net.ParseMAC(tt.mac)
+		if got := OUILookup(mac); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestIsLocalMac(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want bool
+	}{
+		{"44:19:b6:00:00:01", false},
+		{"46:19:b6:00:00:01", true},
+		{"da:a1:19:00:00:01", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		mac, _ := net.ParseMAC(tt.mac)
+		if got := IsLocalMac(mac); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.mac, got, tt.want)
+		}
+	}
+}
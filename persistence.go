@@ -14,19 +14,48 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 type StorageState struct {
-	HistoryState        HistoryDB            `json:"history,omitempty"`
-	TrafficHistoryState map[int]*FlowSummary `json:"traffichistory,omitempty"`
+	HistoryState        HistoryDB                   `json:"history,omitempty"`
+	TrafficHistoryState map[int]*FlowSummary        `json:"traffichistory,omitempty"`
+	DestinationState    map[int]*DestinationSet     `json:"destinations,omitempty"`
+	LinkerState         LinkerState                 `json:"linker,omitempty"`
+	DetectorState       map[string]DetectorSettings `json:"detectors,omitempty"`
+	BaselineState       map[int][]time.Time         `json:"baseline,omitempty"`
+	BlockState          BlockState                  `json:"blocks,omitempty"`
+	LedgerState         LedgerState                 `json:"ledger,omitempty"`
+	ApprovalState       ApprovalState               `json:"approvals,omitempty"`
+	AlertState          AlertState                  `json:"alerts,omitempty"`
+	IncidentState       IncidentState               `json:"incidents,omitempty"`
+	PolicyState         PolicyConfig                `json:"policies,omitempty"`
+	PhaseState          map[int]*DevicePhase        `json:"phases,omitempty"`
+	ResolverState       ResolverUsage               `json:"resolvers,omitempty"`
 }
 
 func save(fp string) bool {
+	detectors := DetectorState()
+	baseline := BaselineState()
+	blocks := BlocksState()
+	approvals := ApprovalsState()
+	alerts := AlertsState()
+	incidents := IncidentsState()
+	policies := PolicyState()
+	phases := PhasesState()
+	usage := ResolversState()
 	History.RLock()
 	TrafficHistory.RLock()
+	Destinations.RLock()
+	Linker.RLock()
+	Ledger.RLock()
 	defer History.RUnlock()
 	defer TrafficHistory.RUnlock()
-	ss := StorageState{History.m, TrafficHistory.h}
+	defer Destinations.RUnlock()
+	defer Linker.RUnlock()
+	defer Ledger.RUnlock()
+	ss := StorageState{History.m, TrafficHistory.h, Destinations.d, Linker.s, detectors, baseline, blocks,
+		Ledger.s, approvals, alerts, incidents, policies, phases, usage}
 	return saveToFile(ss, fp)
 }
 
@@ -0,0 +1,399 @@
+/*
+ * Learning phases for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Every device learns before it is enforced: it is measured first, then
+ * verdicts are only reported, and finally blocks are enforced. The phase is
+ * stored per device, with the time it entered every phase. Learning starts
+ * at the first traffic of a device, and the phase follows from the time
+ * since then and the (policy) limits of measuring and reporting.
+ * Users can restart learning (e.g. after a firmware update), extend it, or
+ * force enforcement. Every transition is logged and published as event.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const PHASE_CHECK_INTERVAL = time.Minute // Time between phase updates of all devices
+const PHASE_EXTEND = TIME_REPORTING      // Default extension of learning, in minutes
+const PHASE_MAX_TRANSITIONS = 20         // Maximum number of transitions stored per device
+
+var phaseOrder = []string{PHASE_MEASURING, PHASE_REPORTING, PHASE_ENFORCING}
+
+type PhaseEvent struct {
+	Device int       `json:"device"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+type DevicePhase struct {
+	Phase       string               `json:"phase"`
+	Started     time.Time            `json:"started"`     // Start of learning
+	Entered     map[string]time.Time `json:"entered"`     // Entry time of every phase since learning started
+	Extension   int                  `json:"extension"`   // Minutes enforcing is postponed
+	Forced      bool                 `json:"forced"`      // Enforcing by command, until learning is restarted or extended
+	Transitions []PhaseEvent         `json:"transitions"` // Most recent transitions
+}
+
+var Phases = struct {
+	sync.RWMutex
+	s map[int]*DevicePhase
+}{s: map[int]*DevicePhase{}}
+
+// Initialise learning phases, with previously stored phases
+func InitPhases(oldstate *map[int]*DevicePhase) {
+	Phases.Lock()
+	if oldstate != nil && *oldstate != nil {
+		Phases.s = *oldstate
+		for _, p := range Phases.s {
+			if p.Entered == nil {
+				p.Entered = map[string]time.Time{}
+			}
+		}
+	}
+	Phases.Unlock()
+
+	RegisterCommand("get_phases", handleGetPhases)
+	RegisterCommand("restart_learning", handleRestartLearning)
+	RegisterCommand("extend_learning", handleExtendLearning)
+	RegisterCommand("force_enforcement", handleForceEnforcement)
+	go func() {
+		for {
+			clock.Sleep(PHASE_CHECK_INTERVAL)
+			UpdatePhases()
+		}
+	}()
+}
+
+// Returns a copy of all phases, for persistence
+func PhasesState() map[int]*DevicePhase {
+	Phases.RLock()
+	defer Phases.RUnlock()
+	res := make(map[int]*DevicePhase, len(Phases.s))
+	for id, p := range Phases.s {
+		c := p.copy()
+		res[id] = &c
+	}
+	return res
+}
+
+func (p *DevicePhase) copy() DevicePhase {
+	c := *p
+	c.Entered = make(map[string]time.Time, len(p.Entered))
+	for k, v := range p.Entered {
+		c.Entered[k] = v
+	}
+	c.Transitions = append([]PhaseEvent{}, p.Transitions...)
+	return c
+}
+
+// Returns the end of measuring and of reporting, given the limits in minutes
+func (p *DevicePhase) schedule(measuring int, reporting int) (time.Time, time.Time) {
+	m := p.Started.Add(time.Duration(measuring) * time.Minute)
+	r := p.Started.Add(time.Duration(reporting+p.Extension) * time.Minute)
+	if r.Before(m) {
+		r = m
+	}
+	return m, r
+}
+
+// Returns the phase a device should be in now
+func (p *DevicePhase) target(measuring int, reporting int, now time.Time) string {
+	m, r := p.schedule(measuring, reporting)
+	switch {
+	case p.Forced:
+		return PHASE_ENFORCING
+	case now.Before(m):
+		return PHASE_MEASURING
+	case now.Before(r):
+		return PHASE_REPORTING
+	}
+	return PHASE_ENFORCING
+}
+
+// Moves a device into a phase, returns the transition
+func (p *DevicePhase) enter(deviceid int, phase string, at time.Time, reason string) PhaseEvent {
+	e := PhaseEvent{Device: deviceid, From: p.Phase, To: phase, Time: at, Reason: reason}
+	p.Phase = phase
+	p.Entered[phase] = at
+	p.record(e)
+	return e
+}
+
+// Stores a transition, keeping the most recent ones
+func (p *DevicePhase) record(e PhaseEvent) {
+	p.Transitions = append(p.Transitions, e)
+	if len(p.Transitions) > PHASE_MAX_TRANSITIONS {
+		p.Transitions = p.Transitions[len(p.Transitions)-PHASE_MAX_TRANSITIONS:]
+	}
+}
+
+// Moves a device to the phase it should be in. Moving forward goes through every
+// phase, entered at the moment its limit passed. Moving back happens now.
+func (p *DevicePhase) advance(deviceid int, measuring int, reporting int, now time.Time, reason string) []PhaseEvent {
+	events := []PhaseEvent{}
+	target := p.target(measuring, reporting, now)
+	m, r := p.schedule(measuring, reporting)
+	for p.Phase != target {
+		next, at := target, now
+		if phaseIndex(target) > phaseIndex(p.Phase) && !p.Forced {
+			next = phaseOrder[phaseIndex(p.Phase)+1]
+			at = m
+			if next == PHASE_ENFORCING {
+				at = r
+			}
+		}
+		events = append(events, p.enter(deviceid, next, at, reason))
+	}
+	return events
+}
+
+func phaseIndex(phase string) int {
+	for i, p := range phaseOrder {
+		if p == phase {
+			return i
+		}
+	}
+	return 0
+}
+
+// Returns the time of the first traffic of a device, or now if there is none
+func firstTraffic(deviceid int, now time.Time) time.Time {
+	TrafficHistory.RLock()
+	defer TrafficHistory.RUnlock()
+	node, exists := TrafficHistory.h[deviceid]
+	if !exists || len(node.Datapoints) == 0 {
+		return now
+	}
+	tmin, _ := getTimeMinMax(node.Datapoints)
+	return tmin
+}
+
+// Changes the phase of a device with f, creating it when needed, and publishes the
+// transitions. Returns a copy of the phase afterwards.
+func updatePhase(deviceid int, reason string, f func(p *DevicePhase, measuring int, reporting int, now time.Time) []PhaseEvent) DevicePhase {
+	measuring, reporting := DevicePolicy(deviceid).phaseLimits()
+	now := clock.Now()
+	Phases.RLock()
+	_, exists := Phases.s[deviceid]
+	Phases.RUnlock()
+	first := now
+	if !exists {
+		first = firstTraffic(deviceid, now)
+	}
+
+	Phases.Lock()
+	events := []PhaseEvent{}
+	p, exists := Phases.s[deviceid]
+	if !exists {
+		p = &DevicePhase{Started: first, Entered: map[string]time.Time{}}
+		events = append(events, p.enter(deviceid, PHASE_MEASURING, first, "first traffic"))
+		Phases.s[deviceid] = p
+	}
+	if f != nil {
+		events = append(events, f(p, measuring, reporting, now)...)
+	}
+	events = append(events, p.advance(deviceid, measuring, reporting, now, reason)...)
+	res := p.copy()
+	Phases.Unlock()
+
+	publishPhaseEvents(events)
+	return res
+}
+
+// Logs and publishes transitions
+func publishPhaseEvents(events []PhaseEvent) {
+	for _, e := range events {
+		from := e.From
+		if from == "" {
+			from = "new"
+		}
+		fmt.Println("PH: device", DeviceLabel(e.Device), "from", from, "to", e.To, "at", e.Time.Format(time.RFC3339), e.Reason)
+		publishResult("phasechange", fmt.Sprintf("%v", e.Device), e)
+	}
+}
+
+// Returns the phase of a device, and the number of minutes it has been learning
+func devicePhase(nodeid int) (string, float64) {
+	p := updatePhase(nodeid, "learning limit reached", nil)
+	return p.Phase, clock.Now().Sub(p.Started).Minutes()
+}
+
+// Returns the next phase of a device and when it is entered, or an empty phase when enforcing
+func nextPhase(nodeid int) (string, time.Time) {
+	p := updatePhase(nodeid, "learning limit reached", nil)
+	if p.Phase == PHASE_ENFORCING {
+		return "", time.Time{}
+	}
+	m, r := p.schedule(DevicePolicy(nodeid).phaseLimits())
+	if p.Phase == PHASE_MEASURING {
+		return PHASE_REPORTING, m
+	}
+	return PHASE_ENFORCING, r
+}
+
+// Updates the phases of all known devices with traffic, and forgets the phases of unknown devices
+func UpdatePhases() {
+	History.RLock()
+	known := make(map[int]bool, len(History.m.Devices))
+	for deviceid := range History.m.Devices {
+		known[deviceid] = true
+	}
+	History.RUnlock()
+
+	Phases.Lock()
+	for deviceid := range Phases.s {
+		if !known[deviceid] {
+			delete(Phases.s, deviceid)
+		}
+	}
+	Phases.Unlock()
+
+	TrafficHistory.RLock()
+	devices := make([]int, 0, len(TrafficHistory.h))
+	for deviceid := range TrafficHistory.h {
+		if known[deviceid] {
+			devices = append(devices, deviceid)
+		}
+	}
+	TrafficHistory.RUnlock()
+	sort.Ints(devices)
+	for _, deviceid := range devices {
+		devicePhase(deviceid)
+	}
+}
+
+// Device into takes over the phase of device from, when that one learned longer.
+// The merge is published as a transition of device into.
+func PhasesMerge(from int, into int) {
+	Phases.Lock()
+	src, exists := Phases.s[from]
+	if !exists {
+		Phases.Unlock()
+		return
+	}
+	previous := ""
+	dst, exists := Phases.s[into]
+	if exists {
+		previous = dst.Phase
+	}
+	if !exists || src.Started.Before(dst.Started) {
+		for i := range src.Transitions {
+			src.Transitions[i].Device = into
+		}
+		Phases.s[into], dst = src, src
+	}
+	delete(Phases.s, from)
+	e := PhaseEvent{Device: into, From: previous, To: dst.Phase, Time: clock.Now(),
+		Reason: fmt.Sprintf("merged device %v", from)}
+	dst.record(e)
+	Phases.Unlock()
+
+	publishPhaseEvents([]PhaseEvent{e})
+}
+
+// Checks whether a device is known, phases are only kept for known devices
+func knownDevice(deviceid int) bool {
+	History.RLock()
+	defer History.RUnlock()
+	_, exists := History.m.Devices[deviceid]
+	return exists
+}
+
+// Decodes the argument of phase commands: a device id, or {"device": id, "minutes": n}.
+// The device must be known.
+func phaseArgument(argument json.RawMessage) (int, int, bool) {
+	arg := struct {
+		Device  int `json:"device"`
+		Minutes int `json:"minutes"`
+	}{Minutes: PHASE_EXTEND}
+	if id, ok := argumentInt(argument); ok {
+		arg.Device = id
+	} else if err := json.Unmarshal(argument, &arg); err != nil {
+		return 0, 0, false
+	}
+	if !knownDevice(arg.Device) {
+		fmt.Println("PH: unknown device", arg.Device)
+		return 0, 0, false
+	}
+	return arg.Device, arg.Minutes, true
+}
+
+// Handles the get_phases command, argument is an optional device id
+func handleGetPhases(argument json.RawMessage) {
+	if deviceid, ok := argumentInt(argument); ok && deviceid > 0 {
+		if !knownDevice(deviceid) {
+			return
+		}
+		p := updatePhase(deviceid, "learning limit reached", nil)
+		publishResult("phases", fmt.Sprintf("%v", deviceid), map[int]DevicePhase{deviceid: p})
+		return
+	}
+	res := map[int]DevicePhase{}
+	for id, p := range PhasesState() {
+		res[id] = *p
+	}
+	publishResult("phases", "", res)
+}
+
+// Handles the restart_learning command, argument is the device id
+func handleRestartLearning(argument json.RawMessage) {
+	deviceid, _, ok := phaseArgument(argument)
+	if !ok {
+		return
+	}
+	p := updatePhase(deviceid, "learning limit reached",
+		func(p *DevicePhase, measuring int, reporting int, now time.Time) []PhaseEvent {
+			p.Started, p.Extension, p.Forced = now, 0, false
+			p.Entered = map[string]time.Time{}
+			return []PhaseEvent{p.enter(deviceid, PHASE_MEASURING, now, "learning restarted")}
+		})
+	publishResult("phases", fmt.Sprintf("%v", deviceid), map[int]DevicePhase{deviceid: p})
+}
+
+// Handles the extend_learning command, argument is the device id or {"device": id, "minutes": n}.
+// Enforcing starts minutes later than planned, or than now when already enforcing.
+func handleExtendLearning(argument json.RawMessage) {
+	deviceid, minutes, ok := phaseArgument(argument)
+	if !ok || minutes <= 0 {
+		return
+	}
+	reason := fmt.Sprintf("learning extended by %v minutes", minutes)
+	p := updatePhase(deviceid, reason,
+		func(p *DevicePhase, measuring int, reporting int, now time.Time) []PhaseEvent {
+			_, end := p.schedule(measuring, reporting)
+			if end.Before(now) {
+				end = now
+			}
+			end = end.Add(time.Duration(minutes) * time.Minute)
+			p.Extension = int(end.Sub(p.Started).Minutes()+0.5) - reporting
+			p.Forced = false
+			return nil
+		})
+	publishResult("phases", fmt.Sprintf("%v", deviceid), map[int]DevicePhase{deviceid: p})
+}
+
+// Handles the force_enforcement command, argument is the device id
+func handleForceEnforcement(argument json.RawMessage) {
+	deviceid, _, ok := phaseArgument(argument)
+	if !ok {
+		return
+	}
+	p := updatePhase(deviceid, "enforcement forced",
+		func(p *DevicePhase, measuring int, reporting int, now time.Time) []PhaseEvent {
+			p.Forced = true
+			return nil
+		})
+	publishResult("phases", fmt.Sprintf("%v", deviceid), map[int]DevicePhase{deviceid: p})
+}
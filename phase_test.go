@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPhaseSchedule(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		extension int
+		measuring int
+		reporting int
+		wantm     time.Duration
+		wantr     time.Duration
+	}{
+		{"defaults", 0, TIME_MEASURING, TIME_REPORTING, TIME_MEASURING * time.Minute, TIME_REPORTING * time.Minute},
+		{"extended", 30, 10, 60, 10 * time.Minute, 90 * time.Minute},
+		{"reporting before measuring ends", 0, 60, 10, 60 * time.Minute, 60 * time.Minute},
+	}
+	for _, tt := range tests {
+		p := DevicePhase{Started: start, Extension: tt.extension}
+		m, r := p.schedule(tt.measuring, tt.reporting)
+		if !m.Equal(start.Add(tt.wantm)) || !r.Equal(start.Add(tt.wantr)) {
+			t.Errorf("%v: got %v and %v, want %v and %v", tt.name, m.Sub(start), r.Sub(start), tt.wantm, tt.wantr)
+		}
+	}
+}
+
+func TestPhaseAdvance(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	type transition struct {
+		to string
+		at time.Duration // since start
+	}
+	tests := []struct {
+		name   string
+		phase  string
+		forced bool
+		now    time.Duration
+		want   []transition
+	}{
+		{"still measuring", PHASE_MEASURING, false, 5 * time.Minute, nil},
+		{"to reporting", PHASE_MEASURING, false, 20 * time.Minute, []transition{{PHASE_REPORTING, 10 * time.Minute}}},
+		{"through every phase", PHASE_MEASURING, false, 2 * time.Hour,
+			[]transition{{PHASE_REPORTING, 10 * time.Minute}, {PHASE_ENFORCING, time.Hour}}},
+		{"forced", PHASE_MEASURING, true, 5 * time.Minute, []transition{{PHASE_ENFORCING, 5 * time.Minute}}},
+		{"back after extension", PHASE_ENFORCING, false, 30 * time.Minute,
+			[]transition{{PHASE_REPORTING, 30 * time.Minute}}},
+		{"enforcing", PHASE_ENFORCING, false, 2 * time.Hour, nil},
+	}
+	for _, tt := range tests {
+		p := DevicePhase{Phase: tt.phase, Started: start, Forced: tt.forced, Entered: map[string]time.Time{}}
+		events := p.advance(9001, 10, 60, start.Add(tt.now), "test")
+		if len(events) != len(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, events, tt.want)
+			continue
+		}
+		for i, e := range events {
+			if e.To != tt.want[i].to || !e.Time.Equal(start.Add(tt.want[i].at)) || e.Device != 9001 {
+				t.Errorf("%v: transition %v is %+v, want %v at %v", tt.name, i, e, tt.want[i].to, tt.want[i].at)
+			}
+		}
+		if len(events) > 0 && p.Phase != events[len(events)-1].To {
+			t.Errorf("%v: phase %v after %v", tt.name, p.Phase, events)
+		}
+	}
+}
+
+func TestPhasesMerge(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	Phases.Lock()
+	old := &DevicePhase{Phase: PHASE_ENFORCING, Started: start, Entered: map[string]time.Time{}}
+	old.enter(9001, PHASE_MEASURING, start, "first traffic")
+	old.enter(9001, PHASE_ENFORCING, start.Add(time.Hour), "test")
+	Phases.s[9001] = old
+	Phases.s[9002] = &DevicePhase{Phase: PHASE_MEASURING, Started: start.Add(24 * time.Hour),
+		Entered: map[string]time.Time{}}
+	Phases.Unlock()
+	defer func() {
+		Phases.Lock()
+		delete(Phases.s, 9001)
+		delete(Phases.s, 9002)
+		Phases.Unlock()
+	}()
+
+	testBroker.results("")
+	PhasesMerge(9001, 9002)
+	if published := testBroker.results("phasechange"); len(published) != 1 {
+		t.Errorf("merge published %v phase changes, want 1", len(published))
+	}
+	Phases.RLock()
+	defer Phases.RUnlock()
+	if _, exists := Phases.s[9001]; exists {
+		t.Error("phase of the merged device is kept")
+	}
+	p := Phases.s[9002]
+	if p.Phase != PHASE_ENFORCING || !p.Started.Equal(start) {
+		t.Errorf("got %v since %v, want the phase of the device that learned longer", p.Phase, p.Started)
+	}
+	for _, e := range p.Transitions {
+		if e.Device != 9002 {
+			t.Errorf("transition %+v is not of the merged device", e)
+		}
+	}
+	if e := p.Transitions[len(p.Transitions)-1]; e.From != PHASE_MEASURING || e.To != PHASE_ENFORCING ||
+		e.Reason != "merged device 9001" {
+		t.Errorf("last transition %+v, want the merge", e)
+	}
+}
+
+func TestUpdatePhasesForgetsUnknownDevices(t *testing.T) {
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{}
+	History.Unlock()
+	setTraffic(t, 9001, map[time.Time]*Datapoint{clock.Now(): {BytesSent: 1}})
+	Phases.Lock()
+	Phases.s[9002] = &DevicePhase{Phase: PHASE_MEASURING, Entered: map[string]time.Time{}}
+	Phases.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		History.Unlock()
+		Phases.Lock()
+		delete(Phases.s, 9001)
+		delete(Phases.s, 9002)
+		Phases.Unlock()
+	}()
+
+	UpdatePhases()
+	Phases.RLock()
+	defer Phases.RUnlock()
+	if _, exists := Phases.s[9001]; !exists {
+		t.Error("no phase of a known device with traffic")
+	}
+	if _, exists := Phases.s[9002]; exists {
+		t.Error("phase of an unknown device is kept")
+	}
+}
+
+func TestPhaseArgument(t *testing.T) {
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{}
+	History.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		History.Unlock()
+	}()
+
+	tests := []struct {
+		argument string
+		device   int
+		minutes  int
+		ok       bool
+	}{
+		{`9001`, 9001, PHASE_EXTEND, true},
+		{`"9001"`, 9001, PHASE_EXTEND, true},
+		{`{"device": 9001, "minutes": 30}`, 9001, 30, true},
+		{`9002`, 0, 0, false},
+		{`{"device": 9002}`, 0, 0, false},
+		{`"abc"`, 0, 0, false},
+	}
+	for _, tt := range tests {
+		device, minutes, ok := phaseArgument(json.RawMessage(tt.argument))
+		if device != tt.device || minutes != tt.minutes || ok != tt.ok {
+			t.Errorf("%v: got %v %v %v, want %v %v %v", tt.argument, device, minutes, ok, tt.device, tt.minutes, tt.ok)
+		}
+	}
+}
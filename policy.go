@@ -0,0 +1,390 @@
+/*
+ * Anomaly policies for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * A NAS and a smart plug need very different limits. Policies override the
+ * peak limits, the learning durations, the minimum risk score for blocks,
+ * which detectors count and which action they take. Policies are layered:
+ * the default policy, then the policy of the device category, then the
+ * policy of the device by name, and finally by MAC address. Fields that are not
+ * set in a layer are inherited; unset everywhere, the detector configuration
+ * and built-in constants apply. Example:
+ * {"default": {"reporting": 120},
+ *  "categories": {"ip-camera": {"actions": {"peak": "block_device"}}},
+ *  "devices": {"nas": {"threshold": 60000000, "detectors": {"ratio": false}}}}
+ * Policies set with set_policy override the policy of the same scope and key
+ * in the file. Only these overrides are persisted, so changes to the file
+ * still apply after a restart, except where an override replaces them.
+ * Actions must be one of none, report, block_remote or block_device.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+type Policy struct {
+	MaxIncrease *float64          `json:"maxincrease,omitempty"` // Peak: alert if new peak is this much higher
+	Threshold   *int              `json:"threshold,omitempty"`   // Peak: outgoing traffic (per minute) below this is allowed
+	Inbound     *int              `json:"inbound,omitempty"`     // Peak: incoming traffic (per minute) below this is allowed
+	Penalty     *int              `json:"penalty,omitempty"`     // Peak: number of recent peak minutes before acting
+	Measuring   *int              `json:"measuring,omitempty"`   // Minutes of traffic to measure only
+	Reporting   *int              `json:"reporting,omitempty"`   // Minutes of traffic before enforcing
+	MinRisk     *float64          `json:"minrisk,omitempty"`     // Minimum risk score for automatic blocks
+	Detectors   map[string]bool   `json:"detectors,omitempty"`   // Detectors that count (true) or are ignored (false)
+	Actions     map[string]string `json:"actions,omitempty"`     // Action per detector, overrides the suggested action
+}
+
+type PolicyConfig struct {
+	Default    *Policy           `json:"default"`
+	Categories map[string]Policy `json:"categories"` // Per device category
+	Devices    map[string]Policy `json:"devices"`    // Per MAC address or name
+}
+
+var Policies = struct {
+	sync.RWMutex
+	c         PolicyConfig // Effective policies: the file, with the overrides on top
+	file      string
+	loaded    PolicyConfig // Policies of the file
+	overrides PolicyConfig // Policies set with set_policy
+}{
+	c:         PolicyConfig{Categories: map[string]Policy{}, Devices: map[string]Policy{}},
+	loaded:    PolicyConfig{Categories: map[string]Policy{}, Devices: map[string]Policy{}},
+	overrides: PolicyConfig{Categories: map[string]Policy{}, Devices: map[string]Policy{}},
+}
+
+// Initialise policies, with previously stored overrides
+func InitPolicies(oldstate *PolicyConfig, file string) {
+	Policies.Lock()
+	if oldstate != nil {
+		Policies.overrides = *oldstate
+		Policies.overrides.normalise()
+		if err := Policies.overrides.validate(); err != nil {
+			fmt.Println("PO: ignoring stored policies:", err)
+			Policies.overrides = PolicyConfig{}
+			Policies.overrides.normalise()
+		}
+	}
+	Policies.file = file
+	applyOverrides()
+	Policies.Unlock()
+	if file != "" {
+		ReloadPolicies()
+	}
+
+	RegisterCommand("get_policies", handleGetPolicies)
+	RegisterCommand("set_policy", handleSetPolicy)
+	RegisterCommand("reload_policies", func(argument json.RawMessage) { ReloadPolicies() })
+}
+
+// Loads the policy file
+func ReloadPolicies() {
+	Policies.Lock()
+	defer Policies.Unlock()
+	if Policies.file == "" {
+		return
+	}
+	c := PolicyConfig{}
+	bbuf, err := ioutil.ReadFile(Policies.file)
+	if err == nil {
+		err = json.Unmarshal(bbuf, &c)
+	}
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		fmt.Println("PO: unable to load", Policies.file, ":", err)
+		return
+	}
+	Policies.loaded = c
+	Policies.loaded.normalise()
+	applyOverrides()
+	fmt.Println("PO: loaded", len(c.Categories), "category and", len(c.Devices), "device policies")
+}
+
+// Requires lock on Policies
+// Computes the effective policies from the file and the overrides
+func applyOverrides() {
+	c := PolicyConfig{Default: Policies.loaded.Default, Categories: map[string]Policy{}, Devices: map[string]Policy{}}
+	for key, p := range Policies.loaded.Categories {
+		c.Categories[key] = p
+	}
+	for key, p := range Policies.loaded.Devices {
+		c.Devices[key] = p
+	}
+	if Policies.overrides.Default != nil {
+		c.Default = Policies.overrides.Default
+	}
+	for key, p := range Policies.overrides.Categories {
+		c.Categories[key] = p
+	}
+	for key, p := range Policies.overrides.Devices {
+		c.Devices[key] = p
+	}
+	Policies.c = c.copy()
+}
+
+// Makes sure maps exist, device names are lowercase and MAC addresses in the standard notation
+func (c *PolicyConfig) normalise() {
+	if c.Categories == nil {
+		c.Categories = map[string]Policy{}
+	}
+	devices := map[string]Policy{}
+	for key, p := range c.Devices {
+		devices[deviceKey(key)] = p
+	}
+	c.Devices = devices
+}
+
+// Returns the key of a device policy: a MAC address in the standard notation, or a lowercase name
+func deviceKey(key string) string {
+	if mac, err := net.ParseMAC(key); err == nil {
+		return mac.String()
+	}
+	return strings.ToLower(key)
+}
+
+// Returns a deep copy of policies
+func (c PolicyConfig) copy() PolicyConfig {
+	bbuf, _ := json.Marshal(c)
+	res := PolicyConfig{}
+	json.Unmarshal(bbuf, &res)
+	res.normalise()
+	return res
+}
+
+// Checks the actions of all policies
+func (c PolicyConfig) validate() error {
+	if c.Default != nil {
+		if err := c.Default.validate(); err != nil {
+			return fmt.Errorf("default policy: %v", err)
+		}
+	}
+	for key, p := range c.Categories {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("policy of category %v: %v", key, err)
+		}
+	}
+	for key, p := range c.Devices {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("policy of device %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Checks the actions of a policy
+func (p Policy) validate() error {
+	for name, action := range p.Actions {
+		if !validAction(action) {
+			return fmt.Errorf("invalid action %q for detector %v", action, name)
+		}
+	}
+	return nil
+}
+
+// Checks whether an action is one of the ACTION_* constants
+func validAction(action string) bool {
+	switch action {
+	case ACTION_NONE, ACTION_REPORT, ACTION_BLOCK_REMOTE, ACTION_BLOCK_DEVICE:
+		return true
+	}
+	return false
+}
+
+// Requires read lock on History
+// Checks whether a device has a MAC address or name (case insensitive)
+func deviceMatches(dev Device, key string) bool {
+	if mac, err := net.ParseMAC(key); err == nil {
+		return dev.Mac != nil && mac.String() == dev.Mac.String()
+	}
+	return dev.Name != "" && strings.EqualFold(dev.Name, key)
+}
+
+// Overlays the fields that are set in policy o
+func (p *Policy) overlay(o Policy) {
+	if o.MaxIncrease != nil {
+		p.MaxIncrease = o.MaxIncrease
+	}
+	if o.Threshold != nil {
+		p.Threshold = o.Threshold
+	}
+	if o.Inbound != nil {
+		p.Inbound = o.Inbound
+	}
+	if o.Penalty != nil {
+		p.Penalty = o.Penalty
+	}
+	if o.Measuring != nil {
+		p.Measuring = o.Measuring
+	}
+	if o.Reporting != nil {
+		p.Reporting = o.Reporting
+	}
+	if o.MinRisk != nil {
+		p.MinRisk = o.MinRisk
+	}
+	for name, enabled := range o.Detectors {
+		p.Detectors[name] = enabled
+	}
+	for name, action := range o.Actions {
+		p.Actions[name] = action
+	}
+}
+
+// Returns the effective policy of a device
+func DevicePolicy(deviceid int) Policy {
+	History.RLock()
+	dev, exists := History.m.Devices[deviceid]
+	category := ""
+	if exists && dev.Class != nil {
+		category = dev.Class.Category
+	}
+	History.RUnlock()
+
+	Policies.RLock()
+	defer Policies.RUnlock()
+	p := Policy{Detectors: map[string]bool{}, Actions: map[string]string{}}
+	if Policies.c.Default != nil {
+		p.overlay(*Policies.c.Default)
+	}
+	if category != "" {
+		p.overlay(Policies.c.Categories[category])
+	}
+	if exists {
+		// By name first, so a policy by MAC address is the more specific one
+		if o, ok := Policies.c.Devices[strings.ToLower(dev.Name)]; ok && dev.Name != "" {
+			p.overlay(o)
+		}
+		if o, ok := Policies.c.Devices[dev.Mac.String()]; ok && dev.Mac != nil {
+			p.overlay(o)
+		}
+	}
+	return p
+}
+
+// Returns the minutes of traffic to measure only, and before enforcing, of a policy
+func (p Policy) phaseLimits() (int, int) {
+	measuring, reporting := TIME_MEASURING, TIME_REPORTING
+	if p.Measuring != nil {
+		measuring = *p.Measuring
+	}
+	if p.Reporting != nil {
+		reporting = *p.Reporting
+	}
+	return measuring, reporting
+}
+
+// Drops verdicts of detectors the policy of a device ignores, and overrides their actions
+func applyPolicy(deviceid int, verdicts []Verdict) []Verdict {
+	p := DevicePolicy(deviceid)
+	res := []Verdict{}
+	for _, v := range verdicts {
+		if enabled, exists := p.Detectors[v.Detector]; exists && !enabled {
+			continue
+		}
+		if action, exists := p.Actions[v.Detector]; exists && validAction(action) && v.Action != ACTION_NONE &&
+			v.Action != "" {
+			v.Action = action
+			if action == ACTION_BLOCK_REMOTE && v.Remote == 0 {
+				v.Action = ACTION_REPORT // No remote to block, blocking the device would go beyond the policy
+			}
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// Returns a copy of the overrides set with set_policy, for persistence
+func PolicyState() PolicyConfig {
+	Policies.RLock()
+	defer Policies.RUnlock()
+	return Policies.overrides.copy()
+}
+
+// Handles the get_policies command, replies with all effective policies
+func handleGetPolicies(argument json.RawMessage) {
+	Policies.RLock()
+	c := Policies.c.copy()
+	Policies.RUnlock()
+	publishResult("policies", "", c)
+}
+
+// Handles the set_policy command, argument is
+// {"scope": "default"|"category"|"device", "key": <category, MAC or name>, "policy": {...}}.
+// The policy overrides the one in the policy file, an empty (null) policy removes
+// the override. Replies with the resulting policy of the scope, or an error.
+func handleSetPolicy(argument json.RawMessage) {
+	var arg struct {
+		Scope  string  `json:"scope"`
+		Key    string  `json:"key"`
+		Policy *Policy `json:"policy"`
+	}
+	if err := json.Unmarshal(argument, &arg); err != nil {
+		publishResult("policy", "", map[string]string{"error": err.Error()})
+		return
+	}
+	result := map[string]interface{}{"scope": arg.Scope, "key": arg.Key}
+	if arg.Policy != nil {
+		if err := arg.Policy.validate(); err != nil {
+			result["error"] = err.Error()
+			publishResult("policy", arg.Key, result)
+			return
+		}
+	}
+
+	Policies.Lock()
+	key := arg.Key
+	switch arg.Scope {
+	case "default":
+		Policies.overrides.Default = arg.Policy
+	case "category":
+		delete(Policies.overrides.Categories, key)
+		if arg.Policy != nil {
+			Policies.overrides.Categories[key] = *arg.Policy
+		}
+	case "device":
+		key = deviceKey(key)
+		delete(Policies.overrides.Devices, key)
+		if arg.Policy != nil {
+			Policies.overrides.Devices[key] = *arg.Policy
+		}
+	default:
+		Policies.Unlock()
+		result["error"] = fmt.Sprintf("invalid scope %q", arg.Scope)
+		publishResult("policy", arg.Key, result)
+		return
+	}
+	applyOverrides()
+	result["policy"] = Policies.c.policy(arg.Scope, key)
+	Policies.Unlock()
+
+	fmt.Println("PO: policy of", arg.Scope, arg.Key, "changed")
+	publishResult("policy", arg.Key, result)
+}
+
+// Returns the policy of a scope and key, or nil if there is none
+func (c PolicyConfig) policy(scope string, key string) *Policy {
+	var p Policy
+	exists := false
+	switch scope {
+	case "default":
+		return c.Default
+	case "category":
+		p, exists = c.Categories[key]
+	case "device":
+		p, exists = c.Devices[key]
+	}
+	if !exists {
+		return nil
+	}
+	return &p
+}
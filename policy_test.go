@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// Replaces the policy file and overrides for the duration of a test
+func setPolicies(t *testing.T, loaded PolicyConfig, overrides PolicyConfig) {
+	loaded.normalise()
+	overrides.normalise()
+	Policies.Lock()
+	Policies.loaded, Policies.overrides = loaded, overrides
+	applyOverrides()
+	Policies.Unlock()
+	t.Cleanup(func() {
+		Policies.Lock()
+		Policies.loaded, Policies.overrides = PolicyConfig{}, PolicyConfig{}
+		Policies.loaded.normalise()
+		Policies.overrides.normalise()
+		applyOverrides()
+		Policies.Unlock()
+	})
+}
+
+func TestPolicyOverlay(t *testing.T) {
+	one, two := 1, 2
+	tests := []struct {
+		name   string
+		layers []Policy
+		want   Policy
+	}{
+		{"empty", nil, Policy{}},
+		{"inherited", []Policy{{Threshold: &one}, {Penalty: &two}}, Policy{Threshold: &one, Penalty: &two}},
+		{"overridden", []Policy{{Threshold: &one}, {Threshold: &two}}, Policy{Threshold: &two}},
+		{"maps merge", []Policy{{Actions: map[string]string{"peak": ACTION_REPORT, "dga": ACTION_REPORT}},
+			{Actions: map[string]string{"peak": ACTION_BLOCK_DEVICE}}},
+			Policy{Actions: map[string]string{"peak": ACTION_BLOCK_DEVICE, "dga": ACTION_REPORT}}},
+	}
+	for _, tt := range tests {
+		p := Policy{Detectors: map[string]bool{}, Actions: map[string]string{}}
+		for _, l := range tt.layers {
+			p.overlay(l)
+		}
+		if tt.want.Detectors == nil {
+			tt.want.Detectors = map[string]bool{}
+		}
+		if tt.want.Actions == nil {
+			tt.want.Actions = map[string]string{}
+		}
+		got, _ := json.Marshal(p)
+		want, _ := json.Marshal(tt.want)
+		if string(got) != string(want) {
+			t.Errorf("%v: got %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{Name: "nas", Mac: mac, Class: &DeviceClass{Category: "ip-camera"}}
+	History.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		History.Unlock()
+	}()
+	setPolicies(t, PolicyConfig{
+		Default:    &Policy{Actions: map[string]string{"peak": ACTION_REPORT, "dga": "explode"}},
+		Categories: map[string]Policy{"ip-camera": {Actions: map[string]string{"scan": ACTION_BLOCK_REMOTE}}},
+		Devices:    map[string]Policy{"NAS": {Detectors: map[string]bool{"ratio": false}}},
+	}, PolicyConfig{})
+
+	tests := []struct {
+		verdict Verdict
+		action  string // empty if dropped
+	}{
+		{Verdict{Detector: "ratio", Action: ACTION_REPORT}, ""},
+		{Verdict{Detector: "peak", Action: ACTION_BLOCK_DEVICE}, ACTION_REPORT},
+		{Verdict{Detector: "peak", Action: ACTION_NONE}, ACTION_NONE},
+		{Verdict{Detector: "scan", Action: ACTION_REPORT}, ACTION_REPORT}, // no remote to block
+		{Verdict{Detector: "scan", Action: ACTION_REPORT, Remote: 42}, ACTION_BLOCK_REMOTE},
+		{Verdict{Detector: "dga", Action: ACTION_REPORT}, ACTION_REPORT}, // invalid action is ignored
+		{Verdict{Detector: "beacon", Action: ACTION_REPORT}, ACTION_REPORT},
+	}
+	for _, tt := range tests {
+		tt.verdict.Deviceid = 9001
+		res := applyPolicy(9001, []Verdict{tt.verdict})
+		action := ""
+		if len(res) > 0 {
+			action = res[0].Action
+		}
+		if action != tt.action {
+			t.Errorf("%+v: action %q, want %q", tt.verdict, action, tt.action)
+		}
+	}
+}
+
+func TestDevicePolicyOrder(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{Name: "NAS", Mac: mac}
+	History.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		History.Unlock()
+	}()
+	one, two := 1, 2
+	setPolicies(t, PolicyConfig{Devices: map[string]Policy{
+		"nas":               {Threshold: &one, Penalty: &one},
+		"00-11-22-33-44-55": {Threshold: &two},
+	}}, PolicyConfig{})
+
+	// The policy by MAC address always wins over the policy by name
+	for i := 0; i < 20; i++ {
+		p := DevicePolicy(9001)
+		if p.Threshold == nil || *p.Threshold != two || p.Penalty == nil || *p.Penalty != one {
+			t.Fatalf("attempt %v: got %+v, want threshold %v and penalty %v", i+1, p, two, one)
+		}
+	}
+}
+
+func TestPolicyOverrides(t *testing.T) {
+	one, two := 1, 2
+	setPolicies(t, PolicyConfig{Default: &Policy{Threshold: &one},
+		Devices: map[string]Policy{"nas": {Penalty: &one}}}, PolicyConfig{})
+
+	steps := []struct {
+		argument string
+		valid    bool
+		check    func(c PolicyConfig) bool
+	}{
+		{`{"scope": "default", "policy": {"threshold": 2}}`, true,
+			func(c PolicyConfig) bool { return *c.Default.Threshold == two }},
+		{`{"scope": "device", "key": "NAS", "policy": {}}`, true,
+			func(c PolicyConfig) bool { return c.Devices["nas"].Penalty == nil }},
+		{`{"scope": "device", "key": "nas", "policy": {"actions": {"peak": "explode"}}}`, false,
+			func(c PolicyConfig) bool { return c.Devices["nas"].Actions == nil }},
+		{`{"scope": "everything", "policy": {}}`, false, nil},
+		{`{"scope": "device", "key": "nas", "policy": null}`, true,
+			func(c PolicyConfig) bool { return *c.Devices["nas"].Penalty == one }},
+	}
+	for _, s := range steps {
+		before := PolicyState()
+		handleSetPolicy(json.RawMessage(s.argument))
+		after := PolicyState()
+		b1, _ := json.Marshal(before)
+		b2, _ := json.Marshal(after)
+		if !s.valid && string(b1) != string(b2) {
+			t.Errorf("%v: invalid policy changed the overrides to %s", s.argument, b2)
+		}
+		Policies.RLock()
+		c := Policies.c.copy()
+		Policies.RUnlock()
+		if s.check != nil && !s.check(c) {
+			t.Errorf("%v: unexpected effective policies", s.argument)
+		}
+	}
+
+	// Reloading the file keeps the overrides
+	Policies.Lock()
+	Policies.loaded = PolicyConfig{Default: &Policy{Threshold: &one, Penalty: &one}}
+	Policies.loaded.normalise()
+	applyOverrides()
+	Policies.Unlock()
+	Policies.RLock()
+	defer Policies.RUnlock()
+	if d := Policies.c.Default; *d.Threshold != two || d.Penalty != nil {
+		t.Errorf("default policy after reload is %+v, want the override", d)
+	}
+}
+
+func TestValidAction(t *testing.T) {
+	for _, action := range []string{ACTION_NONE, ACTION_REPORT, ACTION_BLOCK_REMOTE, ACTION_BLOCK_DEVICE} {
+		if !validAction(action) {
+			t.Errorf("%v is not valid", action)
+		}
+	}
+	for _, action := range []string{"", "block", "Block_Device"} {
+		if validAction(action) {
+			t.Errorf("%q is valid", action)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Upload/download ratio detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Most devices have a stable balance between what they send and what they
+ * receive: a camera uploads, a TV downloads. This detector compares the
+ * upload share (bytes sent / all bytes) of the recent minutes with the
+ * upload share of all older traffic. A device that suddenly uploads much
+ * more than usual may be exfiltrating data, a device that suddenly receives
+ * much more than usual may be abused to store or serve files.
+ * Both directions have their own threshold and action.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ratioDetector struct {
+	UploadShift    float64 `json:"uploadshift"`    // Flag when the upload share rises this much (0-1), 0 disables
+	UploadAction   string  `json:"uploadaction"`   // Action when the upload share rises
+	DownloadShift  float64 `json:"downloadshift"`  // Flag when the upload share drops this much (0-1), 0 disables
+	DownloadAction string  `json:"downloadaction"` // Action when the upload share drops
+	MinBytes       int     `json:"minbytes"`       // Recent traffic (both directions) below this is always allowed
+	MinMinutes     int     `json:"minminutes"`     // Minutes of older traffic needed before comparing
+
+	sync.Mutex
+}
+
+// Initialise the ratio detector
+func InitRatio() {
+	RegisterDetector(&ratioDetector{UploadShift: 0.5, UploadAction: ACTION_REPORT, DownloadShift: 0.6,
+		DownloadAction: ACTION_REPORT, MinBytes: RECENT_TRAFFIC * PEAK_THRESHOLD, MinMinutes: TIME_REPORTING}, true)
+}
+
+func (d *ratioDetector) Name() string {
+	return "ratio"
+}
+
+func (d *ratioDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	return json.Unmarshal(config, d)
+}
+
+func (d *ratioDetector) AnalyseTraffic(deviceid int, minute time.Time) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+
+	recentSent, recentRecv, oldSent, oldRecv, oldMinutes := 0, 0, 0, 0, 0
+	TrafficHistory.RLock()
+	node, exists := TrafficHistory.h[deviceid]
+	if !exists {
+		TrafficHistory.RUnlock()
+		return nil
+	}
+	for k, v := range node.Datapoints {
+		if k.After(minute) {
+			continue
+		}
+		if minute.Sub(k).Minutes() < RECENT_TRAFFIC {
+			recentSent += v.BytesSent
+			recentRecv += v.BytesReceived
+		} else {
+			oldSent += v.BytesSent
+			oldRecv += v.BytesReceived
+			oldMinutes++
+		}
+	}
+	TrafficHistory.RUnlock()
+
+	if oldMinutes < d.MinMinutes || oldSent+oldRecv == 0 || recentSent+recentRecv < d.MinBytes {
+		return nil
+	}
+	normal := float64(oldSent) / float64(oldSent+oldRecv)
+	share := float64(recentSent) / float64(recentSent+recentRecv)
+	shift := share - normal
+
+	reason := fmt.Sprintf("upload share %.0f%% of %v bytes in the last %v minutes, normally %.0f%%",
+		share*100, recentSent+recentRecv, RECENT_TRAFFIC, normal*100)
+	switch {
+	case d.UploadShift > 0 && shift > d.UploadShift:
+		return []Verdict{{Detector: d.Name(), Deviceid: deviceid, Score: 1, Action: d.UploadAction,
+			Reason: "uploading: " + reason}}
+	case d.DownloadShift > 0 && -shift > d.DownloadShift:
+		return []Verdict{{Detector: d.Name(), Deviceid: deviceid, Score: 1, Action: d.DownloadAction,
+			Reason: "downloading: " + reason}}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRatioDetector(t *testing.T) {
+	minute := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	balanced := Datapoint{BytesSent: 1000, BytesReceived: 1000}
+	d := &ratioDetector{UploadShift: 0.3, UploadAction: ACTION_BLOCK_DEVICE, DownloadShift: 0.3,
+		DownloadAction: ACTION_REPORT, MinBytes: 10000, MinMinutes: 30}
+	tests := []struct {
+		name    string
+		minutes int
+		recent  Datapoint
+		action  string
+	}{
+		{"unchanged", 60, Datapoint{BytesSent: 5000, BytesReceived: 5000}, ""},
+		{"uploading", 60, Datapoint{BytesSent: 9000, BytesReceived: 1000}, ACTION_BLOCK_DEVICE},
+		{"downloading", 60, Datapoint{BytesSent: 500, BytesReceived: 9500}, ACTION_REPORT},
+		{"too little recent traffic", 60, Datapoint{BytesSent: 1000}, ""},
+		{"too little history", 20, Datapoint{BytesSent: 9000, BytesReceived: 1000}, ""},
+	}
+	for _, tt := range tests {
+		setTraffic(t, 9002, trafficMinutes(minute, tt.minutes, balanced, RECENT_TRAFFIC, tt.recent))
+		verdicts := d.AnalyseTraffic(9002, minute)
+		action := ""
+		if len(verdicts) > 0 {
+			action = verdicts[0].Action
+		}
+		if action != tt.action {
+			t.Errorf("%v: got %v, want action %q", tt.name, verdicts, tt.action)
+		}
+	}
+}
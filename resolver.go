@@ -0,0 +1,218 @@
+/*
+ * Resolver bypass detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * SPIN only sees the DNS queries that go through the local resolver.
+ * Devices that use an external resolver (port 53), DNS-over-TLS (port 853)
+ * or DNS-over-HTTPS hide their lookups, which is what malware and some IoT
+ * firmware do. This detector spots flows to such resolvers, and keeps the
+ * resolver usage of every device, which is persisted. DoH providers are
+ * read from a local list (doh.txt by default), with a domain, ip address or
+ * prefix per line ('#' starts a comment).
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RESOLVER_DNS = "dns" // Plain DNS to an external resolver
+const RESOLVER_DOT = "dot" // DNS-over-TLS
+const RESOLVER_DOH = "doh" // DNS-over-HTTPS
+
+type ResolverUse struct {
+	Protocol  string    `json:"protocol"`  // dns, dot or doh
+	NodeId    int       `json:"nodeid"`    // SPIN identifier of the resolver
+	Port      int       `json:"port"`      // Remote port
+	Addresses []net.IP  `json:"addresses"` // Addresses of the resolver
+	Names     []string  `json:"names"`     // Names of the resolver, if resolved through the local resolver
+	Flows     int       `json:"flows"`     // Number of flows to the resolver
+	Firstseen time.Time `json:"firstseen"`
+	Lastseen  time.Time `json:"lastseen"`
+}
+
+// Resolver usage per device, per remote node and port
+type ResolverUsage map[int]map[string]*ResolverUse
+
+type resolverDetector struct {
+	DohList string `json:"dohlist"` // File with DoH providers
+	Block   bool   `json:"block"`   // Block external resolvers, instead of only reporting them
+
+	sync.Mutex
+	doh   []allowEntry
+	usage ResolverUsage
+}
+
+var resolvers = &resolverDetector{usage: ResolverUsage{}}
+
+// Initialise the resolver detector, with previously stored usage and a file of DoH providers
+func InitResolver(oldstate *ResolverUsage, dohlist string) {
+	if oldstate != nil && *oldstate != nil {
+		resolvers.usage = *oldstate
+	}
+	resolvers.DohList = dohlist
+	resolvers.loadDohList()
+	RegisterDetector(resolvers, true)
+	RegisterCommand("get_resolvers", handleGetResolvers)
+}
+
+// Returns a copy of the resolver usage of all devices, for persistence
+func ResolversState() ResolverUsage {
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	state := ResolverUsage{}
+	for deviceid, uses := range resolvers.usage {
+		state[deviceid] = map[string]*ResolverUse{}
+		for key, use := range uses {
+			u := *use
+			state[deviceid][key] = &u
+		}
+	}
+	return state
+}
+
+// Reloads the list of DoH providers
+func ReloadDohList() {
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	resolvers.loadDohList()
+}
+
+// Requires lock on resolverDetector
+func (d *resolverDetector) loadDohList() {
+	if d.DohList == "" {
+		d.doh = nil
+		return
+	}
+	doh, invalid, err := readEntryList(d.DohList)
+	if err != nil {
+		fmt.Println("RS: unable to load DoH providers:", err)
+		return
+	}
+	for _, line := range invalid {
+		fmt.Println("RS: ignoring invalid DoH provider", line)
+	}
+	d.doh = doh
+	fmt.Println("RS: loaded", len(doh), "DoH providers from", d.DohList)
+}
+
+func (d *resolverDetector) Name() string {
+	return "resolver"
+}
+
+func (d *resolverDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	dohlist := d.DohList
+	if err := json.Unmarshal(config, d); err != nil {
+		return err
+	}
+	if d.DohList != dohlist {
+		d.loadDohList()
+	}
+	return nil
+}
+
+// Requires lock on resolverDetector
+// Checks whether one of the names or addresses is a DoH provider
+func (d *resolverDetector) isDoh(names []string, ips []net.IP) bool {
+	return entriesMatch(d.doh, names, ips)
+}
+
+func (d *resolverDetector) AnalyseFlow(event FlowEvent) []Verdict {
+	flow := event.Flow
+	key := resolverKey(flow)
+	if !event.New {
+		// Only keep track of resolvers already seen
+		d.Lock()
+		if use, exists := d.usage[event.Deviceid][key]; exists {
+			use.Lastseen = event.Timestamp
+		}
+		d.Unlock()
+		return nil
+	}
+	if isLocalAddress(flow.RemoteIps) {
+		return nil
+	}
+
+	names := []string{}
+	if flow.RemotePort == 443 {
+		// requires lock on History, so obtain before locking
+		names = IPToName(event.Deviceid, flow.RemoteIps)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	protocol := ""
+	switch {
+	case flow.RemotePort == 53:
+		protocol = RESOLVER_DNS
+	case flow.RemotePort == 853:
+		protocol = RESOLVER_DOT
+	case flow.RemotePort == 443 && d.isDoh(names, flow.RemoteIps):
+		protocol = RESOLVER_DOH
+	default:
+		return nil
+	}
+
+	if d.usage[event.Deviceid] == nil {
+		d.usage[event.Deviceid] = map[string]*ResolverUse{}
+	}
+	use, exists := d.usage[event.Deviceid][key]
+	if !exists {
+		use = &ResolverUse{Firstseen: event.Timestamp}
+		d.usage[event.Deviceid][key] = use
+	}
+	use.Protocol, use.NodeId, use.Port, use.Addresses, use.Names = protocol, flow.NodeId, flow.RemotePort,
+		flow.RemoteIps, names
+	use.Flows++
+	use.Lastseen = event.Timestamp
+
+	evidence := names
+	for _, ip := range flow.RemoteIps {
+		evidence = append(evidence, ip.String())
+	}
+	verdict := Verdict{Detector: d.Name(), Deviceid: event.Deviceid, Score: 1, Action: ACTION_REPORT,
+		Reason:   fmt.Sprintf("bypasses the local resolver using %v to node %v", strings.ToUpper(protocol), flow.NodeId),
+		Evidence: evidence}
+	if d.Block {
+		verdict.Action, verdict.Remote = ACTION_BLOCK_REMOTE, flow.NodeId
+	}
+	return []Verdict{verdict}
+}
+
+// Key of the usage of a resolver: remote node and port
+func resolverKey(flow Flow) string {
+	return fmt.Sprintf("%v:%v", flow.NodeId, flow.RemotePort)
+}
+
+// Handles the get_resolvers command, replies with the external resolvers used per device
+func handleGetResolvers(argument json.RawMessage) {
+	resolvers.Lock()
+	usage := map[int][]ResolverUse{}
+	for deviceid, uses := range resolvers.usage {
+		for _, use := range uses {
+			usage[deviceid] = append(usage[deviceid], *use)
+		}
+	}
+	resolvers.Unlock()
+
+	// DeviceLabel requires lock on History, so obtain without holding the detector lock
+	result := []map[string]interface{}{}
+	for deviceid, uses := range usage {
+		sort.Slice(uses, func(i, j int) bool { return uses[i].Firstseen.Before(uses[j].Firstseen) })
+		result = append(result, map[string]interface{}{"deviceid": deviceid, "name": DeviceLabel(deviceid),
+			"resolvers": uses})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i]["deviceid"].(int) < result[j]["deviceid"].(int) })
+	publishResult("resolvers", "", result)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolverDetector(t *testing.T) {
+	doh, _ := parseAllowEntry("9.9.9.9")
+	d := &resolverDetector{doh: []allowEntry{doh}, usage: ResolverUsage{}}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	flow := func(ip string, port int) Flow {
+		return Flow{NodeId: 50 + port, RemotePort: port, RemoteIps: []net.IP{net.ParseIP(ip)}}
+	}
+	tests := []struct {
+		name     string
+		flow     Flow
+		isnew    bool
+		protocol string
+	}{
+		{"external DNS", flow("8.8.8.8", 53), true, RESOLVER_DNS},
+		{"DNS-over-TLS", flow("1.1.1.1", 853), true, RESOLVER_DOT},
+		{"DNS-over-HTTPS", flow("9.9.9.9", 443), true, RESOLVER_DOH},
+		{"HTTPS", flow("192.0.2.1", 443), true, ""},
+		{"local resolver", flow("192.168.1.1", 53), true, ""},
+		{"existing flow", flow("8.8.8.8", 53), false, ""},
+	}
+	for i, tt := range tests {
+		event := FlowEvent{SubFlow: SubFlow{Deviceid: 9005, Timestamp: start.Add(time.Duration(i) * time.Minute)},
+			New: tt.isnew, Flow: tt.flow}
+		verdicts := d.AnalyseFlow(event)
+		protocol := ""
+		if len(verdicts) > 0 {
+			protocol = d.usage[9005][resolverKey(tt.flow)].Protocol
+		}
+		if protocol != tt.protocol {
+			t.Errorf("%v: got %v (%v), want %q", tt.name, protocol, verdicts, tt.protocol)
+		}
+	}
+
+	// The second new flow to the same resolver is counted, and keeps the first time it was seen
+	d.AnalyseFlow(FlowEvent{SubFlow: SubFlow{Deviceid: 9005, Timestamp: start.Add(time.Hour)}, New: true,
+		Flow: flow("8.8.8.8", 53)})
+	use := d.usage[9005][resolverKey(flow("8.8.8.8", 53))]
+	if use.Flows != 2 || !use.Firstseen.Equal(start) || !use.Lastseen.Equal(start.Add(time.Hour)) {
+		t.Errorf("got %+v, want 2 flows from %v", use, start)
+	}
+}
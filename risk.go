@@ -0,0 +1,278 @@
+/*
+ * Device risk scores for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Every device gets a risk score between 0 and 100, the weighted sum of
+ * these factors (each between 0 and 1):
+ * - alerts: alerts of the device in the last RISK_WINDOW, by severity
+ * - detectors: the highest recent verdict scores of the detectors
+ * - reputation: contacted remote nodes on a local threat list, with a
+ *   domain, ip address or prefix per line ('#' starts a comment). Blocks of
+ *   the NMC itself do not count, as these would feed back into more blocks.
+ * - category: the prior risk of the device category (e.g. cameras)
+ * - newdest: share of traffic to destinations first seen after learning
+ * Scores are computed every RISK_INTERVAL, published with the device list,
+ * and can be used as a threshold for automatic blocks. The score of a new
+ * device is computed when it is needed before the next interval.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const RISK_INTERVAL = 5 * time.Minute   // Time between computations
+const RISK_WINDOW = 7 * 24 * time.Hour  // Alerts and verdicts in this window count
+const RISK_NEW_AFTER = NEWDEST_LEARNING // Destinations first seen this long after the device are new
+const RISK_ALERT_SCALE = 5.0            // Weighted number of alerts that gives a factor of 0.63
+const RISK_CATEGORY_UNKNOWN = 0.5       // Prior risk of devices without a category
+
+// Weights of the factors, these add up to 1
+var riskWeights = map[string]float64{"alerts": 0.3, "detectors": 0.25, "reputation": 0.15, "category": 0.1,
+	"newdest": 0.2}
+
+// Prior risk per device category
+var riskCategories = map[string]float64{"ip-camera": 0.8, "voice-assistant": 0.6, "smart-tv": 0.6,
+	"printer": 0.5, "phone": 0.3, "laptop": 0.3}
+
+type RiskFactor struct {
+	Name         string  `json:"name"`
+	Value        float64 `json:"value"`        // Between 0 and 1
+	Weight       float64 `json:"weight"`       // Weight of this factor
+	Contribution float64 `json:"contribution"` // Points this factor adds to the score
+	Explanation  string  `json:"explanation"`
+}
+
+type RiskScore struct {
+	Score   float64      `json:"score"` // Between 0 and 100
+	Factors []RiskFactor `json:"factors"`
+	Updated time.Time    `json:"updated"`
+}
+
+type verdictScore struct {
+	score float64
+	time  time.Time
+}
+
+var Risk = struct {
+	sync.RWMutex
+	scores   map[int]*RiskScore
+	verdicts map[int]map[string]verdictScore // Highest recent score per device and detector
+	minrisk  float64                         // Minimum risk score for automatic blocks
+	threats  []allowEntry                    // Domains and prefixes of known malicious remotes
+}{scores: map[int]*RiskScore{}, verdicts: map[int]map[string]verdictScore{}}
+
+// Initialise risk scores. Automatic blocks need a risk score of at least minrisk.
+// threatlist is an optional file with known malicious domains and addresses.
+func InitRisk(minrisk float64, threatlist string) {
+	threats := []allowEntry{}
+	if threatlist != "" {
+		entries, invalid, err := readEntryList(threatlist)
+		if err != nil {
+			fmt.Println("RI: unable to load threat list:", err)
+		}
+		for _, line := range invalid {
+			fmt.Println("RI: ignoring invalid threat", line)
+		}
+		threats = entries
+	}
+	Risk.Lock()
+	Risk.minrisk = minrisk
+	Risk.threats = threats
+	Risk.Unlock()
+	go func() {
+		for {
+			ComputeRisk()
+			clock.Sleep(RISK_INTERVAL)
+		}
+	}()
+}
+
+// Remembers the verdict scores of a device
+func RecordVerdicts(deviceid int, verdicts []Verdict) {
+	now := clock.Now()
+	Risk.Lock()
+	defer Risk.Unlock()
+	if Risk.verdicts[deviceid] == nil {
+		Risk.verdicts[deviceid] = map[string]verdictScore{}
+	}
+	for _, v := range verdicts {
+		last := Risk.verdicts[deviceid][v.Detector]
+		if v.Score >= last.score || now.Sub(last.time) > RISK_WINDOW {
+			Risk.verdicts[deviceid][v.Detector] = verdictScore{v.Score, now}
+		}
+	}
+}
+
+// Takes over the verdict scores of device from, the score is computed again at the next interval
+func RiskMerge(from int, into int) {
+	Risk.Lock()
+	defer Risk.Unlock()
+	if Risk.verdicts[into] == nil && Risk.verdicts[from] != nil {
+		Risk.verdicts[into] = map[string]verdictScore{}
+	}
+	for name, v := range Risk.verdicts[from] {
+		if v.score > Risk.verdicts[into][name].score {
+			Risk.verdicts[into][name] = v
+		}
+	}
+	delete(Risk.verdicts, from)
+	delete(Risk.scores, from)
+}
+
+// Computes the risk scores of all devices
+func ComputeRisk() {
+	now := clock.Now()
+
+	// Alerts per device, weighted by severity
+	alerts := map[int]float64{}
+	counts := map[int]int{}
+	for _, a := range AlertsState().Alerts {
+		if now.Sub(a.Lastseen) < RISK_WINDOW {
+			alerts[a.Device] += float64(alertSeverityLevel(a.Severity) * a.Count)
+			counts[a.Device] += a.Count
+		}
+	}
+
+	Risk.RLock()
+	threats := Risk.threats
+	Risk.RUnlock()
+
+	type deviceInput struct {
+		category        string
+		badnodes        int
+		newbytes, bytes int
+	}
+	inputs := map[int]deviceInput{}
+	History.RLock()
+	for id, dev := range History.m.Devices {
+		in := deviceInput{}
+		if dev.Class != nil {
+			in.category = dev.Class.Category
+		}
+		bad := map[int]bool{}
+		for _, flow := range dev.Flows {
+			if flow.NodeId != id && !bad[flow.NodeId] && entriesMatch(threats, flowNames(dev, flow), flow.RemoteIps) {
+				bad[flow.NodeId] = true
+			}
+			bytes := flow.BytesSent + flow.BytesReceived
+			in.bytes += bytes
+			if !dev.Firstseen.IsZero() && flow.FirstActivity.Sub(dev.Firstseen) > RISK_NEW_AFTER {
+				in.newbytes += bytes
+			}
+		}
+		in.badnodes = len(bad)
+		inputs[id] = in
+	}
+	History.RUnlock()
+
+	Risk.Lock()
+	defer Risk.Unlock()
+	for id := range Risk.verdicts {
+		if _, exists := inputs[id]; !exists {
+			delete(Risk.verdicts, id)
+		}
+	}
+	scores := map[int]*RiskScore{}
+	for id, in := range inputs {
+		factors := []RiskFactor{}
+		add := func(name string, value float64, explanation string) {
+			w := riskWeights[name]
+			factors = append(factors, RiskFactor{Name: name, Value: value, Weight: w,
+				Contribution: 100 * w * value, Explanation: explanation})
+		}
+
+		add("alerts", 1-math.Exp(-alerts[id]/RISK_ALERT_SCALE),
+			fmt.Sprintf("%v alerts in the last %v", counts[id], RISK_WINDOW))
+
+		normal, detectors := 1.0, []string{}
+		for name, v := range Risk.verdicts[id] {
+			if now.Sub(v.time) < RISK_WINDOW && v.score > 0 {
+				normal *= 1 - v.score
+				detectors = append(detectors, fmt.Sprintf("%v %.2f", name, v.score))
+			}
+		}
+		add("detectors", 1-normal, fmt.Sprintf("recent verdict scores %v", detectors))
+
+		add("reputation", 1-math.Exp(-float64(in.badnodes)),
+			fmt.Sprintf("contacted %v nodes on the threat list", in.badnodes))
+
+		prior, known := riskCategories[in.category]
+		if !known {
+			prior = RISK_CATEGORY_UNKNOWN
+		}
+		add("category", prior, fmt.Sprintf("category %q", in.category))
+
+		share := 0.0
+		if in.bytes > 0 {
+			share = float64(in.newbytes) / float64(in.bytes)
+		}
+		add("newdest", share, fmt.Sprintf("%.0f%% of traffic to destinations first seen after %v", 100*share,
+			RISK_NEW_AFTER))
+
+		score := &RiskScore{Factors: factors, Updated: now}
+		for _, f := range factors {
+			score.Score += f.Contribution
+		}
+		scores[id] = score
+	}
+	Risk.scores = scores
+}
+
+// Returns the names a device resolved for the addresses of a flow
+func flowNames(dev Device, flow Flow) []string {
+	names := []string{}
+	for name, ips := range dev.Resolved {
+		for _, ip := range ips {
+			if containsIP(flow.RemoteIps, ip) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Returns the risk score of a device, or nil if not computed yet
+func DeviceRisk(deviceid int) *RiskScore {
+	Risk.RLock()
+	defer Risk.RUnlock()
+	score, exists := Risk.scores[deviceid]
+	if !exists {
+		return nil
+	}
+	res := *score
+	return &res
+}
+
+// Checks whether a device is risky enough for automatic blocks
+func RiskAllowsBlock(deviceid int) (bool, string) {
+	Risk.RLock()
+	minrisk := Risk.minrisk
+	Risk.RUnlock()
+	if p := DevicePolicy(deviceid); p.MinRisk != nil {
+		minrisk = *p.MinRisk
+	}
+	if minrisk <= 0 {
+		return true, ""
+	}
+	score := DeviceRisk(deviceid)
+	if score == nil {
+		// New device, compute now instead of waiting for the next interval
+		ComputeRisk()
+		score = DeviceRisk(deviceid)
+	}
+	if score == nil {
+		return false, "no risk score, unknown device"
+	}
+	if score.Score < minrisk {
+		return false, fmt.Sprintf("risk score %.0f below %v", score.Score, minrisk)
+	}
+	return true, ""
+}
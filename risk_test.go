@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestComputeRisk(t *testing.T) {
+	c := &ManualClock{}
+	c.Set(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	SetClock(c)
+	defer SetClock(systemClock{})
+	resetAlerts()
+
+	bad, good := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1")
+	entry, _ := parseAllowEntry("evil.example")
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{Class: &DeviceClass{Category: "ip-camera"},
+		Resolved: map[string][]net.IP{"cdn.evil.example": {bad}, "good.example": {good}},
+		Flows:    []Flow{{NodeId: 42, RemoteIps: []net.IP{bad}}, {NodeId: 43, RemoteIps: []net.IP{good}}}}
+	History.m.Devices[9002] = Device{Flows: []Flow{{NodeId: 43, RemoteIps: []net.IP{good}}}}
+	History.Unlock()
+	Risk.Lock()
+	Risk.threats, Risk.scores, Risk.verdicts = []allowEntry{entry}, map[int]*RiskScore{},
+		map[int]map[string]verdictScore{}
+	Risk.minrisk = 20
+	Risk.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		delete(History.m.Devices, 9002)
+		History.Unlock()
+		Risk.Lock()
+		Risk.threats, Risk.scores, Risk.verdicts = nil, map[int]*RiskScore{}, map[int]map[string]verdictScore{}
+		Risk.minrisk = 0
+		Risk.Unlock()
+	}()
+	RecordVerdicts(9001, []Verdict{{Detector: "dga", Score: 0.5}, {Detector: "scan", Score: 0.5}})
+	RecordVerdicts(9999, []Verdict{{Detector: "dga", Score: 0.5}}) // device that is gone
+
+	// Computed on demand for a device without a score
+	if ok, why := RiskAllowsBlock(9001); !ok {
+		t.Errorf("device 9001: block not allowed (%v)", why)
+	}
+	if ok, _ := RiskAllowsBlock(9002); ok {
+		t.Error("device 9002: block allowed below the minimum risk")
+	}
+
+	tests := []struct {
+		device int
+		factor string
+		value  float64
+	}{
+		{9001, "reputation", 1 - math.Exp(-1)},
+		{9001, "category", riskCategories["ip-camera"]},
+		{9001, "detectors", 0.75},
+		{9002, "reputation", 0},
+		{9002, "category", RISK_CATEGORY_UNKNOWN},
+		{9002, "detectors", 0},
+	}
+	for _, tt := range tests {
+		score := DeviceRisk(tt.device)
+		if score == nil {
+			t.Fatalf("device %v: no risk score", tt.device)
+		}
+		found := false
+		for _, f := range score.Factors {
+			if f.Name == tt.factor {
+				found = true
+				if math.Abs(f.Value-tt.value) > 1e-9 {
+					t.Errorf("device %v: %v is %v (%v), want %v", tt.device, f.Name, f.Value, f.Explanation, tt.value)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("device %v: no %v factor", tt.device, tt.factor)
+		}
+	}
+
+	Risk.RLock()
+	_, kept := Risk.verdicts[9999]
+	Risk.RUnlock()
+	if kept {
+		t.Error("verdicts of a device that is gone are kept")
+	}
+}
+
+func TestRiskWeights(t *testing.T) {
+	sum := 0.0
+	for _, w := range riskWeights {
+		sum += w
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("weights add up to %v, want 1", sum)
+	}
+}
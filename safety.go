@@ -0,0 +1,171 @@
+/*
+ * Safety rails for automated blocking in SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * A bug in a threshold should not block every device in the house. Before
+ * the NMC blocks a node, these rails are checked:
+ * - protected devices (by MAC address or name) are never blocked
+ * - the circuit breaker: when more than SAFETY_BREAKER_DEVICES devices trip
+ *   within SAFETY_BREAKER_WINDOW, all enforcement switches to report-only
+ *   until it is reset (reset_breaker) or SAFETY_BREAKER_COOLDOWN has passed
+ * - a global rate limit on the number of blocks per hour
+ * - dry-run mode, which logs the intended commands instead of sending them
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SAFETY_BREAKER_DEVICES = 3               // Trip the breaker when more devices than this trip at once
+const SAFETY_BREAKER_WINDOW = 10 * time.Minute // Devices that trip within this window trip at once
+const SAFETY_BREAKER_COOLDOWN = 6 * time.Hour  // The breaker closes again after this long
+
+var Safety = struct {
+	sync.Mutex
+	protected []string          // MAC addresses and names of protected devices
+	maxblocks int               // Maximum number of blocks per hour, 0 is unlimited
+	dryrun    bool              // Log commands instead of sending them
+	blocks    []time.Time       // Blocks in the last hour
+	trips     map[int]time.Time // Last time a device tripped, within the breaker window
+	breaker   time.Time         // Time the breaker tripped, zero if closed
+}{trips: map[int]time.Time{}}
+
+// Initialise the safety rails. protected is a comma separated list of MAC addresses or names.
+func InitSafety(protected string, maxblocks int, dryrun bool) {
+	Safety.Lock()
+	for _, p := range strings.Split(protected, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			Safety.protected = append(Safety.protected, strings.ToLower(p))
+		}
+	}
+	Safety.maxblocks = maxblocks
+	Safety.dryrun = dryrun
+	Safety.Unlock()
+	if dryrun {
+		fmt.Println("SF: dry-run mode, no commands are sent to SPIN")
+	}
+
+	RegisterCommand("get_safety", handleGetSafety)
+	RegisterCommand("reset_breaker", handleResetBreaker)
+}
+
+// Checks whether a node is a protected device
+func isProtected(node int) bool {
+	History.RLock()
+	dev, exists := History.m.Devices[node]
+	History.RUnlock()
+	if !exists {
+		return false
+	}
+	Safety.Lock()
+	defer Safety.Unlock()
+	for _, p := range Safety.protected {
+		if deviceMatches(dev, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks all safety rails before a node is blocked on behalf of a device.
+// Returns whether the block may be sent, and why not.
+func AllowBlock(node int, device int) (bool, string) {
+	if isProtected(node) {
+		return false, "protected device"
+	}
+
+	now := clock.Now()
+	Safety.Lock()
+	defer Safety.Unlock()
+
+	// Circuit breaker
+	Safety.trips[device] = now
+	for d, t := range Safety.trips {
+		if now.Sub(t) > SAFETY_BREAKER_WINDOW {
+			delete(Safety.trips, d)
+		}
+	}
+	if !Safety.breaker.IsZero() && now.Sub(Safety.breaker) > SAFETY_BREAKER_COOLDOWN {
+		Safety.breaker = time.Time{}
+		fmt.Println("SF: circuit breaker closed after cooldown, enforcing again")
+	}
+	if Safety.breaker.IsZero() && len(Safety.trips) > SAFETY_BREAKER_DEVICES {
+		Safety.breaker = now
+		fmt.Println("SF: circuit breaker tripped,", len(Safety.trips), "devices tripped within",
+			SAFETY_BREAKER_WINDOW, ", switching to report-only")
+	}
+	if !Safety.breaker.IsZero() {
+		return false, "circuit breaker tripped, report-only"
+	}
+
+	// Rate limit
+	recent := []time.Time{}
+	for _, t := range Safety.blocks {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	Safety.blocks = recent
+	if Safety.maxblocks > 0 && len(recent) >= Safety.maxblocks {
+		return false, fmt.Sprintf("rate limit of %v blocks per hour reached", Safety.maxblocks)
+	}
+
+	if Safety.dryrun {
+		return false, fmt.Sprintf("dry-run, would send %v %v", SPIN_CMD_ADD_BLOCK, node)
+	}
+	Safety.blocks = append(Safety.blocks, now)
+	return true, ""
+}
+
+// Sends an enforcement command to SPIN, or only logs it in dry-run mode
+func SendEnforcement(command SPINcommand) {
+	Safety.Lock()
+	dryrun := Safety.dryrun
+	Safety.Unlock()
+	if dryrun {
+		fmt.Println("SF: dry-run, would send", command.Command, command.Argument)
+		return
+	}
+	BrokerSendCommand(command)
+}
+
+// Handles the get_safety command, replies with the state of the safety rails
+func handleGetSafety(argument json.RawMessage) {
+	Safety.Lock()
+	now := clock.Now()
+	recent := 0
+	for _, t := range Safety.blocks {
+		if now.Sub(t) < time.Hour {
+			recent++
+		}
+	}
+	result := map[string]interface{}{
+		"protected":      Safety.protected,
+		"maxblocks":      Safety.maxblocks,
+		"blockslasthour": recent,
+		"dryrun":         Safety.dryrun,
+		"breaker":        !Safety.breaker.IsZero(),
+		"breakersince":   Safety.breaker,
+	}
+	Safety.Unlock()
+	publishResult("safety", "", result)
+}
+
+// Handles the reset_breaker command, closes the circuit breaker
+func handleResetBreaker(argument json.RawMessage) {
+	Safety.Lock()
+	defer Safety.Unlock()
+	if !Safety.breaker.IsZero() {
+		Safety.breaker = time.Time{}
+		Safety.trips = map[int]time.Time{}
+		fmt.Println("SF: circuit breaker reset, enforcing again")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Resets the safety rails for a test
+func resetSafety(protected []string, maxblocks int, dryrun bool) {
+	Safety.Lock()
+	Safety.protected, Safety.maxblocks, Safety.dryrun = protected, maxblocks, dryrun
+	Safety.blocks, Safety.trips, Safety.breaker = nil, map[int]time.Time{}, time.Time{}
+	Safety.Unlock()
+}
+
+func TestAllowBlockProtected(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	History.Lock()
+	if History.m.Devices == nil {
+		History.m.Devices = map[int]Device{}
+	}
+	History.m.Devices[9001] = Device{Name: "Thermostat"}
+	History.m.Devices[9002] = Device{Name: "camera", Mac: mac}
+	History.Unlock()
+	defer func() {
+		History.Lock()
+		delete(History.m.Devices, 9001)
+		delete(History.m.Devices, 9002)
+		History.Unlock()
+	}()
+	resetSafety([]string{"thermostat", "00:11:22:33:44:55"}, 0, false)
+	defer resetSafety(nil, 0, false)
+
+	tests := []struct {
+		node  int
+		allow bool
+	}{
+		{9001, false}, // by name
+		{9002, false}, // by MAC address
+		{9003, true},  // unknown device
+	}
+	for _, tt := range tests {
+		if allow, reason := AllowBlock(tt.node, tt.node); allow != tt.allow {
+			t.Errorf("node %v: allow %v (%v), want %v", tt.node, allow, reason, tt.allow)
+		}
+	}
+}
+
+func TestAllowBlockRails(t *testing.T) {
+	c := &ManualClock{}
+	SetClock(c)
+	defer SetClock(systemClock{})
+	defer resetSafety(nil, 0, false)
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	type attempt struct {
+		after  time.Duration // since the start of the test
+		device int
+		allow  bool
+	}
+	tests := []struct {
+		name      string
+		maxblocks int
+		dryrun    bool
+		attempts  []attempt
+	}{
+		{"breaker trips", 0, false, []attempt{
+			{0, 9001, true}, {time.Minute, 9002, true}, {2 * time.Minute, 9003, true},
+			{3 * time.Minute, 9004, false}, {4 * time.Minute, 9001, false}}},
+		{"trips spread out", 0, false, []attempt{
+			{0, 9001, true}, {SAFETY_BREAKER_WINDOW, 9002, true}, {2 * SAFETY_BREAKER_WINDOW, 9003, true},
+			{3 * SAFETY_BREAKER_WINDOW, 9004, true}, {4 * SAFETY_BREAKER_WINDOW, 9005, true}}},
+		{"breaker cools down", 0, false, []attempt{
+			{0, 9001, true}, {0, 9002, true}, {0, 9003, true}, {0, 9004, false},
+			{SAFETY_BREAKER_COOLDOWN + time.Minute, 9001, true}}},
+		{"rate limit", 2, false, []attempt{
+			{0, 9001, true}, {SAFETY_BREAKER_WINDOW + time.Minute, 9001, true},
+			{2 * (SAFETY_BREAKER_WINDOW + time.Minute), 9001, false}, {time.Hour + time.Minute, 9001, true}}},
+		{"dry-run", 0, true, []attempt{{0, 9001, false}}},
+	}
+	for _, tt := range tests {
+		resetSafety(nil, tt.maxblocks, tt.dryrun)
+		for i, a := range tt.attempts {
+			c.Set(start.Add(a.after))
+			if allow, reason := AllowBlock(a.device, a.device); allow != a.allow {
+				t.Errorf("%v, attempt %v: allow %v (%v), want %v", tt.name, i+1, allow, reason, a.allow)
+			}
+		}
+	}
+}
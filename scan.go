@@ -0,0 +1,192 @@
+/*
+ * Fan-out and scanning detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Infected devices (Mirai and friends) scan for new victims: they contact
+ * hundreds of hosts on telnet or ssh within minutes, while sending very
+ * little data. This detector keeps the new flows of every device in a
+ * sliding window, and counts:
+ * - horizontal scans: distinct hosts on a single port
+ * - vertical scans: distinct ports on a single host
+ * - fan-out: distinct hosts on any port
+ * Commonly scanned ports and hosts in the local network have lower limits.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A new flow of a device
+type scanContact struct {
+	time time.Time
+	node int  // SPIN identifier of the remote node
+	port int  // Remote port
+	lan  bool // Remote node is in the local network
+}
+
+type scanDetector struct {
+	Window          int    `json:"window"`          // Length of the sliding window, in seconds
+	HorizontalHosts int    `json:"horizontalhosts"` // Maximum distinct hosts on a single port
+	SuspectPorts    []int  `json:"suspectports"`    // Commonly scanned ports
+	SuspectHosts    int    `json:"suspecthosts"`    // Maximum distinct hosts on a single suspect port
+	LanHosts        int    `json:"lanhosts"`        // Maximum distinct local hosts on a single port
+	VerticalPorts   int    `json:"verticalports"`   // Maximum distinct ports on a single host
+	FanOut          int    `json:"fanout"`          // Maximum distinct hosts on any port
+	Action          string `json:"action"`          // Action on a scan
+
+	sync.Mutex
+	contacts map[int][]scanContact // New flows in the window, per device
+	flagged  map[int]time.Time     // Last scan verdict per device, to report a scan only once per window
+	expired  time.Time             // Last check for idle devices
+}
+
+// Initialise the scan detector
+func InitScan() {
+	RegisterDetector(&scanDetector{Window: 300, HorizontalHosts: 100, SuspectPorts: []int{22, 23, 2323, 5555, 7547},
+		SuspectHosts: 20, LanHosts: 10, VerticalPorts: 50, FanOut: 250, Action: ACTION_BLOCK_DEVICE,
+		contacts: map[int][]scanContact{}, flagged: map[int]time.Time{}}, true)
+}
+
+func (d *scanDetector) Name() string {
+	return "scan"
+}
+
+func (d *scanDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	return json.Unmarshal(config, d)
+}
+
+func (d *scanDetector) AnalyseFlow(event FlowEvent) []Verdict {
+	if !event.New {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	window := time.Duration(d.Window) * time.Second
+	now := event.Timestamp
+	if now.Sub(d.expired) > window {
+		d.expired = now
+		d.expire(now, window)
+	}
+	// Flows are not always reported in order, so filter on time instead of cutting off the oldest
+	contacts := inWindow(d.contacts[event.Deviceid], now, window)
+	contacts = append(contacts, scanContact{time: now, node: event.Flow.NodeId,
+		port: event.Flow.RemotePort, lan: isLocalAddress(event.Flow.RemoteIps)})
+	d.contacts[event.Deviceid] = contacts
+
+	if last, exists := d.flagged[event.Deviceid]; exists && now.Sub(last) < window {
+		return nil
+	}
+	reason, evidence := d.findScan(contacts)
+	if reason == "" {
+		return nil
+	}
+	d.flagged[event.Deviceid] = now
+	return []Verdict{{Detector: d.Name(), Deviceid: event.Deviceid, Score: 1, Action: d.Action,
+		Reason: fmt.Sprintf("%v in %v", reason, window), Evidence: evidence}}
+}
+
+// Requires lock on scanDetector
+// Forgets the contacts and verdicts of devices without new flows in the window
+func (d *scanDetector) expire(now time.Time, window time.Duration) {
+	for id, contacts := range d.contacts {
+		if contacts = inWindow(contacts, now, window); len(contacts) == 0 {
+			delete(d.contacts, id)
+		} else {
+			d.contacts[id] = contacts
+		}
+	}
+	for id, last := range d.flagged {
+		if now.Sub(last) >= window {
+			delete(d.flagged, id)
+		}
+	}
+}
+
+// Returns the contacts at most a window before now, reusing the list
+func inWindow(contacts []scanContact, now time.Time, window time.Duration) []scanContact {
+	res := contacts[:0]
+	for _, c := range contacts {
+		if now.Sub(c.time) <= window {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Requires lock on scanDetector
+// Returns a description of the scan in a list of contacts, or an empty string, and the
+// scanned port or node as evidence, so scans of several devices can be correlated
+func (d *scanDetector) findScan(contacts []scanContact) (string, []string) {
+	hostsPerPort := map[int]map[int]bool{}
+	lanHostsPerPort := map[int]map[int]bool{}
+	portsPerHost := map[int]map[int]bool{}
+	hosts := map[int]bool{}
+	for _, c := range contacts {
+		if hostsPerPort[c.port] == nil {
+			hostsPerPort[c.port], lanHostsPerPort[c.port] = map[int]bool{}, map[int]bool{}
+		}
+		hostsPerPort[c.port][c.node] = true
+		if c.lan {
+			lanHostsPerPort[c.port][c.node] = true
+		}
+		if portsPerHost[c.node] == nil {
+			portsPerHost[c.node] = map[int]bool{}
+		}
+		portsPerHost[c.node][c.port] = true
+		hosts[c.node] = true
+	}
+
+	for port, h := range hostsPerPort {
+		limit := d.HorizontalHosts
+		if d.isSuspectPort(port) {
+			limit = d.SuspectHosts
+		}
+		if limit > 0 && len(h) > limit {
+			return fmt.Sprintf("horizontal scan of port %v: %v hosts", port, len(h)), []string{fmt.Sprintf("port %v", port)}
+		}
+		if d.LanHosts > 0 && len(lanHostsPerPort[port]) > d.LanHosts {
+			return fmt.Sprintf("horizontal scan of port %v in the local network: %v hosts", port,
+				len(lanHostsPerPort[port])), []string{fmt.Sprintf("port %v", port)}
+		}
+	}
+	for node, p := range portsPerHost {
+		if d.VerticalPorts > 0 && len(p) > d.VerticalPorts {
+			return fmt.Sprintf("vertical scan of node %v: %v ports", node, len(p)), []string{fmt.Sprintf("node %v", node)}
+		}
+	}
+	if d.FanOut > 0 && len(hosts) > d.FanOut {
+		return fmt.Sprintf("fan-out to %v hosts", len(hosts)), nil
+	}
+	return "", nil
+}
+
+// Requires lock on scanDetector
+func (d *scanDetector) isSuspectPort(port int) bool {
+	for _, p := range d.SuspectPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether one of the addresses is in the local network
+func isLocalAddress(ips []net.IP) bool {
+	for _, ip := range ips {
+		if ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindScan(t *testing.T) {
+	d := &scanDetector{HorizontalHosts: 100, SuspectPorts: []int{23}, SuspectHosts: 20, LanHosts: 10,
+		VerticalPorts: 50, FanOut: 250}
+	contacts := func(hosts int, ports int, port int, lan bool) []scanContact {
+		res := []scanContact{}
+		for h := 0; h < hosts; h++ {
+			for p := 0; p < ports; p++ {
+				res = append(res, scanContact{node: 1000 + h, port: port + p, lan: lan})
+			}
+		}
+		return res
+	}
+	// 251 distinct hosts over several ports, below the limit on every single port
+	fanout := []scanContact{}
+	for h := 0; h < 251; h++ {
+		fanout = append(fanout, scanContact{node: h, port: 1000 + h%3})
+	}
+	tests := []struct {
+		name     string
+		contacts []scanContact
+		want     string
+		evidence string
+	}{
+		{"nothing", nil, "", ""},
+		{"a few hosts", contacts(10, 1, 443, false), "", ""},
+		{"horizontal", contacts(101, 1, 443, false), "horizontal scan of port 443", "port 443"},
+		{"suspect port", contacts(21, 1, 23, false), "horizontal scan of port 23", "port 23"},
+		{"local network", contacts(11, 1, 80, true), "in the local network", "port 80"},
+		{"vertical", contacts(1, 51, 1, false), "vertical scan", "node 1000"},
+		{"same hosts on a few ports", contacts(99, 3, 443, false), "", ""},
+		{"fan-out", fanout, "fan-out to 251 hosts", ""},
+	}
+
+	for _, tt := range tests {
+		got, evidence := d.findScan(tt.contacts)
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+		if strings.Join(evidence, ",") != tt.evidence {
+			t.Errorf("%v: evidence %q, want %q", tt.name, evidence, tt.evidence)
+		}
+	}
+}
+
+func TestIsLocalAddress(t *testing.T) {
+	tests := []struct {
+		ips  []string
+		want bool
+	}{
+		{[]string{"192.168.1.1"}, true},
+		{[]string{"fe80::1"}, true},
+		{[]string{"192.0.2.1", "10.0.0.1"}, true},
+		{[]string{"192.0.2.1"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		ips := []net.IP{}
+		for _, s := range tt.ips {
+			ips = append(ips, net.ParseIP(s))
+		}
+		if got := isLocalAddress(ips); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.ips, got, tt.want)
+		}
+	}
+}
+
+func TestScanWindow(t *testing.T) {
+	d := &scanDetector{Window: 300, HorizontalHosts: 100, contacts: map[int][]scanContact{},
+		flagged: map[int]time.Time{}}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	flow := func(deviceid int, seconds int, node int) {
+		d.AnalyseFlow(FlowEvent{SubFlow: SubFlow{Deviceid: deviceid, Timestamp: start.Add(time.Duration(seconds) *
+			time.Second)}, Flow: Flow{NodeId: node, RemotePort: 443}, New: true})
+	}
+	// The flow of the first second is reported late, and has to leave the window before the flow reported before it
+	flow(9001, 200, 1)
+	flow(9001, 0, 2)
+	flow(9002, 0, 3)
+	d.flagged[9002] = start
+	flow(9001, 400, 4)
+
+	d.Lock()
+	nodes := []int{}
+	for _, c := range d.contacts[9001] {
+		nodes = append(nodes, c.node)
+	}
+	d.Unlock()
+	if len(nodes) != 2 || nodes[0] != 1 || nodes[1] != 4 {
+		t.Errorf("contacts of nodes %v in the window, want [1 4]", nodes)
+	}
+
+	// Devices without flows in the window are forgotten
+	flow(9001, 700, 5)
+	d.Lock()
+	defer d.Unlock()
+	if _, exists := d.contacts[9002]; exists {
+		t.Errorf("contacts of an idle device kept")
+	}
+	if _, exists := d.flagged[9002]; exists {
+		t.Errorf("verdict of an idle device kept")
+	}
+	if len(d.contacts[9001]) != 2 {
+		t.Errorf("%v contacts in the window, want 2", len(d.contacts[9001]))
+	}
+}
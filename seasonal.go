@@ -0,0 +1,169 @@
+/*
+ * Seasonal baseline detection for SPIN-NMC
+ * Made by SIDN Labs (sidnlabs@sidn.nl)
+ */
+
+/*
+ * Household traffic is seasonal: the TV streams every evening, backups run
+ * at night. This detector models the expected outgoing traffic of every
+ * device per hour of the week (168 slots, in local time), using quantiles
+ * of all minutes in that slot. Minutes without traffic count as zero, so a
+ * device that is normally silent at night has a low expected value then.
+ * A minute is anomalous when it exceeds factor times the expected value
+ * (the configured quantile) of its slot.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const SEASONAL_SLOTS = 7 * 24             // Hour-of-week slots
+const SEASONAL_REFRESH = time.Hour        // Time after which the model is computed again
+const SEASONAL_MIN_BYTES = 10 * 1024 * 60 // 10 Kbit/sec (over a minute interval) is always allowed
+const SEASONAL_MINUTES_PER_SLOT = 60      // Minutes in a slot, per week
+
+type slotModel struct {
+	Minutes  int     `json:"minutes"`  // Number of minutes observed in this slot, including silent ones
+	Median   float64 `json:"median"`   // Median bytes sent per minute
+	Expected float64 `json:"expected"` // Configured quantile of bytes sent per minute
+}
+
+type seasonalModel struct {
+	computed time.Time
+	slots    [SEASONAL_SLOTS]slotModel
+}
+
+type seasonalDetector struct {
+	Quantile float64 `json:"quantile"` // Quantile (0-100) of a slot that is the expected value
+	Factor   float64 `json:"factor"`   // Flag minutes above factor times the expected value
+	MinWeeks float64 `json:"minweeks"` // Slots with less history (in weeks) are ignored
+	MinBytes int     `json:"minbytes"` // Traffic (per minute) below this is always allowed
+	Action   string  `json:"action"`   // Action on an anomalous minute
+
+	sync.Mutex
+	models map[int]*seasonalModel
+}
+
+// Initialise the seasonal detector
+func InitSeasonal() {
+	RegisterDetector(&seasonalDetector{Quantile: 95, Factor: 2, MinWeeks: 2, MinBytes: SEASONAL_MIN_BYTES,
+		Action: ACTION_REPORT, models: map[int]*seasonalModel{}}, true)
+}
+
+// Returns the hour-of-week slot of a moment, in local time. Monday 00:00-01:00 is slot 0.
+func weekSlot(t time.Time) int {
+	t = t.In(time.Local)
+	return ((int(t.Weekday())+6)%7)*24 + t.Hour()
+}
+
+func (d *seasonalDetector) Name() string {
+	return "seasonal"
+}
+
+func (d *seasonalDetector) Configure(config json.RawMessage) error {
+	d.Lock()
+	defer d.Unlock()
+	if err := json.Unmarshal(config, d); err != nil {
+		return err
+	}
+	d.models = map[int]*seasonalModel{} // quantile may have changed
+	return nil
+}
+
+func (d *seasonalDetector) AnalyseTraffic(deviceid int, minute time.Time) []Verdict {
+	d.Lock()
+	defer d.Unlock()
+
+	TrafficHistory.RLock()
+	node, exists := TrafficHistory.h[deviceid]
+	if !exists || node.Datapoints[minute] == nil {
+		TrafficHistory.RUnlock()
+		return nil
+	}
+	current := node.Datapoints[minute].BytesSent
+	m := d.models[deviceid]
+	if m == nil || clock.Now().Sub(m.computed) > SEASONAL_REFRESH {
+		m = d.computeModel(node.Datapoints, minute)
+		d.models[deviceid] = m
+	}
+	TrafficHistory.RUnlock()
+
+	slot := m.slots[weekSlot(minute)]
+	if current < d.MinBytes || float64(slot.Minutes) < d.MinWeeks*SEASONAL_MINUTES_PER_SLOT {
+		return nil
+	}
+	limit := d.Factor * slot.Expected
+	if float64(current) <= limit {
+		return nil
+	}
+
+	reason := fmt.Sprintf("%v bytes at %v, expected up to %.0f (median %.0f, limit %.0f)", current,
+		minute.In(time.Local).Format("Mon 15:04"), slot.Expected, slot.Median, limit)
+	return []Verdict{{Detector: d.Name(), Deviceid: deviceid, Score: 1, Reason: reason, Action: d.Action}}
+}
+
+// Models are computed from the merged datapoints again
+func (d *seasonalDetector) MergeDevice(from int, into int) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.models, from)
+	delete(d.models, into)
+}
+
+// Requires lock on seasonalDetector and read lock on TrafficHistory
+// Computes the model of all slots, leaving out the current minute
+func (d *seasonalDetector) computeModel(dps map[time.Time]*Datapoint, current time.Time) *seasonalModel {
+	m := &seasonalModel{computed: clock.Now()}
+
+	// Collect traffic per slot, and find the first minute of history
+	values := [SEASONAL_SLOTS][]float64{}
+	first := current
+	for t, dp := range dps {
+		if !t.Before(current) {
+			continue
+		}
+		slot := weekSlot(t)
+		values[slot] = append(values[slot], float64(dp.BytesSent))
+		if t.Before(first) {
+			first = t
+		}
+	}
+
+	// Count all minutes per slot between first and current, silent minutes are zero
+	minutes := [SEASONAL_SLOTS]int{}
+	for t := first; t.Before(current); t = t.Add(time.Hour) {
+		minutes[weekSlot(t)] += SEASONAL_MINUTES_PER_SLOT
+	}
+
+	for slot := range m.slots {
+		sort.Float64s(values[slot])
+		n := minutes[slot]
+		if n < len(values[slot]) {
+			n = len(values[slot])
+		}
+		zeros := n - len(values[slot])
+		m.slots[slot] = slotModel{Minutes: n, Median: quantileWithZeros(values[slot], zeros, 50),
+			Expected: quantileWithZeros(values[slot], zeros, d.Quantile)}
+	}
+	return m
+}
+
+// Returns the p-th percentile (0-100) of a sorted list of positive values,
+// preceded by a number of zeros that are not in the list
+func quantileWithZeros(sorted []float64, zeros int, p float64) float64 {
+	n := len(sorted) + zeros
+	if n == 0 {
+		return 0
+	}
+	idx := int(p/100*float64(n-1) + 0.5) // nearest rank
+	if idx < zeros {
+		return 0
+	}
+	return sorted[idx-zeros]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeekSlot(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want int
+	}{
+		{time.Date(2026, 1, 5, 0, 30, 0, 0, time.Local), 0},     // Monday
+		{time.Date(2026, 1, 6, 13, 0, 0, 0, time.Local), 37},    // Tuesday
+		{time.Date(2026, 1, 11, 23, 59, 0, 0, time.Local), 167}, // Sunday
+	}
+	for _, tt := range tests {
+		if got := weekSlot(tt.t); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestQuantileWithZeros(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		zeros  int
+		p      float64
+		want   float64
+	}{
+		{nil, 0, 50, 0},
+		{nil, 10, 95, 0},
+		{[]float64{5}, 0, 50, 5},
+		{[]float64{1, 2, 3}, 7, 50, 0},
+		{[]float64{1, 2, 3}, 7, 90, 2},
+		{[]float64{1, 2, 3}, 7, 100, 3},
+		{[]float64{1, 2, 3, 4}, 0, 50, 3},
+	}
+	for _, tt := range tests {
+		if got := quantileWithZeros(tt.sorted, tt.zeros, tt.p); got != tt.want {
+			t.Errorf("quantileWithZeros(%v, %v, %v) = %v, want %v", tt.sorted, tt.zeros, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestSeasonalComputeModel(t *testing.T) {
+	// Two weeks of traffic, only on Monday 20:00-21:00
+	current := time.Date(2026, 1, 19, 0, 0, 0, 0, time.Local)
+	start := current.AddDate(0, 0, -14)
+	dps := map[time.Time]*Datapoint{start: {BytesSent: 1}}
+	for week := 0; week < 2; week++ {
+		evening := start.AddDate(0, 0, 7*week).Add(20 * time.Hour)
+		for m := 0; m < 60; m++ {
+			dps[evening.Add(time.Duration(m)*time.Minute)] = &Datapoint{BytesSent: 1000}
+		}
+	}
+	d := &seasonalDetector{Quantile: 95}
+	m := d.computeModel(dps, current)
+
+	evening := m.slots[20]
+	if evening.Minutes != 120 || evening.Median != 1000 || evening.Expected != 1000 {
+		t.Errorf("evening slot: got %+v", evening)
+	}
+	night := m.slots[3]
+	if night.Minutes != 120 || night.Expected != 0 {
+		t.Errorf("night slot: got %+v", night)
+	}
+}